@@ -0,0 +1,319 @@
+//go:build linux
+
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
+)
+
+func newAttachCmd(log *zerolog.Logger) *attachCmd {
+	c := &attachCmd{}
+
+	cmd := &cobra.Command{
+		Use: "attach [flags]",
+		Example: strings.Join([]string{
+			"wirez attach --pid 1234 -F 127.0.0.1:1234",
+			"wirez attach --netns /run/netns/foo -F 127.0.0.1:1234"}, "\n"),
+		Short: "Proxy traffic of a running process or network namespace through the socks5 server",
+		Long: "Create a tun device in the network namespace of the running process or in the given one, " +
+			"replace its default route and transparently proxy the namespace traffic through the socks5 server until interrupted",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			netnsPath, err := c.opts.netnsPath()
+			if err != nil {
+				return
+			}
+			if err = c.opts.loadConfigFile(cmd.Flags()); err != nil {
+				return
+			}
+			log = c.opts.config.logger(log, cmd.Flags(), c.opts.VerboseLevel)
+			stackConfig, err := c.opts.newNetworkStackConfig(log)
+			if err != nil {
+				return
+			}
+
+			parentFd, childFd, err := newUnixSocketPair()
+			if err != nil {
+				return
+			}
+
+			proc := exec.Command("/proc/self/exe", "attachc",
+				"--unix-fd", strconv.Itoa(childFd), "--netns", netnsPath)
+			proc.Stdout = os.Stdout
+			proc.Stderr = os.Stderr
+			err = proc.Start()
+			// the child end is closed in the parent, so the socket reports EOF if the child fails to attach
+			unix.Close(childFd)
+			if err != nil {
+				unix.Close(parentFd)
+				return err
+			}
+			procDone := make(chan error, 1)
+			go func() {
+				procDone <- proc.Wait()
+			}()
+
+			parentConn := newParentUnixSocketConn(parentFd)
+			exited := false
+			defer func() {
+				// the child restores the default routes when the socket is closed
+				err = multierr.Append(err, parentConn.Close())
+				if !exited {
+					err = multierr.Append(err, <-procDone)
+				}
+			}()
+
+			if err = parentConn.SendNetworkConfig(c.opts.networkConfig("")); err != nil {
+				return err
+			}
+			closeStack, err := stackConfig.serveTun(parentConn)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				err = multierr.Append(err, closeStack())
+			}()
+			if err = parentConn.SendACK(); err != nil {
+				return err
+			}
+			log.Info().Str("netns", netnsPath).Msg("attached")
+
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+			select {
+			case <-ctx.Done():
+				log.Info().Str("netns", netnsPath).Msg("detaching...")
+				return nil
+			case err = <-procDone:
+				exited = true
+				return multierr.Append(errors.New("attach process exited unexpectedly"), err)
+			}
+		},
+	}
+
+	c.opts.initCliFlags(cmd)
+
+	c.cmd = cmd
+	return c
+}
+
+type attachCmd struct {
+	cmd  *cobra.Command
+	opts attachCmdOpts
+}
+
+type attachCmdOpts struct {
+	networkCmdOpts
+	PID   int
+	Netns string
+}
+
+func (o *attachCmdOpts) initCliFlags(cmd *cobra.Command) {
+	o.networkCmdOpts.initCliFlags(cmd)
+
+	cmd.Flags().IntVar(&o.PID, "pid", 0, "attach to the network namespace of the running process")
+	cmd.Flags().StringVar(&o.Netns, "netns", "", "attach to the network namespace bind-mounted at the path, e.g. /run/netns/foo")
+	netnsFlag := cmd.Flags().Lookup("netns")
+	netnsFlag.Value = &renamedTypeFlagValue{Value: netnsFlag.Value, name: "path"}
+}
+
+func (o *attachCmdOpts) netnsPath() (string, error) {
+	switch {
+	case o.PID > 0 && o.Netns != "":
+		return "", errors.New("only one of pid and netns can be specified")
+	case o.PID > 0:
+		return fmt.Sprintf("/proc/%d/ns/net", o.PID), nil
+	case o.Netns != "":
+		return o.Netns, nil
+	case o.PID < 0:
+		return "", errors.New("pid is negative")
+	}
+	return "", errors.New("pid or netns is required")
+}
+
+func newAttachContainerCmd() *attachContainerCmd {
+	c := &attachContainerCmd{}
+
+	cmd := &cobra.Command{
+		Use:     "attachc [flags]",
+		Example: "attachc --unix-fd=10 --netns /proc/1234/ns/net",
+		Short:   "Internal command to create a tun device in the existing network namespace",
+		Hidden:  true,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			// network namespace is a property of the thread, the thread is never
+			// unlocked so that it is not reused by other goroutines
+			runtime.LockOSThread()
+
+			childConn := newChildUnixSocketConn(c.opts.PipeFd)
+			defer childConn.Close()
+
+			netConfig, err := childConn.ReceiveNetworkConfig()
+			if err != nil {
+				return
+			}
+			if err = enterNetns(c.opts.Netns); err != nil {
+				return fmt.Errorf("enter netns: %w", err)
+			}
+
+			tunFds, err := openTun(tunDevice, netConfig.Queues)
+			if err != nil {
+				return fmt.Errorf("open tun: %w", err)
+			}
+			if netConfig.MTU > 0 {
+				if err = setLinkMTU(tunDevice, netConfig.MTU); err != nil {
+					closeFds(tunFds)
+					return fmt.Errorf("set mtu: %w", err)
+				}
+			}
+			err = childConn.SendFds(tunFds...)
+			// the parent owns the tun device now, it is removed when the parent exits
+			closeFds(tunFds)
+			if err != nil {
+				return
+			}
+
+			mtu, err := rawfile.GetMTU(tunDevice)
+			if err != nil {
+				return fmt.Errorf("get mtu: %w", err)
+			}
+			if err = childConn.SendMTU(mtu); err != nil {
+				return
+			}
+			if err = childConn.ReceiveACK(); err != nil {
+				return
+			}
+
+			routes, err := removeDefaultRoutes()
+			if err != nil {
+				return multierr.Append(fmt.Errorf("remove default routes: %w", err), restoreRoutes(routes))
+			}
+			if err = setupIPNetwork(netConfig); err != nil {
+				return multierr.Append(err, restoreRoutes(routes))
+			}
+
+			// wait until the parent detaches
+			err = childConn.WaitClose()
+			// the tun device may outlive the parent for a while, remove it
+			// together with its default routes before restoring the original ones
+			err = multierr.Append(err, deleteLink(tunDevice))
+			return multierr.Append(err, restoreRoutes(routes))
+		},
+	}
+
+	c.opts.initCliFlags(cmd)
+
+	c.cmd = cmd
+	return c
+}
+
+type attachContainerCmd struct {
+	cmd  *cobra.Command
+	opts attachContainerCmdOpts
+}
+
+type attachContainerCmdOpts struct {
+	PipeFd int
+	Netns  string
+}
+
+func (o *attachContainerCmdOpts) initCliFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&o.PipeFd, "unix-fd", 0, "set unix pipe fd")
+	cmd.Flags().StringVar(&o.Netns, "netns", "", "set network namespace path")
+}
+
+// WaitClose waits until the parent closes the socket.
+func (c *childUnixSocketConn) WaitClose() error {
+	for {
+		var msg struct{}
+		if err := c.decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// enterNetns moves the current thread to the network namespace.
+func enterNetns(path string) error {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.Setns(fd, unix.CLONE_NEWNET)
+}
+
+// removeDefaultRoutes deletes default routes of the main table, the deleted
+// routes are returned to restore them after detach.
+func removeDefaultRoutes() (routes []netlink.Route, err error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		familyRoutes, err := netlink.RouteListFiltered(family,
+			&netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			// IPv6 is disabled in the namespace
+			if family == netlink.FAMILY_V6 && errors.Is(err, unix.EAFNOSUPPORT) {
+				continue
+			}
+			return routes, err
+		}
+		for i := range familyRoutes {
+			route := familyRoutes[i]
+			if !isDefaultRoute(&route) {
+				continue
+			}
+			if err = netlink.RouteDel(&route); err != nil {
+				return routes, err
+			}
+			routes = append(routes, route)
+		}
+	}
+	return
+}
+
+func isDefaultRoute(route *netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+func restoreRoutes(routes []netlink.Route) (err error) {
+	for i := range routes {
+		if rerr := netlink.RouteAdd(&routes[i]); rerr != nil && !errors.Is(rerr, unix.EEXIST) {
+			err = multierr.Append(err, fmt.Errorf("restore route %s: %w", routes[i].String(), rerr))
+		}
+	}
+	return
+}
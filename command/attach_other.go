@@ -0,0 +1,50 @@
+//go:build !linux
+
+package command
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+func newAttachCmd(log *zerolog.Logger) *attachCmd {
+	c := &attachCmd{}
+
+	cmd := &cobra.Command{
+		Use:    "attach [flags]",
+		Short:  "Proxy traffic of a running process or network namespace through the socks5 server",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			return errors.New("this command is not supported by your OS")
+		},
+	}
+
+	c.cmd = cmd
+	return c
+}
+
+type attachCmd struct {
+	cmd *cobra.Command
+}
+
+func newAttachContainerCmd() *attachContainerCmd {
+	c := &attachContainerCmd{}
+
+	cmd := &cobra.Command{
+		Use:    "attachc [flags]",
+		Short:  "Internal command to create a tun device in the existing network namespace",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			return errors.New("this command is not supported by your OS")
+		},
+	}
+
+	c.cmd = cmd
+	return c
+}
+
+type attachContainerCmd struct {
+	cmd *cobra.Command
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package command
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestAttachNetnsPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        attachCmdOpts
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:     "PID",
+			opts:     attachCmdOpts{PID: 1234},
+			expected: "/proc/1234/ns/net",
+		},
+		{
+			name:     "Netns",
+			opts:     attachCmdOpts{Netns: "/run/netns/foo"},
+			expected: "/run/netns/foo",
+		},
+		{
+			name:        "PIDAndNetns",
+			opts:        attachCmdOpts{PID: 1234, Netns: "/run/netns/foo"},
+			expectedErr: true,
+		},
+		{
+			name:        "NegativePID",
+			opts:        attachCmdOpts{PID: -1},
+			expectedErr: true,
+		},
+		{
+			name:        "Missing",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := tt.opts.netnsPath()
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, path)
+		})
+	}
+}
+
+func TestIsDefaultRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		dst      string
+		expected bool
+	}{
+		{name: "NoDestination", expected: true},
+		{name: "IPv4Default", dst: "0.0.0.0/0", expected: true},
+		{name: "IPv6Default", dst: "::/0", expected: true},
+		{name: "IPv4Subnet", dst: "10.1.1.0/24"},
+		{name: "IPv4Host", dst: "10.1.1.1/32"},
+		{name: "IPv6Subnet", dst: "fd77:6972:657a::/64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := &netlink.Route{}
+			if tt.dst != "" {
+				_, dst, err := net.ParseCIDR(tt.dst)
+				require.NoError(t, err)
+				route.Dst = dst
+			}
+			require.Equal(t, tt.expected, isDefaultRoute(route))
+		})
+	}
+}
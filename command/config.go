@@ -5,12 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/v-byte-cpu/wirez/pkg/connect"
 )
@@ -50,6 +56,401 @@ func parseProxyURL(proxyURL string) (*connect.SocksAddr, error) {
 	return &connect.SocksAddr{Address: socksURL.Host, Auth: socksURL.User}, nil
 }
 
+// parseUsersFile parses server users, one per line in the following format:
+//
+//	username:password [rate=SIZE] [conn-rate=SIZE] [daily=SIZE] [monthly=SIZE]
+//
+// rate and conn-rate are bandwidth limits in bytes per second, daily and monthly are data quotas.
+func parseUsersFile(usersFile io.Reader) (users []*connect.User, err error) {
+	bs := bufio.NewScanner(usersFile)
+	for bs.Scan() {
+		line := strings.TrimSpace(bs.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, err := parseUser(line)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	err = bs.Err()
+	return
+}
+
+func parseUser(line string) (*connect.User, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, errors.New("empty user line")
+	}
+	name, password, ok := strings.Cut(fields[0], ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid user credentials %s", fields[0])
+	}
+	user := &connect.User{Name: name, Password: password}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid limit %s of user %s", field, name)
+		}
+		size, err := parseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %s of user %s: %w", field, name, err)
+		}
+		switch key {
+		case "rate":
+			user.Limits.Rate = size
+		case "conn-rate":
+			user.Limits.ConnRate = size
+		case "daily":
+			user.Limits.DailyQuota = size
+		case "monthly":
+			user.Limits.MonthlyQuota = size
+		default:
+			return nil, fmt.Errorf("unknown limit %s of user %s", key, name)
+		}
+	}
+	return user, nil
+}
+
+// parseByteSize parses a number of bytes with an optional binary K, M, G or T suffix, e.g. 512K or 10G
+func parseByteSize(input string) (int64, error) {
+	size := strings.TrimSuffix(strings.ToUpper(input), "B")
+	multiplier := int64(1)
+	if len(size) > 0 {
+		if idx := strings.IndexByte("KMGT", size[len(size)-1]); idx != -1 {
+			multiplier = 1 << (10 * (idx + 1))
+			size = size[:len(size)-1]
+		}
+	}
+	value, err := strconv.ParseUint(size, 10, 63)
+	if err != nil {
+		return 0, err
+	}
+	if int64(value) > math.MaxInt64/multiplier {
+		return 0, errors.New("byte size is too large")
+	}
+	return int64(value) * multiplier, nil
+}
+
+// parseRateLimit parses upload and download bandwidth limits in UPLOAD[:DOWNLOAD] format,
+// a single value limits both directions, an empty or zero value means unlimited.
+func parseRateLimit(input string) (limit connect.RateLimit, err error) {
+	upload, download, ok := strings.Cut(input, ":")
+	if !ok {
+		download = upload
+	}
+	if limit.Upload, err = parseOptionalByteSize(upload); err != nil {
+		return limit, fmt.Errorf("invalid upload rate limit %s: %w", input, err)
+	}
+	if limit.Download, err = parseOptionalByteSize(download); err != nil {
+		return limit, fmt.Errorf("invalid download rate limit %s: %w", input, err)
+	}
+	return
+}
+
+func parseOptionalByteSize(input string) (int64, error) {
+	if input == "" {
+		return 0, nil
+	}
+	return parseByteSize(input)
+}
+
+// parseShapingRules parses per-destination rate limits in IP[/CIDR]=UPLOAD[:DOWNLOAD] format.
+func parseShapingRules(rules []string) ([]*connect.ShapingRule, error) {
+	result := make([]*connect.ShapingRule, 0, len(rules))
+	for _, rule := range rules {
+		destination, rawLimit, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing rate limit in destination rule %s", rule)
+		}
+		ipNet, err := parseIPNet(destination)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination in rule %s: %w", rule, err)
+		}
+		limit, err := parseRateLimit(rawLimit)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &connect.ShapingRule{Destination: ipNet, Limit: limit})
+	}
+	return result, nil
+}
+
+// parseIPNet parses a CIDR network or a single IP address.
+func parseIPNet(input string) (*net.IPNet, error) {
+	if strings.Contains(input, "/") {
+		_, ipNet, err := net.ParseCIDR(input)
+		return ipNet, err
+	}
+	ip := net.ParseIP(input)
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// validateContainerNetwork checks container addresses in the ip/prefix format and
+// gateways that must belong to one of the container subnets.
+func validateContainerNetwork(addresses, gateways []string, mtu uint32) error {
+	if len(addresses) == 0 {
+		return errors.New("container subnets list is empty")
+	}
+	subnets := make([]*net.IPNet, 0, len(addresses))
+	hasIPv6 := false
+	for _, address := range addresses {
+		ip, subnet, err := net.ParseCIDR(address)
+		if err != nil {
+			return fmt.Errorf("invalid container subnet: %w", err)
+		}
+		hasIPv6 = hasIPv6 || ip.To4() == nil
+		subnets = append(subnets, subnet)
+	}
+
+	families := make(map[bool]bool, 2)
+	for _, gateway := range gateways {
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			return fmt.Errorf("invalid gateway: %s", gateway)
+		}
+		ipv6 := ip.To4() == nil
+		if families[ipv6] {
+			return fmt.Errorf("gateway %s: only one gateway per address family is allowed", gateway)
+		}
+		families[ipv6] = true
+		if !containsIP(subnets, ip) {
+			return fmt.Errorf("gateway %s is not in the container subnets", gateway)
+		}
+	}
+
+	switch {
+	case mtu == 0:
+	case mtu < 576 || mtu > math.MaxUint16:
+		return fmt.Errorf("invalid mtu: %d", mtu)
+	case hasIPv6 && mtu < 1280:
+		return fmt.Errorf("mtu %d is too small for IPv6, the minimum is 1280", mtu)
+	}
+	return nil
+}
+
+// builtinResolverIP returns the address of the built-in DNS resolver in the container
+// network, it is the host address, IPv4 is preferred over IPv6.
+func builtinResolverIP(addresses, gateways []string) (net.IP, error) {
+	hostIPs, err := containerHostIPs(addresses, gateways)
+	if err != nil {
+		return nil, err
+	}
+	if len(hostIPs) == 0 {
+		return nil, errors.New("no address for the built-in resolver in the container subnets")
+	}
+	return hostIPs[0], nil
+}
+
+// containerHostIPs returns addresses that represent the host in the container network,
+// one per address family: the gateway or the first host address of the first subnet
+// that isn't the container address. The IPv4 address goes first.
+func containerHostIPs(addresses, gateways []string) (hostIPs []net.IP, err error) {
+	for _, address := range addresses {
+		if _, _, err = net.ParseCIDR(address); err != nil {
+			return nil, err
+		}
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if ip := familyHostIP(addresses, gateways, ipv6); ip != nil {
+			hostIPs = append(hostIPs, ip)
+		}
+	}
+	return
+}
+
+func familyHostIP(addresses, gateways []string, ipv6 bool) net.IP {
+	for _, gateway := range gateways {
+		if ip := net.ParseIP(gateway); ip != nil && (ip.To4() == nil) == ipv6 {
+			return ip
+		}
+	}
+	for _, address := range addresses {
+		ip, subnet, err := net.ParseCIDR(address)
+		if err != nil || (ip.To4() == nil) != ipv6 {
+			continue
+		}
+		for i := 1; i <= 2; i++ {
+			hostIP := addIP(subnet.IP, i)
+			if !hostIP.Equal(ip) && subnet.Contains(hostIP) {
+				return hostIP
+			}
+		}
+	}
+	return nil
+}
+
+// containerIP returns the first container address of the address family,
+// the address of the other family is used if there is none.
+func containerIP(addresses []string, ipv6 bool) (net.IP, error) {
+	var fallback net.IP
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, err
+		}
+		if (ip.To4() == nil) == ipv6 {
+			return ip, nil
+		}
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+	if fallback == nil {
+		return nil, errors.New("container subnets list is empty")
+	}
+	return fallback, nil
+}
+
+// portMapping publishes the container port on the host address
+type portMapping struct {
+	network       string
+	hostAddress   string
+	containerPort string
+}
+
+// parsePortMapping parses the [hostip:]hostport:containerport[/proto] mapping,
+// the port is published on the host loopback address by default.
+func parsePortMapping(mapping string) (result *portMapping, err error) {
+	parts := strings.Split(mapping, "/")
+	network := "tcp"
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid port mapping %s", mapping)
+	}
+	if len(parts) == 2 {
+		network = parts[1]
+	}
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("invalid protocol in port mapping %s", mapping)
+	}
+	containerPort, rest, err := takeLastPort(parts[0])
+	if err != nil || containerPort == "0" {
+		return nil, fmt.Errorf("invalid container port in port mapping %s", mapping)
+	}
+	hostPort, rest, err := takeLastPort(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host port in port mapping %s", mapping)
+	}
+	hostIP, rest, err := takeLastHost(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host address in port mapping %s: %w", mapping, err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("invalid host address in port mapping %s", mapping)
+	}
+	if hostIP == "" {
+		hostIP = "127.0.0.1"
+	} else if net.ParseIP(hostIP) == nil {
+		return nil, fmt.Errorf("invalid host address in port mapping %s", mapping)
+	}
+	return &portMapping{
+		network:       network,
+		hostAddress:   net.JoinHostPort(hostIP, hostPort),
+		containerPort: containerPort,
+	}, nil
+}
+
+// parsePortRanges parses ports and inclusive port ranges in the port[-port] format.
+func parsePortRanges(ports []string) ([]connect.PortRange, error) {
+	result := make([]connect.PortRange, 0, len(ports))
+	for _, ports := range ports {
+		rawStart, rawEnd, isRange := strings.Cut(ports, "-")
+		start, err := strconv.ParseUint(rawStart, 10, 16)
+		if err != nil || start == 0 {
+			return nil, fmt.Errorf("invalid port %s", ports)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.ParseUint(rawEnd, 10, 16); err != nil || end < start {
+				return nil, fmt.Errorf("invalid port range %s", ports)
+			}
+		}
+		result = append(result, connect.PortRange{Start: uint16(start), End: uint16(end)})
+	}
+	return result, nil
+}
+
+func addIP(ip net.IP, n int) net.IP {
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	for i := len(result) - 1; i >= 0 && n > 0; i-- {
+		sum := int(result[i]) + n
+		result[i] = byte(sum)
+		n = sum >> 8
+	}
+	return result
+}
+
+// generateResolvConf generates resolv.conf content with the given nameservers.
+func generateResolvConf(nameservers []string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("# generated by wirez\n")
+	for _, nameserver := range nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return "", fmt.Errorf("invalid nameserver address: %s", nameserver)
+		}
+		fmt.Fprintf(&sb, "nameserver %s\n", nameserver)
+	}
+	return sb.String(), nil
+}
+
+// generateHosts generates /etc/hosts content with the container hostname and
+// additional host entries in the host:ip format.
+func generateHosts(hostname string, entries []string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("# generated by wirez\n")
+	sb.WriteString("127.0.0.1\tlocalhost\n")
+	sb.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	fmt.Fprintf(&sb, "127.0.1.1\t%s\n", hostname)
+	for _, entry := range entries {
+		host, ip, found := strings.Cut(entry, ":")
+		if !found || host == "" || strings.ContainsAny(host, " \t") {
+			return "", fmt.Errorf("invalid host entry: %s", entry)
+		}
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid host entry %s: invalid IP address", entry)
+		}
+		fmt.Fprintf(&sb, "%s\t%s\n", ip, host)
+	}
+	return sb.String(), nil
+}
+
+var sandboxNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+func validateSandboxName(name string) error {
+	if !sandboxNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid sandbox name: %q", name)
+	}
+	return nil
+}
+
+// sandboxBaseDir returns the runtime directory of named sandboxes.
+func sandboxBaseDir(runtimeDir string, euid int) string {
+	if runtimeDir != "" {
+		return filepath.Join(runtimeDir, "wirez")
+	}
+	if euid == 0 {
+		return "/run/wirez"
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("wirez-%d", euid))
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseProxyURLs(proxyURLs []string) ([]*connect.SocksAddr, error) {
 	result := make([]*connect.SocksAddr, 0, len(proxyURLs))
 	for _, proxyURL := range proxyURLs {
@@ -176,6 +577,68 @@ func (v *renamedTypeFlagValue) String() string {
 	return v.Value.String()
 }
 
+// timeoutsOpts are limits of relayed flows set with command line flags.
+type timeoutsOpts struct {
+	connect      time.Duration
+	tcpIdle      time.Duration
+	udpIdle      time.Duration
+	tcpLifetime  time.Duration
+	udpLifetime  time.Duration
+	tcpKeepAlive time.Duration
+}
+
+func (o *timeoutsOpts) initCliFlags(cmd *cobra.Command) {
+	defaults := connect.DefaultTimeouts()
+	cmd.Flags().DurationVar(&o.connect, "connect-timeout", defaults.Connect,
+		"max amount of time to connect to the destination through upstreams")
+	cmd.Flags().DurationVar(&o.tcpIdle, "tcp-idle-timeout", defaults.TCPIdle,
+		"close TCP flows without traffic in both directions for this long, 0 disables the timeout")
+	cmd.Flags().DurationVar(&o.udpIdle, "udp-idle-timeout", defaults.UDPIdle,
+		"close UDP flows without traffic in both directions for this long, 0 disables the timeout")
+	cmd.Flags().DurationVar(&o.tcpLifetime, "tcp-lifetime", defaults.TCPLifetime,
+		"close TCP flows after this long regardless of traffic, 0 means unlimited")
+	cmd.Flags().DurationVar(&o.udpLifetime, "udp-lifetime", defaults.UDPLifetime,
+		"close UDP flows after this long regardless of traffic, 0 means unlimited")
+	cmd.Flags().DurationVar(&o.tcpKeepAlive, "tcp-keepalive", defaults.TCPKeepAlive,
+		"period of keepalive probes of relayed TCP connections, 0 disables keepalive")
+}
+
+// timeouts returns limits of the flags, config file values are used for flags not set on the command line.
+func (o *timeoutsOpts) timeouts(flags *pflag.FlagSet, config *fileConfig) (connect.Timeouts, error) {
+	result := connect.Timeouts{
+		Connect:      o.connect,
+		TCPIdle:      o.tcpIdle,
+		UDPIdle:      o.udpIdle,
+		TCPLifetime:  o.tcpLifetime,
+		UDPLifetime:  o.udpLifetime,
+		TCPKeepAlive: o.tcpKeepAlive,
+	}
+	fields := map[string]*time.Duration{
+		"connect-timeout":  &result.Connect,
+		"tcp-idle-timeout": &result.TCPIdle,
+		"udp-idle-timeout": &result.UDPIdle,
+		"tcp-lifetime":     &result.TCPLifetime,
+		"udp-lifetime":     &result.UDPLifetime,
+		"tcp-keepalive":    &result.TCPKeepAlive,
+	}
+	if config != nil {
+		for _, timeout := range config.Timeouts.values() {
+			if timeout.value != nil && !flags.Changed(timeout.flag) {
+				*fields[timeout.flag] = *timeout.value
+			}
+		}
+	}
+	for _, timeout := range (&timeoutsFileConfig{}).values() {
+		if *fields[timeout.flag] < 0 {
+			return result, fmt.Errorf("%s is negative", timeout.flag)
+		}
+	}
+	if result.Connect == 0 {
+		return result, errors.New("connect-timeout must be positive")
+	}
+	return result, nil
+}
+
 func setLogLevel(log *zerolog.Logger, verboseLevel int) *zerolog.Logger {
 	level := zerolog.InfoLevel
 	switch {
@@ -186,6 +649,7 @@ func setLogLevel(log *zerolog.Logger, verboseLevel int) *zerolog.Logger {
 	case verboseLevel >= 2:
 		level = zerolog.TraceLevel
 	}
-	result := log.Level(level)
-	return &result
+	// the global level can be changed at runtime with the control API
+	zerolog.SetGlobalLevel(level)
+	return log
 }
@@ -0,0 +1,345 @@
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/pflag"
+	"github.com/v-byte-cpu/wirez/pkg/connect"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the YAML config file shared by run and server commands:
+//
+//	log:
+//	  level: debug
+//	timeouts:
+//	  connect: 5s
+//	  tcp-idle: 2m
+//	  udp-idle: 30s
+//	  tcp-lifetime: 24h
+//	  tcp-keepalive: 15s
+//	upstreams:
+//	  - name: tor
+//	    url: socks5://127.0.0.1:9050
+//	  - name: eu1
+//	    url: user:pass@10.0.0.1:1080
+//	chains:
+//	  - name: tor-eu1
+//	    upstreams: [tor, eu1]
+//	pools:
+//	  - name: eu
+//	    members: [eu1, tor-eu1]
+//	run:
+//	  forward: tor-eu1
+//	  local:
+//	    - 53:1.1.1.1:53/udp
+//	server:
+//	  forward: eu
+//	  listen:
+//	    - url: 127.0.0.1:1080
+//	    - url: unix:///run/wirez.sock
+//	      forward: tor
+//	  users: users.txt
+//	  quota-state: quota.json
+//	  grace-period: 1m
+//
+// Chains send traffic through each upstream in order, pools load balance flows
+// between their upstreams and chains. Forward names refer to any of them.
+type fileConfig struct {
+	Log       logFileConfig        `yaml:"log"`
+	Timeouts  timeoutsFileConfig   `yaml:"timeouts"`
+	Upstreams []upstreamFileConfig `yaml:"upstreams"`
+	Chains    []chainFileConfig    `yaml:"chains"`
+	Pools     []poolFileConfig     `yaml:"pools"`
+	Run       runFileConfig        `yaml:"run"`
+	Server    serverFileConfig     `yaml:"server"`
+
+	// routes are proxy paths of forward names, each path is a chain of proxies
+	routes map[string][][]*connect.SocksAddr
+}
+
+type logFileConfig struct {
+	Level string `yaml:"level"`
+}
+
+// timeoutsFileConfig values are nil if they are not set, zero values disable limits.
+type timeoutsFileConfig struct {
+	Connect      *time.Duration `yaml:"connect"`
+	TCPIdle      *time.Duration `yaml:"tcp-idle"`
+	UDPIdle      *time.Duration `yaml:"udp-idle"`
+	TCPLifetime  *time.Duration `yaml:"tcp-lifetime"`
+	UDPLifetime  *time.Duration `yaml:"udp-lifetime"`
+	TCPKeepAlive *time.Duration `yaml:"tcp-keepalive"`
+}
+
+type upstreamFileConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+type chainFileConfig struct {
+	Name      string   `yaml:"name"`
+	Upstreams []string `yaml:"upstreams"`
+}
+
+type poolFileConfig struct {
+	Name    string   `yaml:"name"`
+	Members []string `yaml:"members"`
+}
+
+type runFileConfig struct {
+	Forward string   `yaml:"forward"`
+	Local   []string `yaml:"local"`
+}
+
+type serverFileConfig struct {
+	Forward     string               `yaml:"forward"`
+	Listen      []listenerFileConfig `yaml:"listen"`
+	Users       string               `yaml:"users"`
+	QuotaState  string               `yaml:"quota-state"`
+	GracePeriod time.Duration        `yaml:"grace-period"`
+}
+
+type listenerFileConfig struct {
+	URL     string `yaml:"url"`
+	Forward string `yaml:"forward"`
+}
+
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigFile(path, data)
+}
+
+// parseConfigFile decodes and validates the config file, errors are prefixed
+// with the file name and the line of the offending value.
+func parseConfigFile(path string, data []byte) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, configDecodeError(path, err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, configDecodeError(path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		var lineErr *configLineError
+		if errors.As(err, &lineErr) {
+			return nil, fmt.Errorf("%s:%d: %s", path, nodeLine(&root, lineErr.path...), lineErr.msg)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func configDecodeError(path string, err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		msg := strings.TrimPrefix(err.Error(), "yaml: ")
+		if strings.HasPrefix(msg, "line ") {
+			return errors.New(path + ":" + strings.TrimPrefix(msg, "line "))
+		}
+		return errors.New(path + ": " + msg)
+	}
+	msgs := make([]string, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		msg = strings.TrimPrefix(msg, "line ")
+		// hide Go type names of unknown fields
+		if before, _, ok := strings.Cut(msg, " not found in type "); ok {
+			msg = strings.Replace(before, "field ", "unknown field ", 1)
+		}
+		msgs = append(msgs, path+":"+msg)
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// configLineError is a validation error of the value at the path of mapping keys and sequence indexes.
+type configLineError struct {
+	path []interface{}
+	msg  string
+}
+
+func (e *configLineError) Error() string {
+	return e.msg
+}
+
+func lineErrorf(path []interface{}, format string, args ...interface{}) error {
+	return &configLineError{path: path, msg: fmt.Sprintf(format, args...)}
+}
+
+// nodeLine returns the line of the node at the path, or of its deepest existing parent.
+func nodeLine(node *yaml.Node, path ...interface{}) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		return nodeLine(node.Content[0], path...)
+	}
+	if len(path) == 0 {
+		return node.Line
+	}
+	switch key := path[0].(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			break
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return nodeLine(node.Content[i+1], path[1:]...)
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+			return nodeLine(node.Content[key], path[1:]...)
+		}
+	}
+	return node.Line
+}
+
+func (c *fileConfig) validate() error {
+	if c.Log.Level != "" {
+		if _, err := zerolog.ParseLevel(c.Log.Level); err != nil {
+			return lineErrorf([]interface{}{"log", "level"}, "invalid log level %s", c.Log.Level)
+		}
+	}
+	for _, timeout := range c.Timeouts.values() {
+		if timeout.value != nil && *timeout.value < 0 {
+			return lineErrorf([]interface{}{"timeouts", timeout.key}, "negative %s timeout", timeout.key)
+		}
+	}
+	if c.Timeouts.Connect != nil && *c.Timeouts.Connect == 0 {
+		return lineErrorf([]interface{}{"timeouts", "connect"}, "zero connect timeout")
+	}
+
+	c.routes = make(map[string][][]*connect.SocksAddr)
+	addRoute := func(path []interface{}, name string, route [][]*connect.SocksAddr) error {
+		if name == "" {
+			return lineErrorf(path, "name is required")
+		}
+		if _, exists := c.routes[name]; exists {
+			return lineErrorf(append(path, "name"), "duplicate name %s", name)
+		}
+		c.routes[name] = route
+		return nil
+	}
+	upstreams := make(map[string]*connect.SocksAddr, len(c.Upstreams))
+	for i, upstream := range c.Upstreams {
+		path := []interface{}{"upstreams", i}
+		socksAddr, err := parseProxyURL(upstream.URL)
+		if err != nil {
+			return lineErrorf(append(path, "url"), "invalid upstream url %s: %v", upstream.URL, err)
+		}
+		if err = addRoute(path, upstream.Name, [][]*connect.SocksAddr{{socksAddr}}); err != nil {
+			return err
+		}
+		upstreams[upstream.Name] = socksAddr
+	}
+	chains := make(map[string][]*connect.SocksAddr, len(c.Chains))
+	for i, chain := range c.Chains {
+		path := []interface{}{"chains", i}
+		if len(chain.Upstreams) == 0 {
+			return lineErrorf(path, "chain %s has no upstreams", chain.Name)
+		}
+		hops := make([]*connect.SocksAddr, 0, len(chain.Upstreams))
+		for j, name := range chain.Upstreams {
+			socksAddr, ok := upstreams[name]
+			if !ok {
+				return lineErrorf(append(path, "upstreams", j), "unknown upstream %s", name)
+			}
+			hops = append(hops, socksAddr)
+		}
+		if err := addRoute(path, chain.Name, [][]*connect.SocksAddr{hops}); err != nil {
+			return err
+		}
+		chains[chain.Name] = hops
+	}
+	for i, pool := range c.Pools {
+		path := []interface{}{"pools", i}
+		if len(pool.Members) == 0 {
+			return lineErrorf(path, "pool %s has no members", pool.Name)
+		}
+		paths := make([][]*connect.SocksAddr, 0, len(pool.Members))
+		for j, name := range pool.Members {
+			if socksAddr, ok := upstreams[name]; ok {
+				paths = append(paths, []*connect.SocksAddr{socksAddr})
+			} else if hops, ok := chains[name]; ok {
+				paths = append(paths, hops)
+			} else {
+				return lineErrorf(append(path, "members", j), "unknown upstream or chain %s", name)
+			}
+		}
+		if err := addRoute(path, pool.Name, paths); err != nil {
+			return err
+		}
+	}
+
+	if err := c.checkForward([]interface{}{"run", "forward"}, c.Run.Forward); err != nil {
+		return err
+	}
+	for i, mapping := range c.Run.Local {
+		if _, _, _, err := parseMapping(mapping); err != nil {
+			return lineErrorf([]interface{}{"run", "local", i}, "%v", err)
+		}
+	}
+	if err := c.checkForward([]interface{}{"server", "forward"}, c.Server.Forward); err != nil {
+		return err
+	}
+	for i, listener := range c.Server.Listen {
+		path := []interface{}{"server", "listen", i}
+		if _, err := parseListenURL(listener.URL); err != nil {
+			return lineErrorf(append(path, "url"), "invalid listen address %s: %v", listener.URL, err)
+		}
+		if err := c.checkForward(append(path, "forward"), listener.Forward); err != nil {
+			return err
+		}
+	}
+	if c.Server.GracePeriod < 0 {
+		return lineErrorf([]interface{}{"server", "grace-period"}, "negative grace period")
+	}
+	return nil
+}
+
+func (c *fileConfig) checkForward(path []interface{}, name string) error {
+	if _, ok := c.routes[name]; name != "" && !ok {
+		return lineErrorf(path, "unknown upstream, chain or pool %s", name)
+	}
+	return nil
+}
+
+type timeoutFileValue struct {
+	key   string
+	flag  string
+	value *time.Duration
+}
+
+// values returns timeouts with their keys and names of corresponding command line flags.
+func (c *timeoutsFileConfig) values() []timeoutFileValue {
+	return []timeoutFileValue{
+		{"connect", "connect-timeout", c.Connect},
+		{"tcp-idle", "tcp-idle-timeout", c.TCPIdle},
+		{"udp-idle", "udp-idle-timeout", c.UDPIdle},
+		{"tcp-lifetime", "tcp-lifetime", c.TCPLifetime},
+		{"udp-lifetime", "udp-lifetime", c.UDPLifetime},
+		{"tcp-keepalive", "tcp-keepalive", c.TCPKeepAlive},
+	}
+}
+
+// logger returns the logger with the level of the verbose flag,
+// the config file level is used if the flag is not set on the command line.
+func (c *fileConfig) logger(log *zerolog.Logger, flags *pflag.FlagSet, verboseLevel int) *zerolog.Logger {
+	if c == nil || c.Log.Level == "" || flags.Changed("verbose") {
+		return setLogLevel(log, verboseLevel)
+	}
+	// the level is validated on load
+	level, _ := zerolog.ParseLevel(c.Log.Level)
+	zerolog.SetGlobalLevel(level)
+	return log
+}
@@ -0,0 +1,244 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	"github.com/v-byte-cpu/wirez/pkg/connect"
+)
+
+const testConfigFile = `
+log:
+  level: debug
+timeouts:
+  connect: 5s
+  tcp-idle: 2m
+  tcp-lifetime: 0s
+upstreams:
+  - name: tor
+    url: socks5://127.0.0.1:9050
+  - name: eu1
+    url: user:pass@10.0.0.1:1080
+chains:
+  - name: tor-eu1
+    upstreams: [tor, eu1]
+pools:
+  - name: eu
+    members: [eu1, tor-eu1]
+run:
+  forward: tor-eu1
+  local:
+    - 53:1.1.1.1:53/udp
+server:
+  forward: eu
+  listen:
+    - url: 127.0.0.1:1080
+    - url: unix:///run/wirez.sock
+      forward: tor
+  users: users.txt
+  grace-period: 1m
+`
+
+func TestParseConfigFile(t *testing.T) {
+	cfg, err := parseConfigFile("wirez.yaml", []byte(testConfigFile))
+	require.NoError(t, err)
+
+	tor := &connect.SocksAddr{Address: "127.0.0.1:9050"}
+	eu1, err := parseProxyURL("user:pass@10.0.0.1:1080")
+	require.NoError(t, err)
+	require.Equal(t, map[string][][]*connect.SocksAddr{
+		"tor":     {{tor}},
+		"eu1":     {{eu1}},
+		"tor-eu1": {{tor, eu1}},
+		"eu":      {{eu1}, {tor, eu1}},
+	}, cfg.routes)
+	require.Equal(t, 2*time.Minute, *cfg.Timeouts.TCPIdle)
+	require.Equal(t, time.Duration(0), *cfg.Timeouts.TCPLifetime)
+	require.Nil(t, cfg.Timeouts.UDPIdle)
+	require.Equal(t, []string{"53:1.1.1.1:53/udp"}, cfg.Run.Local)
+	require.Equal(t, []listenerFileConfig{{URL: "127.0.0.1:1080"}, {URL: "unix:///run/wirez.sock", Forward: "tor"}}, cfg.Server.Listen)
+	require.Equal(t, time.Minute, cfg.Server.GracePeriod)
+
+	cfg, err = parseConfigFile("empty.yaml", nil)
+	require.NoError(t, err)
+	require.Empty(t, cfg.routes)
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expectedErr string
+	}{
+		{
+			name:        "UnknownField",
+			input:       "upstreams:\n  - name: tor\n    address: 127.0.0.1:9050\n",
+			expectedErr: "wirez.yaml:3: unknown field address",
+		},
+		{
+			name:        "InvalidDuration",
+			input:       "timeouts:\n  connect: soon\n",
+			expectedErr: "wirez.yaml:2: cannot unmarshal !!str `soon` into time.Duration",
+		},
+		{
+			name:        "NegativeTimeout",
+			input:       "timeouts:\n  connect: 5s\n  udp-lifetime: -1s\n",
+			expectedErr: "wirez.yaml:3: negative udp-lifetime timeout",
+		},
+		{
+			name:        "ZeroConnectTimeout",
+			input:       "timeouts:\n  connect: 0s\n",
+			expectedErr: "wirez.yaml:2: zero connect timeout",
+		},
+		{
+			name:        "InvalidSyntax",
+			input:       "run:\n  forward: tor\n  local: - 53:1.1.1.1:53\n",
+			expectedErr: "wirez.yaml:3: ",
+		},
+		{
+			name:        "InvalidLogLevel",
+			input:       "log:\n  level: loud\n",
+			expectedErr: "wirez.yaml:2: invalid log level loud",
+		},
+		{
+			name:        "InvalidUpstreamURL",
+			input:       "upstreams:\n  - name: tor\n    url: http://127.0.0.1:9050\n",
+			expectedErr: "wirez.yaml:3: invalid upstream url http://127.0.0.1:9050: invalid socks5 scheme",
+		},
+		{
+			name:        "MissingName",
+			input:       "upstreams:\n  - url: 127.0.0.1:9050\n",
+			expectedErr: "wirez.yaml:2: name is required",
+		},
+		{
+			name:        "DuplicateName",
+			input:       "upstreams:\n  - name: tor\n    url: 127.0.0.1:9050\nchains:\n  - name: tor\n    upstreams: [tor]\n",
+			expectedErr: "wirez.yaml:5: duplicate name tor",
+		},
+		{
+			name:        "UnknownChainUpstream",
+			input:       "upstreams:\n  - name: tor\n    url: 127.0.0.1:9050\nchains:\n  - name: c\n    upstreams:\n      - tor\n      - eu\n",
+			expectedErr: "wirez.yaml:8: unknown upstream eu",
+		},
+		{
+			name:        "PoolOfPools",
+			input:       "upstreams:\n  - name: tor\n    url: 127.0.0.1:9050\npools:\n  - name: a\n    members: [tor]\n  - name: b\n    members: [a]\n",
+			expectedErr: "wirez.yaml:8: unknown upstream or chain a",
+		},
+		{
+			name:        "UnknownForward",
+			input:       "server:\n  listen:\n    - url: 127.0.0.1:1080\n      forward: eu\n",
+			expectedErr: "wirez.yaml:4: unknown upstream, chain or pool eu",
+		},
+		{
+			name:        "InvalidLocalMapping",
+			input:       "run:\n  local:\n    - 53:1.1.1.1:53/udp\n    - 1.1.1.1\n",
+			expectedErr: "wirez.yaml:4: invalid target port in mapping 1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfigFile("wirez.yaml", []byte(tt.input))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.expectedErr)
+		})
+	}
+}
+
+func TestServerConfigFileOverrides(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "wirez.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(testConfigFile), 0o600))
+
+	log := zerolog.Nop()
+	c := newServerCmd(&log)
+	c.cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return c.opts.loadConfigFile(cmd.Flags())
+	}
+	c.cmd.SetArgs([]string{"--config", configFile, "--users", "cli-users.txt", "-f", "eu.txt"})
+	require.NoError(t, c.cmd.Execute())
+
+	require.Equal(t, "cli-users.txt", c.opts.usersFile)
+	require.Equal(t, time.Minute, c.opts.gracePeriod)
+	require.Len(t, c.opts.listeners, 2)
+	// the proxies file flag overrides the default forward of the config file
+	require.Equal(t, upstreamsKey{proxyFile: "eu.txt"}, c.opts.upstreams(c.opts.listeners[0]))
+	require.Equal(t, upstreamsKey{forward: "tor"}, c.opts.upstreams(c.opts.listeners[1]))
+}
+
+func TestTimeoutsOpts(t *testing.T) {
+	cfg, err := parseConfigFile("wirez.yaml", []byte(testConfigFile))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		args        []string
+		config      *fileConfig
+		expected    connect.Timeouts
+		expectedErr string
+	}{
+		{
+			name:     "Defaults",
+			expected: connect.DefaultTimeouts(),
+		},
+		{
+			name: "Flags",
+			args: []string{"--connect-timeout", "10s", "--tcp-idle-timeout", "0", "--udp-lifetime", "1h", "--tcp-keepalive", "0"},
+			expected: connect.Timeouts{
+				Connect:     10 * time.Second,
+				UDPIdle:     connect.DefaultTimeouts().UDPIdle,
+				UDPLifetime: time.Hour,
+			},
+		},
+		{
+			name:   "ConfigFile",
+			config: cfg,
+			expected: connect.Timeouts{
+				Connect:      5 * time.Second,
+				TCPIdle:      2 * time.Minute,
+				UDPIdle:      connect.DefaultTimeouts().UDPIdle,
+				TCPKeepAlive: connect.DefaultTimeouts().TCPKeepAlive,
+			},
+		},
+		{
+			name:   "FlagsOverrideConfigFile",
+			args:   []string{"--tcp-idle-timeout", "0"},
+			config: cfg,
+			expected: connect.Timeouts{
+				Connect:      5 * time.Second,
+				UDPIdle:      connect.DefaultTimeouts().UDPIdle,
+				TCPKeepAlive: connect.DefaultTimeouts().TCPKeepAlive,
+			},
+		},
+		{
+			name:        "NegativeTimeout",
+			args:        []string{"--tcp-lifetime", "-1s"},
+			expectedErr: "tcp-lifetime is negative",
+		},
+		{
+			name:        "ZeroConnectTimeout",
+			args:        []string{"--connect-timeout", "0"},
+			expectedErr: "connect-timeout must be positive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts timeoutsOpts
+			cmd := &cobra.Command{}
+			opts.initCliFlags(cmd)
+			require.NoError(t, cmd.Flags().Parse(tt.args))
+
+			timeouts, err := opts.timeouts(cmd.Flags(), tt.config)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, timeouts)
+		})
+	}
+}
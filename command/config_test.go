@@ -1,7 +1,10 @@
 package command
 
 import (
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -435,3 +438,406 @@ func TestParseAddressMapper(t *testing.T) {
 		require.Equal(t, "127.0.0.1:4444", targetAddress)
 	})
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    int64
+		expectedErr bool
+	}{
+		{name: "Bytes", input: "100", expected: 100},
+		{name: "BytesWithSuffix", input: "100B", expected: 100},
+		{name: "Kilobytes", input: "512K", expected: 512 << 10},
+		{name: "LowercaseMegabytes", input: "2mb", expected: 2 << 20},
+		{name: "Gigabytes", input: "10G", expected: 10 << 30},
+		{name: "Terabytes", input: "1T", expected: 1 << 40},
+		{name: "Empty", input: "", expectedErr: true},
+		{name: "SuffixOnly", input: "K", expectedErr: true},
+		{name: "Negative", input: "-1K", expectedErr: true},
+		{name: "InvalidSuffix", input: "1X", expectedErr: true},
+		{name: "Overflow", input: "9223372036854775807K", expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := parseByteSize(tt.input)
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, size)
+		})
+	}
+}
+
+func TestParseUsersFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    []*connect.User
+		expectedErr bool
+	}{
+		{
+			name:  "EmptyWithComments",
+			input: "  \n# abc:def\n",
+		},
+		{
+			name:     "LineWithOnlyTab",
+			input:    "abc:def\n\t\n\tghi:jkl\t\n",
+			expected: []*connect.User{{Name: "abc", Password: "def"}, {Name: "ghi", Password: "jkl"}},
+		},
+		{
+			name:     "UserWithoutLimits",
+			input:    "abc:def",
+			expected: []*connect.User{{Name: "abc", Password: "def"}},
+		},
+		{
+			name:     "UserWithEmptyPassword",
+			input:    "abc:",
+			expected: []*connect.User{{Name: "abc"}},
+		},
+		{
+			name:  "TwoUsersWithLimits",
+			input: "abc:def rate=1M conn-rate=256K\n  ghi:jkl daily=10G monthly=100G  ",
+			expected: []*connect.User{
+				{Name: "abc", Password: "def", Limits: connect.UserLimits{Rate: 1 << 20, ConnRate: 256 << 10}},
+				{Name: "ghi", Password: "jkl", Limits: connect.UserLimits{DailyQuota: 10 << 30, MonthlyQuota: 100 << 30}},
+			},
+		},
+		{
+			name:        "MissingPassword",
+			input:       "abc",
+			expectedErr: true,
+		},
+		{
+			name:        "UnknownLimit",
+			input:       "abc:def speed=1M",
+			expectedErr: true,
+		},
+		{
+			name:        "InvalidLimitValue",
+			input:       "abc:def rate=fast",
+			expectedErr: true,
+		},
+		{
+			name:        "LimitWithoutValue",
+			input:       "abc:def rate",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := parseUsersFile(strings.NewReader(tt.input))
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, users)
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    connect.RateLimit
+		expectedErr bool
+	}{
+		{name: "Empty", input: ""},
+		{name: "SingleValue", input: "1M", expected: connect.RateLimit{Upload: 1 << 20, Download: 1 << 20}},
+		{name: "UploadDownload", input: "512K:10M", expected: connect.RateLimit{Upload: 512 << 10, Download: 10 << 20}},
+		{name: "UploadOnly", input: "512K:", expected: connect.RateLimit{Upload: 512 << 10}},
+		{name: "DownloadOnly", input: ":10M", expected: connect.RateLimit{Download: 10 << 20}},
+		{name: "Unlimited", input: "0:0"},
+		{name: "InvalidUpload", input: "abc:1M", expectedErr: true},
+		{name: "InvalidDownload", input: "1M:abc", expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, err := parseRateLimit(tt.input)
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, limit)
+		})
+	}
+}
+
+func TestParseShapingRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       []string
+		expected    []*connect.ShapingRule
+		expectedErr bool
+	}{
+		{
+			name:  "CIDR",
+			input: []string{"10.0.0.0/8=0"},
+			expected: []*connect.ShapingRule{{Destination: &net.IPNet{
+				IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}}},
+		},
+		{
+			name:  "IPv4Address",
+			input: []string{"1.2.3.4=1M:2M"},
+			expected: []*connect.ShapingRule{{Destination: &net.IPNet{
+				IP: net.IP{1, 2, 3, 4}, Mask: net.CIDRMask(32, 32)},
+				Limit: connect.RateLimit{Upload: 1 << 20, Download: 2 << 20}}},
+		},
+		{
+			name:  "IPv6Address",
+			input: []string{"2001:db8::1=1M"},
+			expected: []*connect.ShapingRule{{Destination: &net.IPNet{
+				IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)},
+				Limit: connect.RateLimit{Upload: 1 << 20, Download: 1 << 20}}},
+		},
+		{
+			name:        "MissingLimit",
+			input:       []string{"10.0.0.0/8"},
+			expectedErr: true,
+		},
+		{
+			name:        "InvalidDestination",
+			input:       []string{"example.com=1M"},
+			expectedErr: true,
+		},
+		{
+			name:        "InvalidLimit",
+			input:       []string{"10.0.0.0/8=fast"},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseShapingRules(tt.input)
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, rules)
+		})
+	}
+}
+
+func TestValidateContainerNetwork(t *testing.T) {
+	tests := []struct {
+		name        string
+		addresses   []string
+		gateways    []string
+		mtu         uint32
+		expectedErr bool
+	}{
+		{
+			name:      "Defaults",
+			addresses: []string{"10.1.1.1/24", "fd77:6972:657a::1/64"},
+		},
+		{
+			name:      "Gateways",
+			addresses: []string{"192.168.77.2/24", "fd00::2/64"},
+			gateways:  []string{"192.168.77.1", "fd00::1"},
+			mtu:       1400,
+		},
+		{
+			name:        "EmptySubnets",
+			expectedErr: true,
+		},
+		{
+			name:        "InvalidSubnet",
+			addresses:   []string{"10.1.1.1"},
+			expectedErr: true,
+		},
+		{
+			name:        "GatewayOutsideSubnet",
+			addresses:   []string{"10.1.1.1/24"},
+			gateways:    []string{"10.1.2.1"},
+			expectedErr: true,
+		},
+		{
+			name:        "TwoGatewaysOfSameFamily",
+			addresses:   []string{"10.1.1.1/24"},
+			gateways:    []string{"10.1.1.2", "10.1.1.3"},
+			expectedErr: true,
+		},
+		{
+			name:        "InvalidMTU",
+			addresses:   []string{"10.1.1.1/24"},
+			mtu:         100,
+			expectedErr: true,
+		},
+		{
+			name:        "SmallMTUWithIPv6",
+			addresses:   []string{"10.1.1.1/24", "fd00::2/64"},
+			mtu:         1000,
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateContainerNetwork(tt.addresses, tt.gateways, tt.mtu)
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestBuiltinResolverIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		gateways  []string
+		expected  string
+	}{
+		{name: "Defaults", addresses: []string{"10.1.1.1/24", "fd77:6972:657a::1/64"}, expected: "10.1.1.2"},
+		{name: "ContainerFirstHost", addresses: []string{"192.168.77.2/24"}, expected: "192.168.77.1"},
+		{name: "Gateway", addresses: []string{"192.168.77.2/24"}, gateways: []string{"192.168.77.254"}, expected: "192.168.77.254"},
+		{name: "IPv6Only", addresses: []string{"fd00::1/64"}, expected: "fd00::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := builtinResolverIP(tt.addresses, tt.gateways)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ip.String())
+		})
+	}
+
+	_, err := builtinResolverIP([]string{"10.1.1.1/32"}, nil)
+	require.Error(t, err)
+}
+
+func TestContainerHostIPs(t *testing.T) {
+	ips, err := containerHostIPs([]string{"fd77:6972:657a::1/64", "10.1.1.1/24"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("10.1.1.2").To4(), net.ParseIP("fd77:6972:657a::2")}, ips)
+
+	_, err = containerHostIPs([]string{"10.1.1.1"}, nil)
+	require.Error(t, err)
+}
+
+func TestContainerIP(t *testing.T) {
+	addresses := []string{"10.1.1.1/24", "fd77:6972:657a::1/64"}
+	ip, err := containerIP(addresses, false)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.1.1", ip.String())
+
+	ip, err = containerIP(addresses, true)
+	require.NoError(t, err)
+	require.Equal(t, "fd77:6972:657a::1", ip.String())
+
+	ip, err = containerIP([]string{"10.1.1.1/24"}, true)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.1.1", ip.String())
+
+	_, err = containerIP(nil, false)
+	require.Error(t, err)
+}
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    *portMapping
+		expectedErr bool
+	}{
+		{
+			name:     "Ports",
+			input:    "8080:80",
+			expected: &portMapping{network: "tcp", hostAddress: "127.0.0.1:8080", containerPort: "80"},
+		},
+		{
+			name:     "HostIP",
+			input:    "0.0.0.0:8080:80",
+			expected: &portMapping{network: "tcp", hostAddress: "0.0.0.0:8080", containerPort: "80"},
+		},
+		{
+			name:     "HostIPv6",
+			input:    "[::1]:8080:80/tcp",
+			expected: &portMapping{network: "tcp", hostAddress: "[::1]:8080", containerPort: "80"},
+		},
+		{
+			name:     "UDP",
+			input:    "5353:53/udp",
+			expected: &portMapping{network: "udp", hostAddress: "127.0.0.1:5353", containerPort: "53"},
+		},
+		{
+			name:     "AnyHostPort",
+			input:    "0:80",
+			expected: &portMapping{network: "tcp", hostAddress: "127.0.0.1:0", containerPort: "80"},
+		},
+		{name: "ContainerPortOnly", input: "80", expectedErr: true},
+		{name: "ZeroContainerPort", input: "8080:0", expectedErr: true},
+		{name: "InvalidPort", input: "8080:http", expectedErr: true},
+		{name: "InvalidProtocol", input: "8080:80/sctp", expectedErr: true},
+		{name: "InvalidHostIP", input: "localhost:8080:80", expectedErr: true},
+		{name: "ExtraParts", input: "1.1.1.1:1:8080:80", expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parsePortMapping(tt.input)
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := parsePortRanges([]string{"5432", "8000-8100"})
+	require.NoError(t, err)
+	require.Equal(t, []connect.PortRange{{Start: 5432, End: 5432}, {Start: 8000, End: 8100}}, ranges)
+
+	for _, input := range []string{"", "0", "65536", "http", "8100-8000", "8000-", "1-2-3"} {
+		_, err = parsePortRanges([]string{input})
+		require.Error(t, err, input)
+	}
+}
+
+func TestGenerateResolvConf(t *testing.T) {
+	content, err := generateResolvConf([]string{"10.1.1.2", "fd00::2"})
+	require.NoError(t, err)
+	require.Equal(t, "# generated by wirez\nnameserver 10.1.1.2\nnameserver fd00::2\n", content)
+
+	_, err = generateResolvConf([]string{"dns.local"})
+	require.Error(t, err)
+}
+
+func TestGenerateHosts(t *testing.T) {
+	content, err := generateHosts("box", []string{"db.local:10.0.0.5", "v6.local:fd00::5"})
+	require.NoError(t, err)
+	require.Equal(t, "# generated by wirez\n"+
+		"127.0.0.1\tlocalhost\n"+
+		"::1\tlocalhost ip6-localhost ip6-loopback\n"+
+		"127.0.1.1\tbox\n"+
+		"10.0.0.5\tdb.local\n"+
+		"fd00::5\tv6.local\n", content)
+
+	for _, entry := range []string{"db.local", ":10.0.0.5", "db.local:abc", "db local:10.0.0.5"} {
+		_, err = generateHosts("box", []string{entry})
+		require.Error(t, err, entry)
+	}
+}
+
+func TestValidateSandboxName(t *testing.T) {
+	for _, name := range []string{"dev", "dev-1", "my_box.2", "A"} {
+		require.NoError(t, validateSandboxName(name), name)
+	}
+	for _, name := range []string{"", ".", "..", "-dev", "a/b", "a b", strings.Repeat("a", 65)} {
+		require.Error(t, validateSandboxName(name), name)
+	}
+}
+
+func TestSandboxBaseDir(t *testing.T) {
+	require.Equal(t, "/run/user/1000/wirez", sandboxBaseDir("/run/user/1000", 1000))
+	require.Equal(t, "/run/wirez", sandboxBaseDir("", 0))
+	require.Equal(t, filepath.Join(os.TempDir(), "wirez-1000"), sandboxBaseDir("", 1000))
+}
@@ -0,0 +1,122 @@
+package command
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/v-byte-cpu/wirez/pkg/connect"
+)
+
+// upstreamSet builds connectors of proxy paths and monitors dials through each path,
+// routes sharing the same path share its monitor.
+type upstreamSet struct {
+	log       *zerolog.Logger
+	keepAlive time.Duration
+	monitors  map[string]*connect.UpstreamMonitor
+	names     []string
+}
+
+// newUpstreamSet returns the set that sends TCP keepalive probes to the first proxy of paths
+// with the period, zero disables keepalive.
+func newUpstreamSet(log *zerolog.Logger, keepAlive time.Duration) *upstreamSet {
+	return &upstreamSet{log: log, keepAlive: keepAlive, monitors: make(map[string]*connect.UpstreamMonitor)}
+}
+
+// connectors returns connectors that load balance flows between the proxy paths,
+// each path is a chain of proxies traversed in order.
+func (s *upstreamSet) connectors(paths [][]*connect.SocksAddr) (tcpConn, udpConn connect.Connector) {
+	dconn := connect.NewKeepAliveDirectConnector(s.keepAlive)
+	tcpConns := make([]connect.Connector, 0, len(paths))
+	udpConns := make([]connect.Connector, 0, len(paths))
+	for _, path := range paths {
+		socksTCPConn := dconn
+		socksTCPConns := make([]connect.Connector, 0, len(path)+1)
+		socksTCPConns = append(socksTCPConns, dconn)
+		for _, proxyAddr := range path {
+			socksTCPConn = connect.NewSOCKS5Connector(socksTCPConn, proxyAddr)
+			socksTCPConns = append(socksTCPConns, socksTCPConn)
+		}
+		socksUDPConn := dconn
+		for i, proxyAddr := range path {
+			socksUDPConn = connect.NewSOCKS5UDPConnector(s.log, socksTCPConns[i], socksUDPConn, proxyAddr)
+		}
+		monitor := s.monitor(path)
+		tcpConns = append(tcpConns, monitor.Connector(socksTCPConn))
+		udpConns = append(udpConns, monitor.Connector(socksUDPConn))
+	}
+	if len(paths) == 1 {
+		return tcpConns[0], udpConns[0]
+	}
+	return connect.NewRotationConnector(tcpConns), connect.NewRotationConnector(udpConns)
+}
+
+func (s *upstreamSet) monitor(path []*connect.SocksAddr) *connect.UpstreamMonitor {
+	name := pathName(path)
+	monitor, ok := s.monitors[name]
+	if !ok {
+		monitor = connect.NewUpstreamMonitor(name)
+		s.monitors[name] = monitor
+		s.names = append(s.names, name)
+	}
+	return monitor
+}
+
+// list returns monitors in the order of creation.
+func (s *upstreamSet) list() []*connect.UpstreamMonitor {
+	result := make([]*connect.UpstreamMonitor, 0, len(s.names))
+	for _, name := range s.names {
+		result = append(result, s.monitors[name])
+	}
+	return result
+}
+
+// pathName joins proxy addresses of the chain, credentials are omitted.
+func pathName(path []*connect.SocksAddr) string {
+	addrs := make([]string, 0, len(path))
+	for _, socksAddr := range path {
+		addrs = append(addrs, socksAddr.Address)
+	}
+	return strings.Join(addrs, ">")
+}
+
+// addConfigRoutes adds all upstreams, chains and pools of the config file
+// to the forward switch except the already added one.
+func (s *upstreamSet) addConfigRoutes(forward *connect.ForwardSwitch, config *fileConfig, exclude string) {
+	if config == nil {
+		return
+	}
+	names := make([]string, 0, len(config.routes))
+	for name := range config.routes {
+		if name != exclude {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tcpConn, udpConn := s.connectors(config.routes[name])
+		forward.Add(name, tcpConn, udpConn)
+	}
+}
+
+// serveControl serves the control API on the unix socket, the returned function
+// stops the server and removes the socket file.
+func serveControl(log *zerolog.Logger, path string, cfg connect.ControlConfig) (closeFunc func() error, err error) {
+	listener := &listenerConfig{Network: "unix", Address: path, FileMode: 0o600, UID: -1, GID: -1}
+	ln, err := listener.listenUnix()
+	if err != nil {
+		return
+	}
+	srv := &http.Server{Handler: connect.NewControlHandler(log, cfg)}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("control server")
+		}
+	}()
+	log.Info().Str("socket", path).Msg("control API started")
+	// closing the unix listener removes the socket file
+	return srv.Close, nil
+}
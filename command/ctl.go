@@ -0,0 +1,262 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/v-byte-cpu/wirez/pkg/connect"
+)
+
+// ctlRequestTimeout limits control API requests
+const ctlRequestTimeout = 10 * time.Second
+
+func newCtlCmd() *cobra.Command {
+	opts := &ctlCmdOpts{}
+	cmd := &cobra.Command{
+		Use: "ctl",
+		Example: strings.Join([]string{
+			"wirez ctl -s /run/wirez-ctl.sock flows",
+			"wirez ctl -s /run/wirez-ctl.sock forward tor",
+			"wirez ctl -s /run/wirez-ctl.sock map add 53:1.1.1.1:53/udp"}, "\n"),
+		Short: "Inspect and control the running run or server command via its control socket",
+	}
+	cmd.PersistentFlags().StringVarP(&opts.socket, "socket", "s", "", "control socket path of the --control flag")
+	socketFlag := cmd.PersistentFlags().Lookup("socket")
+	socketFlag.Value = &renamedTypeFlagValue{Value: socketFlag.Value, name: "path"}
+	_ = cmd.MarkPersistentFlagRequired("socket")
+
+	cmd.AddCommand(
+		newCtlFlowsCmd(opts),
+		newCtlCloseCmd(opts),
+		newCtlUpstreamsCmd(opts),
+		newCtlForwardCmd(opts),
+		newCtlMapCmd(opts),
+		newCtlLogLevelCmd(opts),
+	)
+	return cmd
+}
+
+type ctlCmdOpts struct {
+	socket string
+}
+
+func newCtlFlowsCmd(opts *ctlCmdOpts) *cobra.Command {
+	return &cobra.Command{
+		Use:   "flows",
+		Short: "List active flows",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var flows []connect.Flow
+			if err = opts.request(http.MethodGet, "/flows", nil, &flows); err != nil {
+				return
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNETWORK\tSOURCE\tDESTINATION\tUSER\tDURATION")
+			for _, flow := range flows {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", flow.ID, flow.Network, flow.Source, flow.Destination,
+					flow.User, time.Since(flow.Started).Truncate(time.Second))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newCtlCloseCmd(opts *ctlCmdOpts) *cobra.Command {
+	return &cobra.Command{
+		Use:   "close id",
+		Short: "Close the active flow",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.request(http.MethodDelete, "/flows/"+url.PathEscape(args[0]), nil, nil)
+		},
+	}
+}
+
+func newCtlUpstreamsCmd(opts *ctlCmdOpts) *cobra.Command {
+	return &cobra.Command{
+		Use:   "upstreams",
+		Short: "Show health of upstream proxies",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var upstreams []connect.UpstreamHealth
+			if err = opts.request(http.MethodGet, "/upstreams", nil, &upstreams); err != nil {
+				return
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tHEALTHY\tDIALS\tFAILURES\tCONNECT TIME\tLAST ERROR")
+			for _, upstream := range upstreams {
+				fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%s\t%s\n", upstream.Name, upstream.Healthy, upstream.Dials,
+					upstream.Failures, upstream.ConnectTime.Round(time.Millisecond), upstream.LastError)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newCtlForwardCmd(opts *ctlCmdOpts) *cobra.Command {
+	return &cobra.Command{
+		Use:   "forward [name]",
+		Short: "Show or switch the active upstream, chain or pool",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var state connect.ForwardState
+			if len(args) > 0 {
+				err = opts.request(http.MethodPut, "/forward", map[string]string{"name": args[0]}, &state)
+			} else {
+				err = opts.request(http.MethodGet, "/forward", nil, &state)
+			}
+			if err != nil {
+				return
+			}
+			for _, name := range state.Available {
+				marker := " "
+				if name == state.Active {
+					marker = "*"
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s %s\n", marker, name)
+			}
+			return nil
+		},
+	}
+}
+
+func newCtlMapCmd(opts *ctlCmdOpts) *cobra.Command {
+	printMappings := func(cmd *cobra.Command, mappings []connect.AddressMapping) error {
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NETWORK\tFROM\tTO")
+		for _, mapping := range mappings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", mapping.Network, mapping.FromAddress, mapping.ToAddress)
+		}
+		return w.Flush()
+	}
+	cmd := &cobra.Command{
+		Use:   "map",
+		Short: "Manage local address mappings of the run command",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "ls",
+		Short: "List address mappings",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var mappings []connect.AddressMapping
+			if err = opts.request(http.MethodGet, "/mappings", nil, &mappings); err != nil {
+				return
+			}
+			return printMappings(cmd, mappings)
+		},
+	}, &cobra.Command{
+		Use:     "add mapping",
+		Example: "wirez ctl -s /run/wirez-ctl.sock map add 1.1.1.1:53:127.0.0.1:5353/udp",
+		Short:   "Add the address mapping in the format of the --local flag",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			network, fromAddress, toAddress, err := parseMapping(args[0])
+			if err != nil {
+				return
+			}
+			var mappings []connect.AddressMapping
+			if err = opts.request(http.MethodPost, "/mappings", &connect.AddressMapping{
+				Network: network, FromAddress: fromAddress, ToAddress: toAddress,
+			}, &mappings); err != nil {
+				return
+			}
+			return printMappings(cmd, mappings)
+		},
+	}, &cobra.Command{
+		Use:     "rm [host:]port[/proto]",
+		Example: "wirez ctl -s /run/wirez-ctl.sock map rm 1.1.1.1:53/udp",
+		Short:   "Remove the address mapping",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			fromAddress, network, found := strings.Cut(args[0], "/")
+			if !found {
+				network = "tcp"
+			}
+			query := url.Values{"network": {network}, "from": {fromAddress}}
+			var mappings []connect.AddressMapping
+			if err = opts.request(http.MethodDelete, "/mappings?"+query.Encode(), nil, &mappings); err != nil {
+				return
+			}
+			return printMappings(cmd, mappings)
+		},
+	})
+	return cmd
+}
+
+func newCtlLogLevelCmd(opts *ctlCmdOpts) *cobra.Command {
+	return &cobra.Command{
+		Use:   "log-level [level]",
+		Short: "Show or change the log level: trace, debug, info, warn, error or disabled",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var level connect.LogLevel
+			if len(args) > 0 {
+				err = opts.request(http.MethodPut, "/log-level", &connect.LogLevel{Level: args[0]}, &level)
+			} else {
+				err = opts.request(http.MethodGet, "/log-level", nil, &level)
+			}
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), level.Level)
+			return nil
+		},
+	}
+}
+
+// request sends the JSON request to the control API and decodes the JSON response into result.
+func (o *ctlCmdOpts) request(method, path string, body, result interface{}) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctlRequestTimeout)
+	defer cancel()
+	// the host is ignored, requests are sent to the unix socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://wirez"+path, reqBody)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", o.socket)
+		},
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		var respErr struct {
+			Error string `json:"error"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&respErr); err != nil || respErr.Error == "" {
+			return fmt.Errorf("control API error: %s", resp.Status)
+		}
+		return errors.New(respErr.Error)
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,61 @@
+package command
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/v-byte-cpu/wirez/pkg/connect"
+)
+
+func TestCtlCmd(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	log := zerolog.Nop()
+	socket := filepath.Join(t.TempDir(), "ctl.sock")
+	forward := connect.NewForwardSwitch()
+	forward.Add("tor", connect.NewDirectConnector(), connect.NewDirectConnector())
+	forward.Add("eu", connect.NewDirectConnector(), connect.NewDirectConnector())
+	closeControl, err := serveControl(&log, socket, connect.ControlConfig{
+		Flows:    connect.NewFlowTable(),
+		Forward:  forward,
+		Mappings: connect.NewAddressMapper(),
+	})
+	require.NoError(t, err)
+	defer closeControl()
+
+	ctl := func(args ...string) (string, error) {
+		cmd := newCtlCmd()
+		var out bytes.Buffer
+		cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		cmd.SetOut(&out)
+		cmd.SetArgs(append([]string{"--socket", socket}, args...))
+		err := cmd.Execute()
+		return out.String(), err
+	}
+
+	out, err := ctl("forward", "eu")
+	require.NoError(t, err)
+	require.Equal(t, "* eu\n  tor\n", out)
+	require.Equal(t, "eu", forward.Active())
+	_, err = ctl("forward", "us")
+	require.EqualError(t, err, connect.ErrUnknownForward.Error())
+
+	out, err = ctl("map", "add", "1.1.1.1:53:127.0.0.1:5353/udp")
+	require.NoError(t, err)
+	require.Contains(t, out, "udp      1.1.1.1:53  127.0.0.1:5353")
+	out, err = ctl("map", "rm", "1.1.1.1:53/udp")
+	require.NoError(t, err)
+	require.Equal(t, "NETWORK  FROM  TO\n", out)
+
+	out, err = ctl("log-level", "warn")
+	require.NoError(t, err)
+	require.Equal(t, "warn\n", out)
+
+	out, err = ctl("flows")
+	require.NoError(t, err)
+	require.Equal(t, "ID  NETWORK  SOURCE  DESTINATION  USER  DURATION\n", out)
+	_, err = ctl("close", "1")
+	require.EqualError(t, err, connect.ErrFlowNotFound.Error())
+}
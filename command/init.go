@@ -0,0 +1,133 @@
+//go:build linux
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// forwardedSignals are relayed to the container command. SIGINT is not among them
+// since the terminal delivers it to the whole foreground process group, it is only
+// caught to wait for the command exit.
+var forwardedSignals = []os.Signal{unix.SIGHUP, unix.SIGQUIT, unix.SIGTERM, unix.SIGUSR1, unix.SIGUSR2}
+
+// forwardSignals relays signals to the process until the returned function is called.
+func forwardSignals(p *os.Process) (stop func()) {
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, append(forwardedSignals, unix.SIGINT)...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig != unix.SIGINT {
+					p.Signal(sig) //nolint:errcheck
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// runCommand runs the command and forwards signals to it.
+func runCommand(proc *exec.Cmd) error {
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	stop := forwardSignals(proc.Process)
+	defer stop()
+	return proc.Wait()
+}
+
+// runInit runs the command as a child of the init process of the PID namespace.
+// It reaps orphaned zombies, forwards signals to the command and kills all
+// remaining processes of the namespace when the command exits.
+func runInit(proc *exec.Cmd) error {
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals, append(forwardedSignals, unix.SIGINT, unix.SIGCHLD)...)
+	defer signal.Stop(signals)
+
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	for sig := range signals {
+		switch sig {
+		case unix.SIGCHLD:
+			status, exited, err := reapChildren(proc.Process.Pid)
+			if err != nil {
+				return err
+			}
+			if exited {
+				killAll()
+				return waitStatusError(status)
+			}
+		case unix.SIGINT:
+		default:
+			proc.Process.Signal(sig) //nolint:errcheck
+		}
+	}
+	return nil
+}
+
+// reapChildren reaps all exited children, exited reports whether the main process is one of them.
+func reapChildren(mainPid int) (mainStatus unix.WaitStatus, exited bool, err error) {
+	for {
+		var status unix.WaitStatus
+		pid, err := unix.Wait4(-1, &status, unix.WNOHANG, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil && !errors.Is(err, unix.ECHILD) {
+			return mainStatus, exited, fmt.Errorf("wait: %w", err)
+		}
+		if pid <= 0 {
+			return mainStatus, exited, nil
+		}
+		if pid == mainPid {
+			mainStatus, exited = status, true
+		}
+	}
+}
+
+// killAll kills the remaining processes of the PID namespace and waits for them.
+func killAll() {
+	// kill(-1) of the init process signals all processes of its namespace except itself
+	unix.Kill(-1, unix.SIGKILL) //nolint:errcheck
+	for {
+		if _, err := unix.Wait4(-1, nil, 0, nil); err != nil && !errors.Is(err, unix.EINTR) {
+			return
+		}
+	}
+}
+
+func waitStatusError(status unix.WaitStatus) error {
+	code := status.ExitStatus()
+	if status.Signaled() {
+		code = 128 + int(status.Signal())
+	}
+	if code == 0 {
+		return nil
+	}
+	return &exitCodeError{code: code}
+}
+
+// mountProc mounts procfs of the new PID namespace, so that the container
+// sees only its own processes.
+func mountProc() error {
+	// don't propagate container mounts to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	return unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+}
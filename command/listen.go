@@ -0,0 +1,186 @@
+package command
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenerConfig describes a server listener parsed from the listen url:
+//
+//	tcp://127.0.0.1:1080
+//	unix:///run/wirez.sock?mode=0660&uid=1000&gid=1000
+//	tls://:1443?cert=server.pem&key=server.key&client-ca=ca.pem
+//
+// Each scheme accepts the optional file query parameter that binds the listener
+// to its own upstream pool instead of the default proxies file.
+type listenerConfig struct {
+	Network string
+	Address string
+	// unix socket file permissions and ownership, uid/gid -1 means unchanged
+	FileMode os.FileMode
+	UID      int
+	GID      int
+	// tls certificates
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	// proxies file of the upstream pool
+	ProxyFile string
+	// config file upstream, chain or pool name
+	Forward string
+}
+
+func (c *listenerConfig) String() string {
+	return c.Network + "://" + c.Address
+}
+
+func parseListenURLs(listenURLs []string) ([]*listenerConfig, error) {
+	result := make([]*listenerConfig, 0, len(listenURLs))
+	for _, listenURL := range listenURLs {
+		cfg, err := parseListenURL(listenURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %s: %w", listenURL, err)
+		}
+		result = append(result, cfg)
+	}
+	return result, nil
+}
+
+func parseListenURL(listenURL string) (cfg *listenerConfig, err error) {
+	listenURL = strings.Trim(listenURL, " ")
+	if !strings.Contains(listenURL, "://") {
+		listenURL = "tcp://" + listenURL
+	}
+	u, err := url.Parse(listenURL)
+	if err != nil {
+		return
+	}
+	query := u.Query()
+	cfg = &listenerConfig{Network: u.Scheme, UID: -1, GID: -1, ProxyFile: query.Get("file")}
+	switch u.Scheme {
+	case "tcp":
+		cfg.Address = u.Host
+	case "tls":
+		cfg.Address = u.Host
+		cfg.CertFile = query.Get("cert")
+		cfg.KeyFile = query.Get("key")
+		cfg.ClientCAFile = query.Get("client-ca")
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("tls listener requires cert and key parameters")
+		}
+	case "unix":
+		return parseUnixListenURL(cfg, u)
+	default:
+		return nil, fmt.Errorf("unsupported listen scheme %s", u.Scheme)
+	}
+	if _, _, err = net.SplitHostPort(cfg.Address); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func parseUnixListenURL(cfg *listenerConfig, u *url.URL) (*listenerConfig, error) {
+	cfg.Address = u.Path
+	if cfg.Address == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+	query := u.Query()
+	if mode := query.Get("mode"); mode != "" {
+		fileMode, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unix socket mode: %w", err)
+		}
+		cfg.FileMode = os.FileMode(fileMode)
+	}
+	var err error
+	if cfg.UID, err = parseListenOwnerID(query, "uid"); err != nil {
+		return nil, err
+	}
+	if cfg.GID, err = parseListenOwnerID(query, "gid"); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func parseListenOwnerID(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return -1, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unix socket %s: %w", name, err)
+	}
+	return int(id), nil
+}
+
+// Listen starts listening on the configured address.
+func (c *listenerConfig) Listen() (net.Listener, error) {
+	switch c.Network {
+	case "unix":
+		return c.listenUnix()
+	case "tls":
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		return tls.Listen("tcp", c.Address, tlsConfig)
+	default:
+		return net.Listen("tcp", c.Address)
+	}
+}
+
+func (c *listenerConfig) listenUnix() (ln net.Listener, err error) {
+	// remove a stale socket file left by the previous run
+	if err = os.Remove(c.Address); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if ln, err = net.Listen("unix", c.Address); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			ln.Close()
+		}
+	}()
+	if c.FileMode != 0 {
+		if err = os.Chmod(c.Address, c.FileMode); err != nil {
+			return
+		}
+	}
+	if c.UID != -1 || c.GID != -1 {
+		err = os.Chown(c.Address, c.UID, c.GID)
+	}
+	return
+}
+
+func (c *listenerConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		caData, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
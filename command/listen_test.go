@@ -0,0 +1,102 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    *listenerConfig
+		expectedErr bool
+	}{
+		{
+			name:     "HostPort",
+			input:    "127.0.0.1:1080",
+			expected: &listenerConfig{Network: "tcp", Address: "127.0.0.1:1080", UID: -1, GID: -1},
+		},
+		{
+			name:     "PortOnly",
+			input:    ":1080",
+			expected: &listenerConfig{Network: "tcp", Address: ":1080", UID: -1, GID: -1},
+		},
+		{
+			name:     "TCPScheme",
+			input:    "tcp://[::1]:1080",
+			expected: &listenerConfig{Network: "tcp", Address: "[::1]:1080", UID: -1, GID: -1},
+		},
+		{
+			name:  "TCPSchemeWithProxyFile",
+			input: "tcp://127.0.0.1:1080?file=eu.txt",
+			expected: &listenerConfig{Network: "tcp", Address: "127.0.0.1:1080",
+				UID: -1, GID: -1, ProxyFile: "eu.txt"},
+		},
+		{
+			name:        "TCPSchemeWithoutPort",
+			input:       "tcp://127.0.0.1",
+			expectedErr: true,
+		},
+		{
+			name:     "UnixScheme",
+			input:    "unix:///run/wirez.sock",
+			expected: &listenerConfig{Network: "unix", Address: "/run/wirez.sock", UID: -1, GID: -1},
+		},
+		{
+			name:  "UnixSchemeWithModeAndOwner",
+			input: "unix:///run/wirez.sock?mode=0660&uid=1000&gid=1001",
+			expected: &listenerConfig{Network: "unix", Address: "/run/wirez.sock",
+				FileMode: 0660, UID: 1000, GID: 1001},
+		},
+		{
+			name:        "UnixSchemeWithInvalidMode",
+			input:       "unix:///run/wirez.sock?mode=999",
+			expectedErr: true,
+		},
+		{
+			name:        "UnixSchemeWithInvalidUID",
+			input:       "unix:///run/wirez.sock?uid=abc",
+			expectedErr: true,
+		},
+		{
+			name:        "UnixSchemeWithoutPath",
+			input:       "unix://",
+			expectedErr: true,
+		},
+		{
+			name:  "TLSScheme",
+			input: "tls://:1443?cert=server.pem&key=server.key",
+			expected: &listenerConfig{Network: "tls", Address: ":1443", UID: -1, GID: -1,
+				CertFile: "server.pem", KeyFile: "server.key"},
+		},
+		{
+			name:  "TLSSchemeWithClientCA",
+			input: "tls://:1443?cert=server.pem&key=server.key&client-ca=ca.pem",
+			expected: &listenerConfig{Network: "tls", Address: ":1443", UID: -1, GID: -1,
+				CertFile: "server.pem", KeyFile: "server.key", ClientCAFile: "ca.pem"},
+		},
+		{
+			name:        "TLSSchemeWithoutKey",
+			input:       "tls://:1443?cert=server.pem",
+			expectedErr: true,
+		},
+		{
+			name:        "InvalidScheme",
+			input:       "udp://:1080",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseListenURL(tt.input)
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, cfg)
+		})
+	}
+}
@@ -0,0 +1,638 @@
+//go:build linux
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sandboxPidFile    = "pid"
+	sandboxNetnsFile  = "net"
+	sandboxExecSocket = "exec.sock"
+
+	// sandboxStartTimeout limits waiting for the background sandbox to get ready
+	sandboxStartTimeout = 30 * time.Second
+	// sandboxStopTimeout limits waiting for the sandbox to exit before it is killed
+	sandboxStopTimeout = 10 * time.Second
+
+	// maxExecMessageSize limits the size of exec protocol messages
+	maxExecMessageSize = 1 << 20
+)
+
+func newNsCmd(log *zerolog.Logger) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ns",
+		Short: "Manage persistent named sandboxes that share one proxied network",
+	}
+	cmd.AddCommand(
+		newNsCreateCmd(log).cmd,
+		newNsExecCmd().cmd,
+		newNsRmCmd().cmd,
+		newNsExecServerCmd().cmd,
+	)
+	return cmd
+}
+
+func newNsCreateCmd(log *zerolog.Logger) *nsCreateCmd {
+	c := &nsCreateCmd{}
+
+	cmd := &cobra.Command{
+		Use:     "create [flags] name",
+		Example: "wirez ns create dev -F 127.0.0.1:1234",
+		Short:   "Start a background sandbox with the proxied network",
+		Long: "Start a long-lived background wirez that owns the container namespaces, " +
+			"commands are run inside it with `wirez ns exec` until it is removed with `wirez ns rm`",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			name := args[0]
+			if err = validateSandboxName(name); err != nil {
+				return
+			}
+			if err = c.opts.loadConfigFile(cmd.Flags()); err != nil {
+				return
+			}
+			log = c.opts.config.logger(log, cmd.Flags(), c.opts.VerboseLevel)
+			if !c.opts.Foreground {
+				return startSandbox(log, name)
+			}
+			return c.opts.serveSandbox(log, name)
+		},
+	}
+
+	c.opts.initCliFlags(cmd)
+
+	c.cmd = cmd
+	return c
+}
+
+type nsCreateCmd struct {
+	cmd  *cobra.Command
+	opts nsCreateCmdOpts
+}
+
+type nsCreateCmdOpts struct {
+	runCmdOpts
+	Foreground bool
+}
+
+func (o *nsCreateCmdOpts) initCliFlags(cmd *cobra.Command) {
+	o.runCmdOpts.initCliFlags(cmd)
+	// commands of the sandbox are always run by the init process
+	cmd.Flags().MarkHidden("pid-ns") //nolint:errcheck
+
+	cmd.Flags().BoolVar(&o.Foreground, "foreground", false, "run the sandbox in the foreground, e.g. under a service manager")
+}
+
+// startSandbox starts the sandbox in the background and waits until it is ready.
+func startSandbox(log *zerolog.Logger, name string) (err error) {
+	baseDir, err := openSandboxBaseDir(true)
+	if err != nil {
+		return
+	}
+	if _, alive := sandboxPid(filepath.Join(baseDir, name)); alive {
+		return fmt.Errorf("sandbox %s already exists", name)
+	}
+	logFile := filepath.Join(baseDir, name+".log")
+	out, err := os.Create(logFile)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	proc := exec.Command("/proc/self/exe", foregroundArgs(os.Args[1:])...)
+	proc.Stdout = out
+	proc.Stderr = out
+	// detach from the terminal session
+	proc.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = proc.Start(); err != nil {
+		return
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- proc.Wait()
+	}()
+
+	socketPath := filepath.Join(baseDir, name, sandboxExecSocket)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(sandboxStartTimeout)
+	for {
+		select {
+		case err = <-exited:
+			// the exit code of the sandbox is not the exit code of this command
+			return fmt.Errorf("sandbox exited before it got ready, see %s: %v", logFile, err)
+		case <-timeout:
+			return multierr.Append(fmt.Errorf("sandbox is not ready in %s, see %s", sandboxStartTimeout, logFile),
+				proc.Process.Kill())
+		case <-ticker.C:
+			conn, err := net.Dial("unixpacket", socketPath)
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			log.Info().Str("name", name).Int("pid", proc.Process.Pid).Str("log", logFile).Msg("sandbox is ready")
+			return nil
+		}
+	}
+}
+
+// foregroundArgs inserts the foreground flag right after the create subcommand.
+func foregroundArgs(args []string) []string {
+	result := make([]string, 0, len(args)+1)
+	for i, arg := range args {
+		result = append(result, arg)
+		if arg == "create" {
+			result = append(result, "--foreground")
+			return append(result, args[i+1:]...)
+		}
+	}
+	return append(result, "--foreground")
+}
+
+// serveSandbox runs the exec server in the container until the sandbox is removed.
+func (o *nsCreateCmdOpts) serveSandbox(log *zerolog.Logger, name string) (err error) {
+	dir, err := createSandboxDir(name)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = multierr.Append(err, os.RemoveAll(dir))
+	}()
+	if err = os.WriteFile(filepath.Join(dir, sandboxPidFile), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		return
+	}
+
+	o.PIDNamespace = true
+	privileged := os.Geteuid() == 0
+	netnsFile := filepath.Join(dir, sandboxNetnsFile)
+	mounted := false
+	defer func() {
+		if mounted {
+			err = multierr.Append(err, unix.Unmount(netnsFile, unix.MNT_DETACH))
+		}
+	}()
+	args := []string{"/proc/self/exe", "ns", "execd", "--socket", filepath.Join(dir, sandboxExecSocket)}
+	return o.runContainer(log, args, func(pid int) error {
+		if !privileged {
+			return nil
+		}
+		// other tools can join the network namespace, e.g. wirez attach --netns
+		if err := os.WriteFile(netnsFile, nil, 0o644); err != nil {
+			return err
+		}
+		if err := unix.Mount(fmt.Sprintf("/proc/%d/ns/net", pid), netnsFile, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("mount netns: %w", err)
+		}
+		mounted = true
+		return nil
+	})
+}
+
+// createSandboxDir creates the runtime directory of the sandbox, the directory
+// of the exited sandbox is reused.
+func createSandboxDir(name string) (dir string, err error) {
+	baseDir, err := openSandboxBaseDir(true)
+	if err != nil {
+		return
+	}
+	dir = filepath.Join(baseDir, name)
+	if err = os.Mkdir(dir, 0o700); err == nil || !errors.Is(err, os.ErrExist) {
+		return
+	}
+	if _, alive := sandboxPid(dir); alive {
+		return "", fmt.Errorf("sandbox %s already exists", name)
+	}
+	if err = cleanupSandboxDir(dir); err != nil {
+		return
+	}
+	return dir, os.Mkdir(dir, 0o700)
+}
+
+// openSandboxBaseDir returns the runtime directory of named sandboxes after checking
+// that it is private to the current user. The directory in the shared temp directory
+// may be created by another user to plant the exec socket of a fake sandbox.
+func openSandboxBaseDir(create bool) (string, error) {
+	euid := os.Geteuid()
+	baseDir := sandboxBaseDir(os.Getenv("XDG_RUNTIME_DIR"), euid)
+	if create {
+		if err := os.MkdirAll(baseDir, 0o700); err != nil {
+			return "", err
+		}
+	}
+	info, err := os.Lstat(baseDir)
+	if err != nil {
+		return "", err
+	}
+	if err = checkPrivateDir(info, euid); err != nil {
+		return "", fmt.Errorf("sandbox directory %s: %w", baseDir, err)
+	}
+	return baseDir, nil
+}
+
+// checkPrivateDir checks that the directory isn't a symlink and is accessible only by its owner euid.
+func checkPrivateDir(info os.FileInfo, euid int) error {
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	if info.Mode().Perm() != 0o700 {
+		return fmt.Errorf("mode %#o is not 0700", info.Mode().Perm())
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != euid {
+		return errors.New("owned by another user")
+	}
+	return nil
+}
+
+// sandboxPid returns the pid of the sandbox and whether it is still running.
+func sandboxPid(dir string) (pid int, alive bool) {
+	data, err := os.ReadFile(filepath.Join(dir, sandboxPidFile))
+	if err != nil {
+		return 0, false
+	}
+	if pid, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, unix.Kill(pid, 0) == nil
+}
+
+func cleanupSandboxDir(dir string) error {
+	// the netns bind mount is left by the killed sandbox
+	if err := unix.Unmount(filepath.Join(dir, sandboxNetnsFile), unix.MNT_DETACH); err != nil &&
+		!errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func newNsRmCmd() *nsRmCmd {
+	c := &nsRmCmd{}
+
+	cmd := &cobra.Command{
+		Use:     "rm name",
+		Example: "wirez ns rm dev",
+		Short:   "Stop the sandbox and all its processes",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			name := args[0]
+			if err = validateSandboxName(name); err != nil {
+				return
+			}
+			baseDir, err := openSandboxBaseDir(false)
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("sandbox %s is not found", name)
+			}
+			if err != nil {
+				return
+			}
+			dir := filepath.Join(baseDir, name)
+			// the log of the failed sandbox is left without its directory
+			logErr := os.Remove(filepath.Join(baseDir, name+".log"))
+			if _, err = os.Stat(dir); err != nil {
+				if errors.Is(err, os.ErrNotExist) && errors.Is(logErr, os.ErrNotExist) {
+					return fmt.Errorf("sandbox %s is not found", name)
+				}
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return
+			}
+			if pid, alive := sandboxPid(dir); alive {
+				if err = stopProcess(pid, sandboxStopTimeout); err != nil {
+					return
+				}
+			}
+			return cleanupSandboxDir(dir)
+		},
+	}
+
+	c.cmd = cmd
+	return c
+}
+
+type nsRmCmd struct {
+	cmd *cobra.Command
+}
+
+// stopProcess terminates the process and kills it if it doesn't exit in time.
+func stopProcess(pid int, timeout time.Duration) error {
+	if err := unix.Kill(pid, unix.SIGTERM); err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return nil
+		}
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if unix.Kill(pid, 0) != nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := unix.Kill(pid, unix.SIGKILL); err != nil && !errors.Is(err, unix.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+func newNsExecCmd() *nsExecCmd {
+	c := &nsExecCmd{}
+
+	cmd := &cobra.Command{
+		Use:     "exec name command",
+		Example: "wirez ns exec dev -- curl example.com",
+		Short:   "Run a command inside the sandbox",
+		Args:    cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			name := args[0]
+			if err = validateSandboxName(name); err != nil {
+				return
+			}
+			baseDir, err := openSandboxBaseDir(false)
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("sandbox %s is not found", name)
+			}
+			if err != nil {
+				return
+			}
+			socketPath := filepath.Join(baseDir, name, sandboxExecSocket)
+			if _, err = os.Stat(socketPath); errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("sandbox %s is not found", name)
+			}
+			dir, err := os.Getwd()
+			if err != nil {
+				return
+			}
+			return execInSandbox(socketPath, &ExecRequestMessage{
+				Args: args[1:],
+				Env:  os.Environ(),
+				Dir:  dir,
+			}, []*os.File{os.Stdin, os.Stdout, os.Stderr})
+		},
+	}
+
+	c.cmd = cmd
+	return c
+}
+
+type nsExecCmd struct {
+	cmd *cobra.Command
+}
+
+// ExecRequestMessage is sent with stdin, stdout and stderr fds of the command.
+type ExecRequestMessage struct {
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+	Dir  string   `json:"dir"`
+}
+
+// ExecSignalMessage asks to send the signal to the command.
+type ExecSignalMessage struct {
+	Signal int `json:"signal"`
+}
+
+// ExecStatusMessage reports the started or exited command.
+type ExecStatusMessage struct {
+	Pid      int    `json:"pid,omitempty"`
+	Exited   bool   `json:"exited,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// execInSandbox runs the command with the exec server and forwards signals to it.
+func execInSandbox(socketPath string, req *ExecRequestMessage, stdio []*os.File) (err error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: socketPath, Net: "unixpacket"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	fds := make([]int, 0, len(stdio))
+	for _, f := range stdio {
+		fds = append(fds, int(f.Fd()))
+	}
+	if _, _, err = conn.WriteMsgUnix(data, unix.UnixRights(fds...), nil); err != nil {
+		return
+	}
+
+	// the command is not in the terminal foreground process group, forward SIGINT as well
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, append(forwardedSignals, unix.SIGINT)...)
+	defer signal.Stop(signals)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				data, err := json.Marshal(&ExecSignalMessage{Signal: int(sig.(syscall.Signal))})
+				if err == nil {
+					conn.Write(data) //nolint:errcheck
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxExecMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("exec connection: %w", err)
+		}
+		var status ExecStatusMessage
+		if err = json.Unmarshal(buf[:n], &status); err != nil {
+			return err
+		}
+		if status.Error != "" {
+			return errors.New(status.Error)
+		}
+		if !status.Exited {
+			continue
+		}
+		if status.ExitCode != 0 {
+			return &exitCodeError{code: status.ExitCode}
+		}
+		return nil
+	}
+}
+
+func newNsExecServerCmd() *nsExecServerCmd {
+	c := &nsExecServerCmd{}
+
+	cmd := &cobra.Command{
+		Use:     "execd [flags]",
+		Example: "execd --socket /run/wirez/dev/exec.sock",
+		Short:   "Internal command to run commands inside the sandbox",
+		Hidden:  true,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			ln, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: c.opts.Socket, Net: "unixpacket"})
+			if err != nil {
+				return
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+			defer cancel()
+			// running commands are killed by the init process
+			return serveExecs(ctx, ln)
+		},
+	}
+
+	c.opts.initCliFlags(cmd)
+
+	c.cmd = cmd
+	return c
+}
+
+type nsExecServerCmd struct {
+	cmd  *cobra.Command
+	opts nsExecServerCmdOpts
+}
+
+type nsExecServerCmdOpts struct {
+	Socket string
+}
+
+func (o *nsExecServerCmdOpts) initCliFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.Socket, "socket", "", "set exec unix socket path")
+}
+
+// serveExecs runs commands of exec requests until the context is canceled.
+func serveExecs(ctx context.Context, ln *net.UnixListener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveExec(conn) //nolint:errcheck
+	}
+}
+
+func serveExec(conn *net.UnixConn) (err error) {
+	defer conn.Close()
+	sendStatus := func(status *ExecStatusMessage) error {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(data)
+		return err
+	}
+
+	proc, err := receiveExecRequest(conn)
+	if err != nil {
+		return multierr.Append(err, sendStatus(&ExecStatusMessage{Error: err.Error()}))
+	}
+	if err = sendStatus(&ExecStatusMessage{Pid: proc.Process.Pid}); err != nil {
+		return multierr.Append(err, proc.Process.Kill())
+	}
+
+	go func() {
+		buf := make([]byte, maxExecMessageSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// the client is gone, don't leave the command behind
+				proc.Process.Kill() //nolint:errcheck
+				return
+			}
+			var msg ExecSignalMessage
+			if err = json.Unmarshal(buf[:n], &msg); err == nil && msg.Signal > 0 {
+				proc.Process.Signal(syscall.Signal(msg.Signal)) //nolint:errcheck
+			}
+		}
+	}()
+
+	status := &ExecStatusMessage{Exited: true}
+	if err = proc.Wait(); err != nil {
+		code, ok := exitCode(err)
+		if !ok {
+			return sendStatus(&ExecStatusMessage{Error: err.Error()})
+		}
+		status.ExitCode = code
+	}
+	return sendStatus(status)
+}
+
+// receiveExecRequest receives the request with stdio fds and starts the command.
+func receiveExecRequest(conn *net.UnixConn) (proc *exec.Cmd, err error) {
+	buf := make([]byte, maxExecMessageSize)
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("parse socket control message: %w", err)
+	}
+	var fds []int
+	for i := range cmsgs {
+		rights, err := unix.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 3 {
+		closeFds(fds)
+		return nil, fmt.Errorf("expected stdin, stdout and stderr fds, got %d fds", len(fds))
+	}
+	stdio := []*os.File{os.NewFile(uintptr(fds[0]), "stdin"),
+		os.NewFile(uintptr(fds[1]), "stdout"), os.NewFile(uintptr(fds[2]), "stderr")}
+	// stdio files are inherited by the command
+	defer func() {
+		for _, f := range stdio {
+			f.Close()
+		}
+	}()
+
+	var req ExecRequestMessage
+	if err = json.Unmarshal(buf[:n], &req); err != nil {
+		return
+	}
+	if len(req.Args) == 0 {
+		return nil, errors.New("command is empty")
+	}
+	proc = exec.Command(req.Args[0], req.Args[1:]...)
+	proc.Env = req.Env
+	proc.Dir = req.Dir
+	proc.Stdin = stdio[0]
+	proc.Stdout = stdio[1]
+	proc.Stderr = stdio[2]
+	if err = proc.Start(); err != nil {
+		return nil, err
+	}
+	return proc, nil
+}
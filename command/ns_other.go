@@ -0,0 +1,21 @@
+//go:build !linux
+
+package command
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+func newNsCmd(log *zerolog.Logger) *cobra.Command {
+	return &cobra.Command{
+		Use:    "ns",
+		Short:  "Manage persistent named sandboxes that share one proxied network",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			return errors.New("this command is not supported by your OS")
+		},
+	}
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package command
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecInSandbox(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), sandboxExecSocket)
+	ln, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: socketPath, Net: "unixpacket"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- serveExecs(ctx, ln)
+	}()
+
+	stdin, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer stdin.Close()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+
+	err = execInSandbox(socketPath, &ExecRequestMessage{
+		Args: []string{"sh", "-c", "echo $WIREZ_TEST in $(pwd); exit 3"},
+		Env:  []string{"WIREZ_TEST=hello"},
+		Dir:  "/",
+	}, []*os.File{stdin, w, w})
+	require.NoError(t, w.Close())
+	code, ok := exitCode(err)
+	require.True(t, ok)
+	require.Equal(t, 3, code)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "hello in /\n", string(out))
+
+	err = execInSandbox(socketPath, &ExecRequestMessage{Args: []string{"wirez-nonexistent-command"}},
+		[]*os.File{stdin, stdin, stdin})
+	require.Error(t, err)
+	_, ok = exitCode(err)
+	require.False(t, ok)
+
+	cancel()
+	require.NoError(t, <-served)
+}
+
+func TestForegroundArgs(t *testing.T) {
+	require.Equal(t, []string{"ns", "create", "--foreground", "dev", "-F", "127.0.0.1:1080"},
+		foregroundArgs([]string{"ns", "create", "dev", "-F", "127.0.0.1:1080"}))
+}
+
+func TestCheckPrivateDir(t *testing.T) {
+	base := t.TempDir()
+	privateDir := filepath.Join(base, "private")
+	require.NoError(t, os.Mkdir(privateDir, 0o700))
+	sharedDir := filepath.Join(base, "shared")
+	require.NoError(t, os.Mkdir(sharedDir, 0o700))
+	require.NoError(t, os.Chmod(sharedDir, 0o777))
+	link := filepath.Join(base, "link")
+	require.NoError(t, os.Symlink(privateDir, link))
+
+	tests := []struct {
+		name    string
+		path    string
+		euid    int
+		wantErr bool
+	}{
+		{name: "Private", path: privateDir, euid: os.Geteuid()},
+		{name: "AnotherOwner", path: privateDir, euid: os.Geteuid() + 1, wantErr: true},
+		{name: "SharedMode", path: sharedDir, euid: os.Geteuid(), wantErr: true},
+		{name: "Symlink", path: link, euid: os.Geteuid(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := os.Lstat(tt.path)
+			require.NoError(t, err)
+			err = checkPrivateDir(info, tt.euid)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -2,8 +2,10 @@ package command
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -13,15 +15,41 @@ import (
 func Main(version string) {
 	log := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).With().Timestamp().Logger()
 	if err := newRootCmd(&log, version).Execute(); err != nil {
-		var exitError *exec.ExitError
-		if errors.As(err, &exitError) {
-			os.Exit(exitError.ExitCode())
+		if code, ok := exitCode(err); ok {
+			os.Exit(code)
 		}
 		log.Error().Err(err).Msg("")
 		os.Exit(1)
 	}
 }
 
+// exitCodeError reports the exit code of the container command that was reaped
+// without exec.Cmd, e.g. by the init process of the container.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// exitCode returns the exit code of the failed command, killed commands exit
+// with 128 plus the signal number like in shells.
+func exitCode(err error) (code int, ok bool) {
+	var codeError *exitCodeError
+	if errors.As(err, &codeError) {
+		return codeError.code, true
+	}
+	var exitError *exec.ExitError
+	if !errors.As(err, &exitError) {
+		return 0, false
+	}
+	if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), true
+	}
+	return exitError.ExitCode(), true
+}
+
 func newRootCmd(log *zerolog.Logger, version string) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:           "wirez",
@@ -35,6 +63,10 @@ func newRootCmd(log *zerolog.Logger, version string) *cobra.Command {
 		newServerCmd(log).cmd,
 		newRunCmd(log).cmd,
 		newRunContainerCmd().cmd,
+		newAttachCmd(log).cmd,
+		newAttachContainerCmd().cmd,
+		newNsCmd(log),
+		newCtlCmd(),
 	)
 
 	return cmd
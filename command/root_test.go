@@ -0,0 +1,49 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+		expectedOK   bool
+	}{
+		{
+			name:         "ExitCodeError",
+			err:          fmt.Errorf("run: %w", &exitCodeError{code: 3}),
+			expectedCode: 3,
+			expectedOK:   true,
+		},
+		{
+			name:         "Exited",
+			err:          exec.Command("sh", "-c", "exit 5").Run(),
+			expectedCode: 5,
+			expectedOK:   true,
+		},
+		{
+			name:         "Killed",
+			err:          exec.Command("sh", "-c", "kill -TERM $$").Run(),
+			expectedCode: 143,
+			expectedOK:   true,
+		},
+		{
+			name: "OtherError",
+			err:  errors.New("other"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, ok := exitCode(tt.err)
+			require.Equal(t, tt.expectedOK, ok)
+			require.Equal(t, tt.expectedCode, code)
+		})
+	}
+}
@@ -6,14 +6,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/v-byte-cpu/wirez/pkg/connect"
 	"go.uber.org/multierr"
 	"golang.org/x/sys/unix"
@@ -30,104 +34,11 @@ func newRunCmd(log *zerolog.Logger) *runCmd {
 		Short: "Proxy application traffic through the socks5 server",
 		Long:  "Run a command in an unprivileged container that transparently proxies application traffic through the socks5 server",
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			if c.opts.ContainerUID < 0 {
-				return errors.New("uid is negative")
-			}
-			if c.opts.ContainerGID < 0 {
-				return errors.New("gid is negative")
-			}
-			if len(c.opts.ForwardProxies) == 0 {
-				return errors.New("forward proxies list is empty")
-			}
-			log = setLogLevel(log, c.opts.VerboseLevel)
-			log.Debug().Strs("forward", c.opts.ForwardProxies).Msg("")
-			log.Debug().Strs("local_address_mappings", c.opts.LocalAddressMappings).Msg("")
-			forwardProxies, err := parseProxyURLs(c.opts.ForwardProxies)
-			if err != nil {
-				return
-			}
-
-			nat, err := parseAddressMapper(c.opts.LocalAddressMappings)
-			if err != nil {
+			if err = c.opts.loadConfigFile(cmd.Flags()); err != nil {
 				return
 			}
-
-			parentFd, childFd, err := newUnixSocketPair()
-			if err != nil {
-				return
-			}
-			defer unix.Close(parentFd)
-			defer unix.Close(childFd)
-
-			privileged := os.Geteuid() == 0
-			proc := exec.Command("/proc/self/exe", append([]string{"runc",
-				"--unix-fd", strconv.Itoa(childFd), fmt.Sprintf("--privileged=%t", privileged),
-				"--uid", strconv.Itoa(c.opts.ContainerUID), "--gid", strconv.Itoa(c.opts.ContainerGID), "--"}, args...)...)
-			proc.Stdin = os.Stdin
-			proc.Stdout = os.Stdout
-			proc.Stderr = os.Stderr
-
-			if privileged {
-				proc.SysProcAttr = &syscall.SysProcAttr{
-					Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET,
-				}
-			} else {
-				proc.SysProcAttr = &syscall.SysProcAttr{
-					Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET | syscall.CLONE_NEWUSER,
-					Credential: &syscall.Credential{Uid: 0, Gid: uint32(c.opts.ContainerGID)},
-					UidMappings: []syscall.SysProcIDMap{
-						{ContainerID: 0, HostID: os.Geteuid(), Size: 1},
-					},
-					GidMappings: []syscall.SysProcIDMap{
-						{ContainerID: c.opts.ContainerGID, HostID: os.Getegid(), Size: 1},
-					},
-				}
-			}
-			if err = proc.Start(); err != nil {
-				return err
-			}
-
-			parentConn := newParentUnixSocketConn(parentFd)
-			tunFd, err := parentConn.ReceiveFd()
-			if err != nil {
-				return err
-			}
-			log.Debug().Int("fd", tunFd).Msg("got tun device")
-			defer unix.Close(tunFd)
-
-			tunMTU, err := parentConn.ReceiveMTU()
-			if err != nil {
-				return err
-			}
-			log.Debug().Uint32("mtu", tunMTU).Msg("")
-
-			dconn := connect.NewDirectConnector()
-			socksTCPConn := dconn
-			socksTCPConns := make([]connect.Connector, 0, len(c.opts.ForwardProxies)+1)
-			socksTCPConns = append(socksTCPConns, dconn)
-			for _, proxyAddr := range forwardProxies {
-				socksTCPConn = connect.NewSOCKS5Connector(socksTCPConn, proxyAddr)
-				socksTCPConns = append(socksTCPConns, socksTCPConn)
-			}
-			socksUDPConn := dconn
-			for i, proxyAddr := range forwardProxies {
-				socksUDPConn = connect.NewSOCKS5UDPConnector(log, socksTCPConns[i], socksUDPConn, proxyAddr)
-			}
-			socksTCPConn = connect.NewLocalForwardingConnector(dconn, socksTCPConn, nat)
-			socksUDPConn = connect.NewLocalForwardingConnector(dconn, socksUDPConn, nat)
-
-			stack, err := connect.NewNetworkStack(log, tunFd, tunMTU, tunNetworkAddr,
-				socksTCPConn, socksUDPConn, connect.NewTransporter(log))
-			if err != nil {
-				return err
-			}
-			defer stack.Close()
-
-			if err = parentConn.SendACK(); err != nil {
-				return err
-			}
-
-			return proc.Wait()
+			log = c.opts.config.logger(log, cmd.Flags(), c.opts.VerboseLevel)
+			return c.opts.runContainer(log, args, nil)
 		},
 	}
 
@@ -143,14 +54,184 @@ type runCmd struct {
 }
 
 type runCmdOpts struct {
-	ForwardProxies       []string
-	LocalAddressMappings []string
-	VerboseLevel         int
-	ContainerUID         int
-	ContainerGID         int
+	networkCmdOpts
+	ContainerUID   int
+	ContainerGID   int
+	Hostname       string
+	MountNamespace bool
+	Nameservers    []string
+	DNSUpstream    string
+	AddHosts       []string
+	HidePaths      []string
+	PIDNamespace   bool
 }
 
 func (o *runCmdOpts) initCliFlags(cmd *cobra.Command) {
+	o.networkCmdOpts.initCliFlags(cmd)
+
+	cmd.Flags().StringVar(&o.Hostname, "hostname", "wirez", "set container hostname")
+
+	cmd.Flags().BoolVar(&o.MountNamespace, "mount-ns", false, "run the command in a private mount namespace with generated /etc/resolv.conf and /etc/hosts, implied by --dns, --add-host and --hide-path")
+	cmd.Flags().StringArrayVar(&o.Nameservers, "dns", nil, "set nameserver in the container resolv.conf, the built-in resolver is used by default")
+	dnsFlag := cmd.Flags().Lookup("dns")
+	dnsFlag.Value = &renamedTypeFlagValue{Value: dnsFlag.Value, name: "ip", hideDefault: true}
+	cmd.Flags().StringVar(&o.DNSUpstream, "dns-upstream", "1.1.1.1:53", "set upstream server of the built-in resolver, queried over TCP through the proxy")
+	dnsUpstreamFlag := cmd.Flags().Lookup("dns-upstream")
+	dnsUpstreamFlag.Value = &renamedTypeFlagValue{Value: dnsUpstreamFlag.Value, name: "address"}
+	cmd.Flags().StringArrayVar(&o.AddHosts, "add-host", nil, "add a custom host-to-IP mapping to the container /etc/hosts")
+	addHostFlag := cmd.Flags().Lookup("add-host")
+	addHostFlag.Value = &renamedTypeFlagValue{Value: addHostFlag.Value, name: "host:ip", hideDefault: true}
+	cmd.Flags().StringArrayVar(&o.HidePaths, "hide-path", nil, "hide the host file or directory from the container, e.g. /run/systemd/resolve")
+	hidePathFlag := cmd.Flags().Lookup("hide-path")
+	hidePathFlag.Value = &renamedTypeFlagValue{Value: hidePathFlag.Value, name: "path", hideDefault: true}
+
+	cmd.Flags().BoolVar(&o.PIDNamespace, "pid-ns", false, "run the command in a new PID namespace with a minimal init that reaps zombies and kills all processes when the command exits")
+
+	cmd.Flags().IntVar(&o.ContainerUID, "uid", os.Geteuid(), "set uid of container process")
+	cmd.Flags().IntVar(&o.ContainerGID, "gid", os.Getegid(), "set gid of container process")
+}
+
+// runContainer runs the command in a new container, started is called with
+// the container pid when its network is ready.
+func (o *runCmdOpts) runContainer(log *zerolog.Logger, args []string, started func(pid int) error) (err error) {
+	if o.ContainerUID < 0 {
+		return errors.New("uid is negative")
+	}
+	if o.ContainerGID < 0 {
+		return errors.New("gid is negative")
+	}
+	stackConfig, err := o.newNetworkStackConfig(log)
+	if err != nil {
+		return
+	}
+
+	mountConfig, resolverIP, err := o.newMountConfig()
+	if err != nil {
+		return
+	}
+
+	parentFd, childFd, err := newUnixSocketPair()
+	if err != nil {
+		return
+	}
+	defer unix.Close(parentFd)
+	childFdOpen := true
+	defer func() {
+		if childFdOpen {
+			unix.Close(childFd)
+		}
+	}()
+
+	privileged := os.Geteuid() == 0
+	proc := exec.Command("/proc/self/exe", append([]string{"runc",
+		"--unix-fd", strconv.Itoa(childFd), fmt.Sprintf("--privileged=%t", privileged),
+		fmt.Sprintf("--pid-ns=%t", o.PIDNamespace),
+		"--uid", strconv.Itoa(o.ContainerUID), "--gid", strconv.Itoa(o.ContainerGID), "--"}, args...)...)
+	proc.Stdin = os.Stdin
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+
+	cloneFlags := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET)
+	if mountConfig.Enabled {
+		cloneFlags |= syscall.CLONE_NEWNS
+	}
+	if o.PIDNamespace {
+		// the new procfs is mounted in the private mount namespace
+		cloneFlags |= syscall.CLONE_NEWPID | syscall.CLONE_NEWNS
+	}
+	if privileged {
+		proc.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: cloneFlags,
+		}
+	} else {
+		proc.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: cloneFlags | syscall.CLONE_NEWUSER,
+			Credential: &syscall.Credential{Uid: 0, Gid: uint32(o.ContainerGID)},
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: os.Geteuid(), Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: o.ContainerGID, HostID: os.Getegid(), Size: 1},
+			},
+		}
+	}
+	if err = proc.Start(); err != nil {
+		return err
+	}
+	// the child end is closed in the parent, so the socket reports EOF if the child fails to set up the container
+	childFdOpen = false
+	if err = unix.Close(childFd); err != nil {
+		return multierr.Append(err, proc.Process.Kill())
+	}
+	stopForwarding := forwardSignals(proc.Process)
+	defer stopForwarding()
+
+	parentConn := newParentUnixSocketConn(parentFd)
+	if err = parentConn.SendNetworkConfig(o.networkConfig(o.Hostname)); err != nil {
+		return err
+	}
+	if err = parentConn.SendMountConfig(mountConfig); err != nil {
+		return err
+	}
+
+	var stackOpts []connect.NetworkStackOption
+	if resolverIP != nil {
+		stackOpts = append(stackOpts, connect.WithDNSForwarder(
+			net.JoinHostPort(resolverIP.String(), "53"), o.DNSUpstream))
+	}
+	closeStack, err := stackConfig.serveTun(parentConn, stackOpts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, closeStack())
+	}()
+
+	if err = parentConn.SendACK(); err != nil {
+		return err
+	}
+	if started != nil {
+		if err = started(proc.Process.Pid); err != nil {
+			return multierr.Append(err, proc.Process.Kill())
+		}
+	}
+
+	return proc.Wait()
+}
+
+// networkCmdOpts configure the network stack serving the tun device of the container.
+type networkCmdOpts struct {
+	ConfigFile            string
+	ForwardProxies        []string
+	LocalAddressMappings  []string
+	VerboseLevel          int
+	RateLimit             string
+	DestinationRateLimits []string
+	PcapFile              string
+	PcapFilter            string
+	SniffHostnames        bool
+	ICMPEcho              string
+	ICMPProbePort         uint16
+	Subnets               []string
+	Gateways              []string
+	MTU                   uint32
+	TunQueues             int
+	PublishPorts          []string
+	HostLoopbackPorts     []string
+	ControlSocket         string
+	FlowTimeouts          timeoutsOpts
+
+	// config is loaded from ConfigFile
+	config *fileConfig
+	// timeouts of flags and the config file
+	timeouts connect.Timeouts
+}
+
+func (o *networkCmdOpts) initCliFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.ConfigFile, "config", "", "load upstreams, local mappings, timeouts and logging from the YAML file, flags take precedence")
+	configFlag := cmd.Flags().Lookup("config")
+	configFlag.Value = &renamedTypeFlagValue{Value: configFlag.Value, name: "path"}
+
 	cmd.Flags().StringArrayVarP(&o.ForwardProxies, "forward", "F", nil, "set socks5 proxy address to forward TCP/UDP packets")
 	forwardFlag := cmd.Flags().Lookup("forward")
 	forwardFlag.Value = &renamedTypeFlagValue{Value: forwardFlag.Value, name: "address", hideDefault: true}
@@ -163,8 +244,351 @@ func (o *runCmdOpts) initCliFlags(cmd *cobra.Command) {
 	localFlag := cmd.Flags().Lookup("local")
 	localFlag.Value = &renamedTypeFlagValue{Value: localFlag.Value, name: "[target_host:]port:host:hostport[/proto]", hideDefault: true}
 
-	cmd.Flags().IntVar(&o.ContainerUID, "uid", os.Geteuid(), "set uid of container process")
-	cmd.Flags().IntVar(&o.ContainerGID, "gid", os.Getegid(), "set gid of container process")
+	cmd.Flags().StringVar(&o.RateLimit, "rate-limit", "", "limit aggregate bandwidth of all container flows in bytes per second, e.g. 1M:10M")
+	rateLimitFlag := cmd.Flags().Lookup("rate-limit")
+	rateLimitFlag.Value = &renamedTypeFlagValue{Value: rateLimitFlag.Value, name: "upload[:download]"}
+
+	cmd.Flags().StringArrayVar(&o.DestinationRateLimits, "rate-limit-dest", nil, "override bandwidth limit of flows to the destination network, 0 means unlimited")
+	rateLimitDestFlag := cmd.Flags().Lookup("rate-limit-dest")
+	rateLimitDestFlag.Value = &renamedTypeFlagValue{Value: rateLimitDestFlag.Value, name: "ip[/cidr]=upload[:download]", hideDefault: true}
+
+	cmd.Flags().StringVar(&o.PcapFile, "pcap", "", "write all IP packets of the container to the pcapng file")
+	cmd.Flags().StringVar(&o.PcapFilter, "pcap-filter", "", "capture only packets matching the filter, e.g. 'tcp and port 443 or udp and port 53'")
+
+	cmd.Flags().BoolVar(&o.SniffHostnames, "sniff", false, "connect to hostnames from TLS SNI or HTTP Host header instead of destination IPs")
+
+	cmd.Flags().StringVar(&o.ICMPEcho, "icmp-echo", "off", "answer ping requests: off, reply (immediately) or probe (after TCP connect to the target through the proxy)")
+	icmpEchoFlag := cmd.Flags().Lookup("icmp-echo")
+	icmpEchoFlag.Value = &renamedTypeFlagValue{Value: icmpEchoFlag.Value, name: "mode"}
+	cmd.Flags().Uint16Var(&o.ICMPProbePort, "icmp-probe-port", 80, "target TCP port of the ping probe")
+
+	cmd.Flags().StringArrayVar(&o.Subnets, "subnet", []string{tunNetworkAddr, tunNetworkAddr6}, "set container address and subnet, the first address of each family is used for the default route")
+	subnetFlag := cmd.Flags().Lookup("subnet")
+	subnetFlag.Value = &renamedTypeFlagValue{Value: subnetFlag.Value, name: "ip/prefix"}
+
+	cmd.Flags().StringArrayVar(&o.Gateways, "gateway", nil, "set default gateway address inside the container subnet, at most one per address family")
+	gatewayFlag := cmd.Flags().Lookup("gateway")
+	gatewayFlag.Value = &renamedTypeFlagValue{Value: gatewayFlag.Value, name: "ip", hideDefault: true}
+
+	cmd.Flags().Uint32Var(&o.MTU, "mtu", 0, "set MTU of the container tun device, 0 keeps the default one")
+	cmd.Flags().IntVar(&o.TunQueues, "tun-queues", defaultTunQueues(), "set number of tun device queues processed in parallel")
+
+	cmd.Flags().StringArrayVarP(&o.PublishPorts, "publish", "p", nil, "publish the container port on the host, the host address is 127.0.0.1 by default")
+	publishFlag := cmd.Flags().Lookup("publish")
+	publishFlag.Value = &renamedTypeFlagValue{Value: publishFlag.Value, name: "[hostip:]hostport:containerport[/proto]", hideDefault: true}
+
+	cmd.Flags().StringSliceVar(&o.HostLoopbackPorts, "host-loopback", nil, "allow the container to reach host loopback services on the ports via the host address, 10.1.1.2 by default")
+	hostLoopbackFlag := cmd.Flags().Lookup("host-loopback")
+	hostLoopbackFlag.Value = &renamedTypeFlagValue{Value: hostLoopbackFlag.Value, name: "port[-port],...", hideDefault: true}
+
+	o.FlowTimeouts.initCliFlags(cmd)
+
+	cmd.Flags().StringVar(&o.ControlSocket, "control", "", "serve the control API on the unix socket, see wirez ctl")
+	controlFlag := cmd.Flags().Lookup("control")
+	controlFlag.Value = &renamedTypeFlagValue{Value: controlFlag.Value, name: "path"}
+}
+
+// loadConfigFile loads the config file, values of flags set on the command line take precedence.
+func (o *networkCmdOpts) loadConfigFile(flags *pflag.FlagSet) (err error) {
+	if o.ConfigFile != "" {
+		if o.config, err = loadConfigFile(o.ConfigFile); err != nil {
+			return
+		}
+		if !flags.Changed("local") {
+			o.LocalAddressMappings = o.config.Run.Local
+		}
+	}
+	o.timeouts, err = o.FlowTimeouts.timeouts(flags, o.config)
+	return
+}
+
+func (o *networkCmdOpts) networkConfig(hostname string) *NetworkConfigMessage {
+	return &NetworkConfigMessage{
+		Hostname:  hostname,
+		MTU:       o.MTU,
+		Addresses: o.Subnets,
+		Gateways:  o.Gateways,
+		Queues:    o.TunQueues,
+	}
+}
+
+// networkStackConfig is the validated configuration of the network stack.
+type networkStackConfig struct {
+	log          *zerolog.Logger
+	opts         *networkCmdOpts
+	tcpConnector connect.Connector
+	udpConnector connect.Connector
+	transporter  connect.Transporter
+	stackOpts    []connect.NetworkStackOption
+	pcapFilter   *connect.PacketFilter
+	portMappings []*portMapping
+	// runtime state of the control API
+	flows     *connect.FlowTable
+	upstreams *upstreamSet
+	forward   *connect.ForwardSwitch
+	nat       connect.AddressMapper
+}
+
+// newNetworkStackConfig validates options before the container is started.
+func (o *networkCmdOpts) newNetworkStackConfig(log *zerolog.Logger) (*networkStackConfig, error) {
+	forwardName, forwardPaths, err := o.forwardPaths()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Strs("forward", o.ForwardProxies).Msg("")
+	log.Debug().Strs("local_address_mappings", o.LocalAddressMappings).Msg("")
+	nat, err := parseAddressMapper(o.LocalAddressMappings)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateContainerNetwork(o.Subnets, o.Gateways, o.MTU); err != nil {
+		return nil, err
+	}
+	if o.TunQueues < 1 || o.TunQueues > maxTunQueues {
+		return nil, fmt.Errorf("tun queues must be between 1 and %d", maxTunQueues)
+	}
+	rateLimit, err := parseRateLimit(o.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	shapingRules, err := parseShapingRules(o.DestinationRateLimits)
+	if err != nil {
+		return nil, err
+	}
+	icmpEchoMode, err := parseICMPEchoMode(o.ICMPEcho)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &networkStackConfig{log: log, opts: o}
+	// the timeouts must be set before options that use them
+	cfg.stackOpts = append(cfg.stackOpts, connect.WithStackTimeouts(o.timeouts))
+	for _, mapping := range o.PublishPorts {
+		portMapping, err := parsePortMapping(mapping)
+		if err != nil {
+			return nil, err
+		}
+		cfg.portMappings = append(cfg.portMappings, portMapping)
+	}
+	hostIPs, err := containerHostIPs(o.Subnets, o.Gateways)
+	if err != nil {
+		return nil, err
+	}
+	cfg.stackOpts = append(cfg.stackOpts, connect.WithHostAddresses(hostIPs...))
+	loopbackPorts, err := parsePortRanges(o.HostLoopbackPorts)
+	if err != nil {
+		return nil, err
+	}
+	if o.PcapFilter != "" {
+		if cfg.pcapFilter, err = connect.ParsePacketFilter(o.PcapFilter); err != nil {
+			return nil, fmt.Errorf("invalid pcap filter: %w", err)
+		}
+	}
+
+	dconn := connect.NewKeepAliveDirectConnector(o.timeouts.TCPKeepAlive)
+	cfg.upstreams = newUpstreamSet(log, o.timeouts.TCPKeepAlive)
+	cfg.forward = connect.NewForwardSwitch()
+	socksTCPConn, socksUDPConn := cfg.upstreams.connectors(forwardPaths)
+	cfg.forward.Add(forwardName, socksTCPConn, socksUDPConn)
+	cfg.upstreams.addConfigRoutes(cfg.forward, o.config, forwardName)
+	cfg.nat = nat
+	cfg.flows = connect.NewFlowTable()
+	cfg.stackOpts = append(cfg.stackOpts, connect.WithStackFlows(cfg.flows))
+	cfg.tcpConnector = connect.NewLocalForwardingConnector(dconn, cfg.forward.TCPConnector(), nat)
+	cfg.udpConnector = connect.NewLocalForwardingConnector(dconn, cfg.forward.UDPConnector(), nat)
+	if len(loopbackPorts) > 0 {
+		log.Debug().Strs("host_loopback_ports", o.HostLoopbackPorts).Msg("")
+		cfg.stackOpts = append(cfg.stackOpts, connect.WithHostLoopback(dconn, loopbackPorts...))
+	}
+
+	if icmpEchoMode != connect.ICMPEchoDisabled {
+		cfg.stackOpts = append(cfg.stackOpts, connect.WithICMPEcho(icmpEchoMode, o.ICMPProbePort))
+	}
+	if o.SniffHostnames {
+		cfg.stackOpts = append(cfg.stackOpts, connect.WithHostnameSniffing())
+	}
+
+	cfg.transporter = connect.NewTransporter(log)
+	if o.RateLimit != "" || len(shapingRules) > 0 {
+		cfg.transporter = connect.NewShapingTransporter(cfg.transporter, rateLimit, shapingRules)
+	}
+	return cfg, nil
+}
+
+// forwardPaths returns proxy chains of the forward flag or of the config file forward name,
+// the name of the forward flag chain consists of its proxy addresses.
+func (o *networkCmdOpts) forwardPaths() (name string, paths [][]*connect.SocksAddr, err error) {
+	if len(o.ForwardProxies) > 0 {
+		forwardProxies, err := parseProxyURLs(o.ForwardProxies)
+		if err != nil {
+			return "", nil, err
+		}
+		return pathName(forwardProxies), [][]*connect.SocksAddr{forwardProxies}, nil
+	}
+	if o.config != nil && o.config.Run.Forward != "" {
+		return o.config.Run.Forward, o.config.routes[o.config.Run.Forward], nil
+	}
+	return "", nil, errors.New("forward proxies list is empty")
+}
+
+// serveTun receives tun device fds from the child and serves them with the
+// network stack, the returned function stops the stack and closes the fds.
+func (c *networkStackConfig) serveTun(parentConn *parentUnixSocketConn,
+	opts ...connect.NetworkStackOption) (closeFunc func() error, err error) {
+	tunFds, err := parentConn.ReceiveFds(c.opts.TunQueues)
+	if err != nil {
+		return
+	}
+	c.log.Debug().Ints("fds", tunFds).Msg("got tun device")
+
+	tunMTU, err := parentConn.ReceiveMTU()
+	if err != nil {
+		closeFds(tunFds)
+		return
+	}
+	c.log.Debug().Uint32("mtu", tunMTU).Msg("")
+
+	stackOpts := append(append([]connect.NetworkStackOption{}, c.stackOpts...), opts...)
+	closeCapture := func() error { return nil }
+	if c.opts.PcapFile != "" {
+		var capture *connect.PacketCapture
+		if capture, closeCapture, err = newPacketCapture(c.opts.PcapFile, c.pcapFilter); err != nil {
+			closeFds(tunFds)
+			return
+		}
+		stackOpts = append(stackOpts, connect.WithPacketCapture(capture))
+	}
+
+	stack, err := connect.NewNetworkStack(c.log, tunFds, tunMTU, c.opts.Subnets,
+		c.tcpConnector, c.udpConnector, c.transporter, stackOpts...)
+	if err != nil {
+		closeFds(tunFds)
+		return nil, multierr.Append(err, closeCapture())
+	}
+	publisher, err := c.publishPorts(stack)
+	if err != nil {
+		stack.Close()
+		closeFds(tunFds)
+		return nil, multierr.Append(err, closeCapture())
+	}
+	closeControl := func() error { return nil }
+	if c.opts.ControlSocket != "" {
+		if closeControl, err = serveControl(c.log, c.opts.ControlSocket, connect.ControlConfig{
+			Flows: c.flows, Upstreams: c.upstreams.list(), Forward: c.forward, Mappings: c.nat,
+		}); err != nil {
+			err = multierr.Append(err, publisher.Close())
+			stack.Close()
+			closeFds(tunFds)
+			return nil, multierr.Append(err, closeCapture())
+		}
+	}
+	return func() error {
+		err := multierr.Append(closeControl(), publisher.Close())
+		stack.Close()
+		closeFds(tunFds)
+		return multierr.Append(err, closeCapture())
+	}, nil
+}
+
+// publishPorts listens on host addresses of port mappings and relays
+// connections to the container through the network stack.
+func (c *networkStackConfig) publishPorts(stack *connect.NetworkStack) (*connect.PortPublisher, error) {
+	publisher := connect.NewPortPublisher(c.log, stack, c.transporter)
+	publisher.ConnectTimeout = stack.ConnectTimeout
+	publisher.TcpIOTimeout = stack.TcpIOTimeout
+	publisher.UdpIOTimeout = stack.UdpIOTimeout
+	publisher.TcpLifetime = stack.TcpLifetime
+	publisher.UdpLifetime = stack.UdpLifetime
+	for _, mapping := range c.portMappings {
+		hostIP, _, err := net.SplitHostPort(mapping.hostAddress)
+		if err != nil {
+			return nil, multierr.Append(err, publisher.Close())
+		}
+		ip, err := containerIP(c.opts.Subnets, net.ParseIP(hostIP).To4() == nil)
+		if err != nil {
+			return nil, multierr.Append(err, publisher.Close())
+		}
+		containerAddress := net.JoinHostPort(ip.String(), mapping.containerPort)
+		addr, err := publisher.Publish(mapping.network, mapping.hostAddress, containerAddress)
+		if err != nil {
+			return nil, multierr.Append(fmt.Errorf("publish %s: %w", mapping.hostAddress, err), publisher.Close())
+		}
+		c.log.Info().Str("network", mapping.network).Stringer("hostAddr", addr).
+			Str("containerAddr", containerAddress).Msg("published container port")
+	}
+	return publisher, nil
+}
+
+// newMountConfig generates files of the container mount namespace, resolverIP is the
+// address of the built-in resolver if it is used.
+func (o *runCmdOpts) newMountConfig() (mountConfig *MountConfigMessage, resolverIP net.IP, err error) {
+	mountConfig = &MountConfigMessage{
+		Enabled: o.MountNamespace || len(o.Nameservers) > 0 || len(o.AddHosts) > 0 || len(o.HidePaths) > 0,
+	}
+	if !mountConfig.Enabled {
+		return
+	}
+	nameservers := o.Nameservers
+	if len(nameservers) == 0 {
+		if _, _, err = net.SplitHostPort(o.DNSUpstream); err != nil {
+			return nil, nil, fmt.Errorf("invalid dns upstream: %w", err)
+		}
+		if resolverIP, err = builtinResolverIP(o.Subnets, o.Gateways); err != nil {
+			return
+		}
+		nameservers = []string{resolverIP.String()}
+	}
+	if mountConfig.ResolvConf, err = generateResolvConf(nameservers); err != nil {
+		return
+	}
+	if mountConfig.Hosts, err = generateHosts(o.Hostname, o.AddHosts); err != nil {
+		return
+	}
+	for _, path := range o.HidePaths {
+		if !filepath.IsAbs(path) {
+			return nil, nil, fmt.Errorf("hidden path must be absolute: %s", path)
+		}
+	}
+	mountConfig.HidePaths = o.HidePaths
+	return
+}
+
+func parseICMPEchoMode(mode string) (connect.ICMPEchoMode, error) {
+	switch mode {
+	case "off":
+		return connect.ICMPEchoDisabled, nil
+	case "reply":
+		return connect.ICMPEchoReply, nil
+	case "probe":
+		return connect.ICMPEchoProbe, nil
+	}
+	return connect.ICMPEchoDisabled, fmt.Errorf("invalid icmp echo mode: %s", mode)
+}
+
+// newPacketCapture creates the pcapng file, the returned function flushes and closes it.
+func newPacketCapture(pcapFile string, filter *connect.PacketFilter) (capture *connect.PacketCapture, closeFunc func() error, err error) {
+	f, err := os.Create(pcapFile)
+	if err != nil {
+		return
+	}
+	if capture, err = connect.NewPacketCapture(f, tunDevice, filter); err != nil {
+		return nil, nil, multierr.Append(err, f.Close())
+	}
+	closeFunc = func() error {
+		return multierr.Append(capture.Flush(), f.Close())
+	}
+	return
+}
+
+// maxTunQueues is the kernel limit of tun device queues
+const maxTunQueues = 256
+
+// defaultTunQueues uses a queue per CPU, but not too many to save fds and memory.
+func defaultTunQueues() int {
+	queues := runtime.NumCPU()
+	if queues > 4 {
+		queues = 4
+	}
+	return queues
 }
 
 func newUnixSocketPair() (parentFd, childFd int, err error) {
@@ -200,27 +624,45 @@ func (c *parentUnixSocketConn) Close() error {
 	return unix.Close(c.socketFd)
 }
 
-func (c *parentUnixSocketConn) ReceiveFd() (fd int, err error) {
+// ReceiveFds receives up to maxFds file descriptors.
+func (c *parentUnixSocketConn) ReceiveFds(maxFds int) (fds []int, err error) {
 	// receive socket control message
-	b := make([]byte, unix.CmsgSpace(4))
-	if _, _, _, _, err = unix.Recvmsg(c.socketFd, nil, b, 0); err != nil {
+	b := make([]byte, unix.CmsgSpace(4*maxFds))
+	_, oobn, _, _, err := unix.Recvmsg(c.socketFd, nil, b, 0)
+	if err != nil {
 		return
 	}
+	// the socket is closed by the exited child
+	if oobn == 0 {
+		return nil, errors.New("container exited before sending tun fds")
+	}
 
 	// parse socket control message
-	cmsgs, err := unix.ParseSocketControlMessage(b)
+	cmsgs, err := unix.ParseSocketControlMessage(b[:oobn])
 	if err != nil {
-		return 0, fmt.Errorf("parse socket control message: %w", err)
+		return nil, fmt.Errorf("parse socket control message: %w", err)
 	}
 
-	tunFds, err := unix.ParseUnixRights(&cmsgs[0])
-	if err != nil {
-		return 0, err
+	for i := range cmsgs {
+		rights, err := unix.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		fds = append(fds, rights...)
 	}
-	if len(tunFds) == 0 {
-		return 0, errors.New("tun fds slice is empty")
+	if len(fds) == 0 {
+		return nil, errors.New("tun fds slice is empty")
 	}
-	return tunFds[0], nil
+	return fds, nil
+}
+
+func (c *parentUnixSocketConn) SendNetworkConfig(msg *NetworkConfigMessage) error {
+	return json.NewEncoder(c.socketFile).Encode(msg)
+}
+
+func (c *parentUnixSocketConn) SendMountConfig(msg *MountConfigMessage) error {
+	return json.NewEncoder(c.socketFile).Encode(msg)
 }
 
 func (c *parentUnixSocketConn) ReceiveMTU() (mtu uint32, err error) {
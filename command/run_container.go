@@ -6,12 +6,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
 	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/tcpip/link/rawfile"
 	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
@@ -21,6 +25,11 @@ const (
 	loDevice       = "lo"
 	tunDevice      = "tun0"
 	tunNetworkAddr = "10.1.1.1/24"
+	// tunNetworkAddr6 is the IPv6 unique local address of the container
+	tunNetworkAddr6 = "fd77:6972:657a::1/64"
+
+	resolvConfFile = "/etc/resolv.conf"
+	hostsFile      = "/etc/hosts"
 )
 
 func newRunContainerCmd() *runContainerCmd {
@@ -28,24 +37,48 @@ func newRunContainerCmd() *runContainerCmd {
 
 	cmd := &cobra.Command{
 		Use:     "runc [flags] command",
-		Example: "runc --hostname=wirez --unix-fd=10 bash",
+		Example: "runc --unix-fd=10 bash",
 		Short:   "Internal command to run a new process inside an isolated container",
 		Hidden:  true,
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			if err = syscall.Sethostname([]byte(c.opts.Hostname)); err != nil {
-				return
-			}
-
 			childConn := newChildUnixSocketConn(c.opts.PipeFd)
 			defer childConn.Close()
 
-			tunFd, err := tun.Open(tunDevice)
+			netConfig, err := childConn.ReceiveNetworkConfig()
 			if err != nil {
-				return err
+				return
+			}
+			mountConfig, err := childConn.ReceiveMountConfig()
+			if err != nil {
+				return
+			}
+			if mountConfig.Enabled {
+				if err = setupMountNamespace(mountConfig); err != nil {
+					return fmt.Errorf("setup mount namespace: %w", err)
+				}
+			}
+			if c.opts.PIDNamespace {
+				if err = mountProc(); err != nil {
+					return fmt.Errorf("mount proc: %w", err)
+				}
+			}
+			if err = syscall.Sethostname([]byte(netConfig.Hostname)); err != nil {
+				return
+			}
+
+			tunFds, err := openTun(tunDevice, netConfig.Queues)
+			if err != nil {
+				return fmt.Errorf("open tun: %w", err)
+			}
+			defer closeFds(tunFds)
+
+			if netConfig.MTU > 0 {
+				if err = setLinkMTU(tunDevice, netConfig.MTU); err != nil {
+					return fmt.Errorf("set mtu: %w", err)
+				}
 			}
-			defer unix.Close(tunFd)
 
-			if err = childConn.SendFd(tunFd); err != nil {
+			if err = childConn.SendFds(tunFds...); err != nil {
 				return
 			}
 
@@ -63,7 +96,7 @@ func newRunContainerCmd() *runContainerCmd {
 				return
 			}
 
-			if err = setupIPNetwork(); err != nil {
+			if err = setupIPNetwork(netConfig); err != nil {
 				return err
 			}
 
@@ -89,7 +122,10 @@ func newRunContainerCmd() *runContainerCmd {
 				}
 			}
 
-			return proc.Run()
+			if c.opts.PIDNamespace {
+				return runInit(proc)
+			}
+			return runCommand(proc)
 		},
 	}
 
@@ -105,30 +141,34 @@ type runContainerCmd struct {
 }
 
 type runContainerCmdOpts struct {
-	Hostname     string
 	PipeFd       int
 	ContainerUID int
 	ContainerGID int
 	Privileged   bool
+	PIDNamespace bool
 }
 
 func (o *runContainerCmdOpts) initCliFlags(cmd *cobra.Command) {
-	cmd.Flags().StringVar(&o.Hostname, "hostname", "wirez", "set container hostname")
 	cmd.Flags().IntVar(&o.PipeFd, "unix-fd", 0, "set unix pipe fd")
 	cmd.Flags().IntVar(&o.ContainerUID, "uid", os.Geteuid(), "set uid of container process")
 	cmd.Flags().IntVar(&o.ContainerGID, "gid", os.Getegid(), "set gid of container process")
 	cmd.Flags().BoolVar(&o.Privileged, "privileged", false, "indicates if started with root privileges")
+	cmd.Flags().BoolVar(&o.PIDNamespace, "pid-ns", false, "indicates if started in a new PID namespace")
 }
 
 type childUnixSocketConn struct {
 	socketFd   int
 	socketFile *os.File
+	// decoder is shared by all messages since it may read ahead several of them
+	decoder *json.Decoder
 }
 
 func newChildUnixSocketConn(socketFd int) *childUnixSocketConn {
+	socketFile := os.NewFile(uintptr(socketFd), "childPipe")
 	return &childUnixSocketConn{
 		socketFd:   socketFd,
-		socketFile: os.NewFile(uintptr(socketFd), "childPipe"),
+		socketFile: socketFile,
+		decoder:    json.NewDecoder(socketFile),
 	}
 }
 
@@ -136,8 +176,8 @@ func (c *childUnixSocketConn) Close() error {
 	return unix.Close(c.socketFd)
 }
 
-func (c *childUnixSocketConn) SendFd(fd int) error {
-	rights := unix.UnixRights(fd)
+func (c *childUnixSocketConn) SendFds(fds ...int) error {
+	rights := unix.UnixRights(fds...)
 	return unix.Sendmsg(c.socketFd, nil, rights, nil, 0)
 }
 
@@ -150,9 +190,21 @@ func (c *childUnixSocketConn) SendMTU(mtu uint32) error {
 	return err
 }
 
+func (c *childUnixSocketConn) ReceiveNetworkConfig() (msg *NetworkConfigMessage, err error) {
+	msg = &NetworkConfigMessage{}
+	err = c.decoder.Decode(msg)
+	return
+}
+
+func (c *childUnixSocketConn) ReceiveMountConfig() (msg *MountConfigMessage, err error) {
+	msg = &MountConfigMessage{}
+	err = c.decoder.Decode(msg)
+	return
+}
+
 func (c *childUnixSocketConn) ReceiveACK() (err error) {
 	var msg ACKMessage
-	if err = json.NewDecoder(c.socketFile).Decode(&msg); err != nil {
+	if err = c.decoder.Decode(&msg); err != nil {
 		return
 	}
 	if !msg.ACK {
@@ -165,7 +217,218 @@ type MTUMessage struct {
 	MTU uint32 `json:"mtu"`
 }
 
-func setupIPNetwork() error {
+// NetworkConfigMessage describes the network layout of the container.
+type NetworkConfigMessage struct {
+	Hostname string `json:"hostname"`
+	// MTU of the tun device, zero keeps the default one
+	MTU uint32 `json:"mtu"`
+	// Addresses of the tun device in the ip/prefix format
+	Addresses []string `json:"addresses"`
+	// Gateways are optional default gateways, at most one per address family
+	Gateways []string `json:"gateways"`
+	// Queues is the number of tun device queues, each one is sent as a separate fd
+	Queues int `json:"queues"`
+}
+
+// openTun opens the tun device, multi-queue mode is enabled only for several queues.
+func openTun(name string, queues int) (fds []int, err error) {
+	if queues <= 1 {
+		fd, err := tun.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return []int{fd}, nil
+	}
+	fds = make([]int, 0, queues)
+	for i := 0; i < queues; i++ {
+		fd, err := openTunQueue(name)
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return
+}
+
+func openTunQueue(name string) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return -1, multierr.Append(err, unix.Close(fd))
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		return -1, multierr.Append(err, unix.Close(fd))
+	}
+	return fd, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// MountConfigMessage describes files of the private mount namespace of the container.
+type MountConfigMessage struct {
+	Enabled    bool   `json:"enabled"`
+	ResolvConf string `json:"resolvConf"`
+	Hosts      string `json:"hosts"`
+	// HidePaths are host files and directories hidden from the container
+	HidePaths []string `json:"hidePaths"`
+}
+
+// setupMountNamespace bind-mounts generated /etc/resolv.conf and /etc/hosts files
+// and hides host paths in the mount namespace created for the container.
+func setupMountNamespace(mountConfig *MountConfigMessage) (err error) {
+	// don't propagate container mounts to the host
+	if err = unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+
+	// hidden directories are private tmpfs mounts, files created there don't reach the host
+	var privateDirs []string
+	for _, path := range mountConfig.HidePaths {
+		var private bool
+		if private, err = hidePath(path); err != nil {
+			return fmt.Errorf("hide %s: %w", path, err)
+		}
+		if private {
+			privateDirs = append(privateDirs, filepath.Clean(path))
+		}
+	}
+
+	// resolv.conf is often a symlink to a file in one of the hidden directories
+	if err = bindMountContent(resolvConfFile, mountConfig.ResolvConf, privateDirs); err != nil {
+		return fmt.Errorf("mount %s: %w", resolvConfFile, err)
+	}
+	if err = bindMountContent(hostsFile, mountConfig.Hosts, privateDirs); err != nil {
+		return fmt.Errorf("mount %s: %w", hostsFile, err)
+	}
+	return nil
+}
+
+// hidePath mounts an empty tmpfs over the directory or /dev/null over the file,
+// it reports whether the path is the private tmpfs directory.
+func hidePath(path string) (private bool, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return
+	}
+	if fi.IsDir() {
+		return true, unix.Mount("tmpfs", path, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755")
+	}
+	return false, unix.Mount(os.DevNull, path, "", unix.MS_BIND, "")
+}
+
+// bindMountContent bind-mounts a file with the given content over the target path.
+// The missing target is created only if it isn't a symlink, the missing file
+// the symlink points to is created only in one of the private directories.
+func bindMountContent(target, content string, privateDirs []string) (err error) {
+	if target, err = mountTarget(target, privateDirs); err != nil {
+		return
+	}
+	f, err := os.CreateTemp("", "wirez-")
+	if err != nil {
+		return
+	}
+	// the mount keeps the file alive after it is removed
+	defer func() {
+		err = multierr.Append(err, os.Remove(f.Name()))
+	}()
+	if _, err = f.WriteString(content); err != nil {
+		return multierr.Append(err, f.Close())
+	}
+	if err = f.Chmod(0o644); err != nil {
+		return multierr.Append(err, f.Close())
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = unix.Mount(f.Name(), target, "", unix.MS_BIND, ""); err != nil {
+		return
+	}
+	// read-only flag of bind mounts is applied only on remount
+	return unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, "")
+}
+
+// mountTarget resolves symlinks of the target and creates the missing file to mount over.
+func mountTarget(target string, privateDirs []string) (string, error) {
+	resolved, linked, err := resolveSymlinks(target)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Lstat(resolved); !errors.Is(err, os.ErrNotExist) {
+		return resolved, err
+	}
+	// the dangling symlink must not create files on the host filesystem
+	if linked && !inDirs(resolved, privateDirs) {
+		return "", fmt.Errorf("%s is a dangling symlink to %s, hide its directory with --hide-path", target, resolved)
+	}
+	if err = os.MkdirAll(filepath.Dir(resolved), 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(resolved, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0o644)
+	if err != nil {
+		return "", err
+	}
+	return resolved, f.Close()
+}
+
+// resolveSymlinks follows symlinks of the path even if the final file is missing,
+// it reports whether the path is a symlink.
+func resolveSymlinks(path string) (resolved string, linked bool, err error) {
+	// the same limit as the kernel uses
+	const maxLinks = 40
+	for i := 0; i < maxLinks; i++ {
+		fi, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return path, linked, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return path, linked, nil
+		}
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", false, err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path, linked = filepath.Clean(link), true
+	}
+	return "", false, unix.ELOOP
+}
+
+// inDirs reports whether the path is inside one of the directories.
+func inDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+func setLinkMTU(device string, mtu uint32) error {
+	dev, err := netlink.LinkByName(device)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetMTU(dev, int(mtu))
+}
+
+func setupIPNetwork(netConfig *NetworkConfigMessage) error {
 	lo, err := netlink.LinkByName(loDevice)
 	if err != nil {
 		return err
@@ -174,29 +437,69 @@ func setupIPNetwork() error {
 		return err
 	}
 
-	tun0, tunAddr, err := setupIPAddress(tunDevice, tunNetworkAddr)
+	tun0, err := netlink.LinkByName(tunDevice)
 	if err != nil {
 		return err
 	}
+	if err = netlink.LinkSetUp(tun0); err != nil {
+		return err
+	}
+
+	gateways := make(map[bool]net.IP, len(netConfig.Gateways))
+	for _, gateway := range netConfig.Gateways {
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			return fmt.Errorf("invalid gateway: %s", gateway)
+		}
+		gateways[ip.To4() == nil] = ip
+	}
 
-	return netlink.RouteAdd(&netlink.Route{
-		Gw:        tunAddr.IP,
-		LinkIndex: tun0.Attrs().Index,
-	})
+	// the first address of each family gets the default route
+	routed := make(map[bool]bool, 2)
+	for _, networkAddr := range netConfig.Addresses {
+		addr, err := netlink.ParseAddr(networkAddr)
+		if err != nil {
+			return err
+		}
+		ipv6 := addr.IP.To4() == nil
+		if err = addIPAddress(tun0, addr, ipv6); err != nil {
+			// IPv6 is disabled on the host, run the container with IPv4 only
+			if ipv6 && (errors.Is(err, unix.EAFNOSUPPORT) || errors.Is(err, unix.EACCES)) {
+				continue
+			}
+			return err
+		}
+		if routed[ipv6] {
+			continue
+		}
+		routed[ipv6] = true
+		if err = netlink.RouteAdd(defaultRoute(tun0, addr, gateways[ipv6], ipv6)); err != nil {
+			return fmt.Errorf("add default route: %w", err)
+		}
+	}
+	return nil
 }
 
-func setupIPAddress(device, networkAddr string) (dev netlink.Link, addr *netlink.Addr, err error) {
-	dev, err = netlink.LinkByName(device)
-	if err != nil {
-		return
+func addIPAddress(dev netlink.Link, addr *netlink.Addr, ipv6 bool) error {
+	if ipv6 {
+		// the address is unique on the tun device, skip duplicate address detection
+		// to make it available immediately
+		addr.Flags = unix.IFA_F_NODAD
 	}
-	if err = netlink.LinkSetUp(dev); err != nil {
-		return
+	return netlink.AddrAdd(dev, addr)
+}
+
+// defaultRoute routes all traffic to the tun device, IPv4 traffic is routed via
+// the container address itself unless the gateway is specified.
+func defaultRoute(dev netlink.Link, addr *netlink.Addr, gateway net.IP, ipv6 bool) *netlink.Route {
+	route := &netlink.Route{
+		Gw:        gateway,
+		LinkIndex: dev.Attrs().Index,
 	}
-	addr, err = netlink.ParseAddr(networkAddr)
-	if err != nil {
-		return
+	if ipv6 {
+		route.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+	} else if gateway == nil {
+		route.Gw = addr.IP
 	}
-	err = netlink.AddrAdd(dev, addr)
-	return
+	return route
 }
@@ -12,6 +12,8 @@ const (
 	loDevice       = "lo"
 	tunDevice      = "tun0"
 	tunNetworkAddr = "10.1.1.1/24"
+	// tunNetworkAddr6 is the IPv6 unique local address of the container
+	tunNetworkAddr6 = "fd77:6972:657a::1/64"
 )
 
 func newRunContainerCmd() *runContainerCmd {
@@ -0,0 +1,65 @@
+//go:build linux
+
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountTarget(t *testing.T) {
+	t.Run("File", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "hosts")
+		require.NoError(t, os.WriteFile(target, []byte("host"), 0o644))
+		resolved, err := mountTarget(target, nil)
+		require.NoError(t, err)
+		require.Equal(t, target, resolved)
+	})
+	t.Run("MissingFile", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "etc", "hosts")
+		resolved, err := mountTarget(target, nil)
+		require.NoError(t, err)
+		require.Equal(t, target, resolved)
+		require.FileExists(t, target)
+	})
+	t.Run("Symlink", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "stub-resolv.conf")
+		require.NoError(t, os.WriteFile(file, nil, 0o644))
+		target := filepath.Join(dir, "resolv.conf")
+		require.NoError(t, os.Symlink("stub-resolv.conf", target))
+		resolved, err := mountTarget(target, nil)
+		require.NoError(t, err)
+		require.Equal(t, file, resolved)
+	})
+	t.Run("DanglingSymlink", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "resolve", "stub-resolv.conf")
+		target := filepath.Join(dir, "resolv.conf")
+		require.NoError(t, os.Symlink(file, target))
+		_, err := mountTarget(target, nil)
+		require.Error(t, err)
+		require.NoFileExists(t, file)
+	})
+	t.Run("DanglingSymlinkToPrivateDir", func(t *testing.T) {
+		dir := t.TempDir()
+		privateDir := filepath.Join(dir, "resolve")
+		require.NoError(t, os.Mkdir(privateDir, 0o755))
+		file := filepath.Join(privateDir, "stub-resolv.conf")
+		target := filepath.Join(dir, "resolv.conf")
+		require.NoError(t, os.Symlink(file, target))
+		resolved, err := mountTarget(target, []string{privateDir})
+		require.NoError(t, err)
+		require.Equal(t, file, resolved)
+		require.FileExists(t, file)
+	})
+	t.Run("SymlinkLoop", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "resolv.conf")
+		require.NoError(t, os.Symlink("resolv.conf", target))
+		_, err := mountTarget(target, nil)
+		require.Error(t, err)
+	})
+}
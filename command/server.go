@@ -6,69 +6,130 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ginuerzh/gosocks5/server"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/v-byte-cpu/wirez/pkg/connect"
+	"go.uber.org/multierr"
 )
 
 func newServerCmd(log *zerolog.Logger) *serverCmd {
 	c := &serverCmd{}
 
 	cmd := &cobra.Command{
-		Use:     "server [flags]",
-		Example: "server -l 127.0.0.1:1080 -f proxies.txt",
-		Short:   "Start SOCKS5 server to load-balance requests",
+		Use: "server [flags]",
+		Example: strings.Join([]string{
+			"server -l 127.0.0.1:1080 -f proxies.txt",
+			"server -l tcp://127.0.0.1:1080 -l 'unix:///run/wirez.sock?mode=0660' -f proxies.txt",
+			"server -l 'tls://:1443?cert=server.pem&key=server.key&client-ca=ca.pem&file=eu-proxies.txt'"}, "\n"),
+		Short: "Start SOCKS5/SOCKS4/HTTP proxy server to load-balance requests",
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			f, err := os.Open(c.opts.proxyFile)
-			if err != nil {
+			if err = c.opts.loadConfigFile(cmd.Flags()); err != nil {
 				return err
 			}
-			defer f.Close()
-			socksAddrs, err := parseProxyFile(f)
-			if err != nil {
-				return err
+			log = c.opts.config.logger(log, cmd.Flags(), c.opts.verboseLevel)
+			listeners := c.opts.listeners
+			if listeners == nil {
+				if listeners, err = parseListenURLs(c.opts.listenAddrs); err != nil {
+					return err
+				}
 			}
 
-			log.Info().Msgf("starting listening on %s...", c.opts.listenAddr)
-			ln, err := net.Listen("tcp", c.opts.listenAddr)
-			if err != nil {
-				return err
-			}
-			srv := &server.Server{
-				Listener: ln,
+			handlerOpts := []connect.ServerOption{connect.WithTimeouts(c.opts.timeouts)}
+			var users *connect.UserManager
+			if c.opts.usersFile != "" {
+				if users, err = newUserManager(c.opts.usersFile, c.opts.quotaStateFile); err != nil {
+					return err
+				}
+				handlerOpts = append(handlerOpts, connect.WithUsers(users))
+				defer func() {
+					err = multierr.Append(err, users.Save())
+				}()
+				go saveUsersPeriodically(log, users, quotaSaveInterval)
 			}
 
-			dconn := connect.NewDirectConnector()
-			tcpProxies := make([]connect.Connector, 0, len(socksAddrs))
-			for _, socksAddr := range socksAddrs {
-				socksConn := connect.NewSOCKS5Connector(dconn, socksAddr)
-				tcpProxies = append(tcpProxies, socksConn)
+			flows := connect.NewFlowTable()
+			handlerOpts = append(handlerOpts, connect.WithFlows(flows))
+			upstreams := newUpstreamSet(log, c.opts.timeouts.TCPKeepAlive)
+			// forward switches upstreams of listeners without their own forward or proxies file
+			var forward *connect.ForwardSwitch
+			defaultKey := c.opts.upstreams(&listenerConfig{})
+
+			tracker := connect.NewConnTracker()
+			handlers := make(map[upstreamsKey]server.Handler)
+			servers := make([]*proxyServer, 0, len(listeners))
+			defer func() {
+				if err != nil {
+					err = multierr.Append(err, closeServers(servers))
+				}
+			}()
+			for _, listener := range listeners {
+				key := c.opts.upstreams(listener)
+				handler, ok := handlers[key]
+				if !ok {
+					var tcpConn, udpConn connect.Connector
+					if tcpConn, udpConn, err = c.opts.upstreamConnectors(upstreams, key); err != nil {
+						return err
+					}
+					if key == defaultKey {
+						forward = connect.NewForwardSwitch()
+						forward.Add(key.String(), tcpConn, udpConn)
+						upstreams.addConfigRoutes(forward, c.opts.config, key.forward)
+						tcpConn, udpConn = forward.TCPConnector(), forward.UDPConnector()
+					}
+					handler = connect.NewServerHandler(log, tcpConn, udpConn, connect.NewTransporter(log), handlerOpts...)
+					handlers[key] = handler
+				}
+
+				log.Info().Msgf("starting listening on %s...", listener)
+				ln, err := listener.Listen()
+				if err != nil {
+					return err
+				}
+				servers = append(servers, &proxyServer{
+					Server:  &server.Server{Listener: tracker.Listener(ln)},
+					handler: handler,
+				})
 			}
-			rotationTCPConn := connect.NewRotationConnector(tcpProxies)
 
-			udpProxies := make([]connect.Connector, 0, len(socksAddrs))
-			for _, socksAddr := range socksAddrs {
-				socksConn := connect.NewSOCKS5UDPConnector(log, dconn, dconn, socksAddr)
-				udpProxies = append(udpProxies, socksConn)
+			if c.opts.controlSocket != "" {
+				var closeControl func() error
+				if closeControl, err = serveControl(log, c.opts.controlSocket, connect.ControlConfig{
+					Flows: flows, Upstreams: upstreams.list(), Forward: forward,
+				}); err != nil {
+					return err
+				}
+				defer func() {
+					err = multierr.Append(err, closeControl())
+				}()
 			}
-			rotationUDPConn := connect.NewRotationConnector(udpProxies)
 
 			go func() {
 				ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 				defer cancel()
 				<-ctx.Done()
-				if err := srv.Close(); err != nil {
+				if err := closeServers(servers); err != nil {
 					log.Error().Err(err).Msg("")
 				}
 			}()
 
-			err = srv.Serve(connect.NewSOCKS5ServerHandler(log, rotationTCPConn, rotationUDPConn, connect.NewTransporter(log)))
-			if err != nil && !errors.Is(err, net.ErrClosed) {
+			if err = serveAll(servers); err != nil {
 				return err
 			}
+
+			log.Info().Int("connections", tracker.Len()).Dur("grace_period", c.opts.gracePeriod).
+				Msg("draining active connections...")
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.gracePeriod)
+			defer cancel()
+			if closed := tracker.Drain(ctx); closed > 0 {
+				log.Warn().Int("connections", closed).Msg("force closed active connections after grace period")
+			}
 			return nil
 		},
 	}
@@ -79,17 +140,212 @@ func newServerCmd(log *zerolog.Logger) *serverCmd {
 	return c
 }
 
+// proxyServer binds a listener to the handler of its upstream pool.
+type proxyServer struct {
+	*server.Server
+	handler server.Handler
+}
+
+// upstreamConnectors returns connectors of the config file forward name or of the proxies file.
+func (o *serverCmdOpts) upstreamConnectors(upstreams *upstreamSet, key upstreamsKey) (tcpConn, udpConn connect.Connector, err error) {
+	if key.forward != "" {
+		tcpConn, udpConn = upstreams.connectors(o.config.routes[key.forward])
+		return
+	}
+	paths, err := loadProxyFilePaths(key.proxyFile)
+	if err != nil {
+		return
+	}
+	tcpConn, udpConn = upstreams.connectors(paths)
+	return
+}
+
+func loadProxyFilePaths(proxyFile string) ([][]*connect.SocksAddr, error) {
+	f, err := os.Open(proxyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	socksAddrs, err := parseProxyFile(f)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([][]*connect.SocksAddr, 0, len(socksAddrs))
+	for _, socksAddr := range socksAddrs {
+		paths = append(paths, []*connect.SocksAddr{socksAddr})
+	}
+	return paths, nil
+}
+
+func newUserManager(usersFile, quotaStateFile string) (*connect.UserManager, error) {
+	f, err := os.Open(usersFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, err := parseUsersFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewUserManager(users, quotaStateFile)
+}
+
+// quotaSaveInterval is the interval of persisting user data usage to the quota state file
+const quotaSaveInterval = 1 * time.Minute
+
+func saveUsersPeriodically(log *zerolog.Logger, users *connect.UserManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := users.Save(); err != nil {
+			log.Error().Err(err).Msg("save quota state")
+		}
+	}
+}
+
+// serveAll serves all servers until they are closed, the first failed server closes the others.
+func serveAll(servers []*proxyServer) (err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var closeOnce sync.Once
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *proxyServer) {
+			defer wg.Done()
+			serveErr := srv.Serve(srv.handler)
+			if serveErr == nil || errors.Is(serveErr, net.ErrClosed) {
+				return
+			}
+			mu.Lock()
+			err = multierr.Append(err, serveErr)
+			mu.Unlock()
+			closeOnce.Do(func() {
+				// listeners of the stopped servers are already closed
+				//nolint:errcheck
+				closeServers(servers)
+			})
+		}(srv)
+	}
+	wg.Wait()
+	return
+}
+
+func closeServers(servers []*proxyServer) (err error) {
+	for _, srv := range servers {
+		err = multierr.Append(err, srv.Close())
+	}
+	return
+}
+
 type serverCmd struct {
 	cmd  *cobra.Command
 	opts serverCmdOpts
 }
 
 type serverCmdOpts struct {
-	listenAddr string
-	proxyFile  string
+	configFile     string
+	listenAddrs    []string
+	proxyFile      string
+	gracePeriod    time.Duration
+	usersFile      string
+	quotaStateFile string
+	verboseLevel   int
+	controlSocket  string
+	flowTimeouts   timeoutsOpts
+
+	// config is loaded from configFile
+	config *fileConfig
+	// listeners of the config file unless overridden by the listen flag
+	listeners []*listenerConfig
+	// defaultForward is the config file forward name of listeners without upstreams
+	defaultForward string
+	// timeouts of flags and the config file
+	timeouts connect.Timeouts
 }
 
 func (o *serverCmdOpts) initCliFlags(cmd *cobra.Command) {
-	cmd.Flags().StringVarP(&o.listenAddr, "listen", "l", ":1080", "SOCKS5 server address")
+	cmd.Flags().StringArrayVarP(&o.listenAddrs, "listen", "l", []string{":1080"},
+		"proxy server listen address: [tcp://]host:port, unix:///path[?mode=&uid=&gid=] or tls://host:port?cert=&key=[&client-ca=], "+
+			"optionally bound to its own proxies file with the file parameter")
+	listenFlag := cmd.Flags().Lookup("listen")
+	listenFlag.Value = &renamedTypeFlagValue{Value: listenFlag.Value, name: "url"}
 	cmd.Flags().StringVarP(&o.proxyFile, "file", "f", "proxies.txt", "SOCKS5 proxies file")
+	cmd.Flags().DurationVar(&o.gracePeriod, "grace-period", 30*time.Second,
+		"max amount of time to wait for active connections to finish on shutdown before force closing them")
+	cmd.Flags().StringVar(&o.usersFile, "users", "",
+		"enable authentication with users file, one 'username:password [rate=SIZE] [conn-rate=SIZE] [daily=SIZE] [monthly=SIZE]' per line")
+	cmd.Flags().StringVar(&o.quotaStateFile, "quota-state", "", "file to persist daily/monthly data usage of users")
+	cmd.Flags().StringVar(&o.configFile, "config", "", "load upstreams, listeners, timeouts and logging from the YAML file, flags take precedence")
+	configFlag := cmd.Flags().Lookup("config")
+	configFlag.Value = &renamedTypeFlagValue{Value: configFlag.Value, name: "path"}
+	cmd.Flags().StringVar(&o.controlSocket, "control", "", "serve the control API on the unix socket, see wirez ctl")
+	controlFlag := cmd.Flags().Lookup("control")
+	controlFlag.Value = &renamedTypeFlagValue{Value: controlFlag.Value, name: "path"}
+	o.flowTimeouts.initCliFlags(cmd)
+	cmd.Flags().CountVarP(&o.verboseLevel, "verbose", "v", "log verbose level")
+	verboseFlag := cmd.Flags().Lookup("verbose")
+	verboseFlag.Value = &renamedTypeFlagValue{Value: verboseFlag.Value}
+}
+
+// loadConfigFile loads the config file, values of flags set on the command line take precedence.
+func (o *serverCmdOpts) loadConfigFile(flags *pflag.FlagSet) (err error) {
+	if o.configFile == "" {
+		o.timeouts, err = o.flowTimeouts.timeouts(flags, nil)
+		return
+	}
+	if o.config, err = loadConfigFile(o.configFile); err != nil {
+		return
+	}
+	if o.timeouts, err = o.flowTimeouts.timeouts(flags, o.config); err != nil {
+		return
+	}
+	serverConfig := &o.config.Server
+	if !flags.Changed("listen") && len(serverConfig.Listen) > 0 {
+		o.listeners = make([]*listenerConfig, 0, len(serverConfig.Listen))
+		for _, listener := range serverConfig.Listen {
+			// the url is validated on load
+			cfg, _ := parseListenURL(listener.URL)
+			cfg.Forward = listener.Forward
+			o.listeners = append(o.listeners, cfg)
+		}
+	}
+	if !flags.Changed("file") {
+		o.defaultForward = serverConfig.Forward
+	}
+	if !flags.Changed("users") && serverConfig.Users != "" {
+		o.usersFile = serverConfig.Users
+	}
+	if !flags.Changed("quota-state") && serverConfig.QuotaState != "" {
+		o.quotaStateFile = serverConfig.QuotaState
+	}
+	if !flags.Changed("grace-period") && serverConfig.GracePeriod > 0 {
+		o.gracePeriod = serverConfig.GracePeriod
+	}
+	return nil
+}
+
+// upstreamsKey identifies upstreams of the listener by the config file forward name or the proxies file.
+type upstreamsKey struct {
+	forward   string
+	proxyFile string
+}
+
+// String returns the forward name or the proxies file path.
+func (k upstreamsKey) String() string {
+	if k.forward != "" {
+		return k.forward
+	}
+	return k.proxyFile
+}
+
+func (o *serverCmdOpts) upstreams(listener *listenerConfig) upstreamsKey {
+	switch {
+	case listener.Forward != "":
+		return upstreamsKey{forward: listener.Forward}
+	case listener.ProxyFile != "":
+		return upstreamsKey{proxyFile: listener.ProxyFile}
+	case o.defaultForward != "":
+		return upstreamsKey{forward: o.defaultForward}
+	}
+	return upstreamsKey{proxyFile: o.proxyFile}
 }
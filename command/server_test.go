@@ -0,0 +1,44 @@
+package command
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5/server"
+	"github.com/stretchr/testify/require"
+)
+
+// failingListener fails to accept connections with a permanent error.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestServeAllClosesServersOnError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	failingLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	acceptErr := errors.New("accept failed")
+	servers := []*proxyServer{
+		{Server: &server.Server{Listener: ln}},
+		{Server: &server.Server{Listener: &failingListener{Listener: failingLn, err: acceptErr}}},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serveAll(servers)
+	}()
+	select {
+	case err = <-done:
+		require.ErrorIs(t, err, acceptErr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers are not closed")
+	}
+}
@@ -11,6 +11,8 @@ require (
 	github.com/vishvananda/netlink v1.1.0
 	go.uber.org/multierr v1.7.0
 	golang.org/x/sys v0.0.0-20220622161953-175b2fd9d664
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	gopkg.in/yaml.v3 v3.0.1
 	gvisor.dev/gvisor v0.0.0-20220816193615-632fd54acfb3
 )
 
@@ -23,6 +25,4 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20211101163701-50045581ed74 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
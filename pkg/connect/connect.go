@@ -1,13 +1,13 @@
 package connect
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,8 +28,32 @@ const (
 	udpIOTimeout = 15 * time.Second
 	// connectTimeout is the default timeout for TCP/UDP dial connect
 	connectTimeout = 3 * time.Second
+	// tcpKeepAlive is the default period of TCP keepalive probes
+	tcpKeepAlive = 30 * time.Second
 )
 
+// Timeouts configures limits of relayed flows. Idle timeouts limit each i/o operation,
+// lifetimes limit the whole flow since it is relayed. Zero idle timeouts, lifetimes
+// and keepalive period disable them.
+type Timeouts struct {
+	Connect      time.Duration
+	TCPIdle      time.Duration
+	UDPIdle      time.Duration
+	TCPLifetime  time.Duration
+	UDPLifetime  time.Duration
+	TCPKeepAlive time.Duration
+}
+
+// DefaultTimeouts returns default limits, flows have no lifetime limits by default.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:      connectTimeout,
+		TCPIdle:      tcpIOTimeout,
+		UDPIdle:      udpIOTimeout,
+		TCPKeepAlive: tcpKeepAlive,
+	}
+}
+
 // Connector is responsible for connecting to the destination address.
 type Connector interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
@@ -39,6 +63,25 @@ func NewDirectConnector() Connector {
 	return &net.Dialer{}
 }
 
+// NewKeepAliveDirectConnector returns the direct connector that sends TCP keepalive
+// probes with the period, zero disables keepalive.
+func NewKeepAliveDirectConnector(keepAlive time.Duration) Connector {
+	if keepAlive <= 0 {
+		keepAlive = -1
+	}
+	return &net.Dialer{KeepAlive: keepAlive}
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return r.Start <= port && port <= r.End
+}
+
 type SocksAddr struct {
 	Address string
 	Auth    *url.Userinfo
@@ -70,10 +113,22 @@ func (c *socks5Connector) DialContext(ctx context.Context, network, address stri
 	if err != nil {
 		return
 	}
+	// let the proxy resolve the sniffed hostname instead of the destination IP
+	if hostname := destinationHostname(ctx); hostname != "" {
+		dstAddr.Type = gosocks5.AddrDomain
+		dstAddr.Host = hostname
+	}
 
-	if conn, err = c.tcpConnector.DialContext(ctx, "tcp", c.socksAddress); err != nil {
+	// the hostname belongs to the destination, not to the next proxy in the chain
+	if conn, err = c.tcpConnector.DialContext(withDestinationHostname(ctx, ""), "tcp", c.socksAddress); err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			err = multierr.Append(err, conn.Close())
+			conn = nil
+		}
+	}()
 	if err = conn.SetDeadline(time.Now().Add(connectTimeout)); err != nil {
 		return
 	}
@@ -85,7 +140,7 @@ func (c *socks5Connector) DialContext(ctx context.Context, network, address stri
 	if err = cc.Handleshake(); err != nil {
 		return
 	}
-	conn = cc
+	conn = newSOCKSConn(cc, conn)
 
 	req := gosocks5.NewRequest(gosocks5.CmdConnect, dstAddr)
 	if err = req.Write(conn); err != nil {
@@ -96,11 +151,36 @@ func (c *socks5Connector) DialContext(ctx context.Context, network, address stri
 		return
 	}
 	if reply.Rep != gosocks5.Succeeded {
-		return conn, fmt.Errorf("destination address [%s] is unavailable", dstAddr)
+		err = &SOCKSReplyError{Address: dstAddr.String(), Reply: reply.Rep}
 	}
 	return
 }
 
+// SOCKSReplyError is returned when the SOCKS5 proxy fails the request to the destination address.
+type SOCKSReplyError struct {
+	Address string
+	// the reply field of the SOCKS5 reply, e.g. gosocks5.HostUnreachable
+	Reply uint8
+}
+
+func (e *SOCKSReplyError) Error() string {
+	return fmt.Sprintf("destination address [%s] is unavailable: reply code %d", e.Address, e.Reply)
+}
+
+// socksConn is the SOCKS5 connection that relays data over the raw connection after the handshake.
+type socksConn struct {
+	*gosocks5.Conn
+	rawConn net.Conn
+}
+
+func newSOCKSConn(conn *gosocks5.Conn, rawConn net.Conn) *socksConn {
+	return &socksConn{Conn: conn, rawConn: rawConn}
+}
+
+func (c *socksConn) CloseWrite() error {
+	return closeWrite(c.rawConn)
+}
+
 func NewSOCKS5UDPConnector(log *zerolog.Logger, tcpConnector Connector, udpConnector Connector, socksAddr *SocksAddr) Connector {
 	selector := client.DefaultSelector
 	if socksAddr.Auth != nil {
@@ -112,31 +192,63 @@ func NewSOCKS5UDPConnector(log *zerolog.Logger, tcpConnector Connector, udpConne
 		udpConnector: udpConnector,
 		selector:     selector,
 		socksAddress: socksAddr.Address,
+		idleTimeout:  udpAssociationIdleTimeout,
+		dialSem:      make(chan struct{}, 1),
 	}
 }
 
+// socks5UDPConnector relays UDP flows to destinations over shared SOCKS5 UDP associations.
 type socks5UDPConnector struct {
 	log          *zerolog.Logger
 	tcpConnector Connector
 	udpConnector Connector
 	selector     gosocks5.Selector
 	socksAddress string
+	// idleTimeout is the time an association without flows is kept open
+	idleTimeout time.Duration
+	// dialSem serializes UDP ASSOCIATE requests
+	dialSem      chan struct{}
+	mu           sync.Mutex
+	associations []*socksUDPAssociation
 }
 
 func (c *socks5UDPConnector) DialContext(ctx context.Context, network, address string) (_ net.Conn, err error) {
 	if network != "udp" {
 		return nil, fmt.Errorf("network %s is not supported", network)
 	}
-	dstAddr, err := gosocks5.NewAddr(address)
+	dstUDPAddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return
 	}
-	dstUDPAddr, err := net.ResolveUDPAddr("udp", address)
+	if !dstUDPAddr.IP.IsUnspecified() {
+		return c.dialAssociated(ctx, address, dstUDPAddr)
+	}
+
+	// datagrams to any destination are relayed as is over the own association
+	uc, socksConn, err := c.associate(ctx, address)
+	if err != nil {
+		return
+	}
+	//nolint:errcheck
+	go func() {
+		io.Copy(io.Discard, socksConn)
+		socksConn.Close()
+		// A UDP association terminates when the TCP connection that the UDP
+		// ASSOCIATE request arrived on terminates. RFC1928
+		uc.Close()
+	}()
+	return newSocksRawUDPConn(uc, socksConn), nil
+}
+
+// associate requests the new UDP association and returns the connection to the UDP relay
+// of the proxy along with the TCP control connection.
+func (c *socks5UDPConnector) associate(ctx context.Context, address string) (uc, socksConn net.Conn, err error) {
+	dstAddr, err := gosocks5.NewAddr(address)
 	if err != nil {
 		return
 	}
 
-	socksConn, err := c.tcpConnector.DialContext(ctx, "tcp", c.socksAddress)
+	socksConn, err = c.tcpConnector.DialContext(ctx, "tcp", c.socksAddress)
 	if err != nil {
 		return
 	}
@@ -168,29 +280,17 @@ func (c *socks5UDPConnector) DialContext(ctx context.Context, network, address s
 		return
 	}
 	if reply.Rep != gosocks5.Succeeded {
-		return nil, errors.New("service unavailable")
+		err = &SOCKSReplyError{Address: address, Reply: reply.Rep}
+		return
 	}
 	replyAddr := reply.Addr.String()
 	c.log.Debug().Str("dstAddr", address).Str("replyAddr", replyAddr).Msg("udp cmd reply success")
 
-	uc, err := c.udpConnector.DialContext(ctx, "udp", replyAddr)
-	if err != nil {
+	if uc, err = c.udpConnector.DialContext(ctx, "udp", replyAddr); err != nil {
 		return
 	}
 	c.log.Debug().Str("local udp addr", uc.LocalAddr().String())
-	//nolint:errcheck
-	go func() {
-		io.Copy(io.Discard, socksConn)
-		socksConn.Close()
-		// A UDP association terminates when the TCP connection that the UDP
-		// ASSOCIATE request arrived on terminates. RFC1928
-		uc.Close()
-	}()
-
-	if dstUDPAddr.IP.IsUnspecified() {
-		return newSocksRawUDPConn(uc, socksConn), nil
-	}
-	return newSocksUDPConn(uc, socksConn, dstUDPAddr), nil
+	return
 }
 
 func newSocksRawUDPConn(udpConn net.Conn, tcpConn net.Conn) *socksRawUDPConn {
@@ -215,70 +315,6 @@ func (c *socksRawUDPConn) Close() error {
 	return multierr.Append(err, c.tcpConn.Close())
 }
 
-func newSocksUDPConn(udpConn net.Conn, tcpConn net.Conn, dstAddr *net.UDPAddr) *socksUDPConn {
-	return &socksUDPConn{Conn: udpConn, tcpConn: tcpConn, dstAddr: dstAddr}
-}
-
-type socksUDPConn struct {
-	net.Conn
-	tcpConn net.Conn
-	dstAddr *net.UDPAddr
-}
-
-var _ net.PacketConn = (*socksUDPConn)(nil)
-var _ net.Conn = (*socksUDPConn)(nil)
-
-func (c *socksUDPConn) Read(b []byte) (n int, err error) {
-	n, _, err = c.ReadFrom(b)
-	return
-}
-
-func (c *socksUDPConn) Write(b []byte) (n int, err error) {
-	n, err = c.WriteTo(b, c.dstAddr)
-	return n, err
-}
-
-func (c *socksUDPConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
-	toAddr, err := gosocks5.NewAddr(addr.String())
-	if err != nil {
-		return
-	}
-	// TODO buffer pool
-	buf := &bytes.Buffer{}
-	h := &gosocks5.UDPHeader{Addr: toAddr}
-	if err = h.Write(buf); err != nil {
-		return
-	}
-	if _, err = buf.Write(b); err != nil {
-		return
-	}
-	_, err = c.Conn.Write(buf.Bytes())
-	return len(b), err
-}
-
-func (c *socksUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	n, err := c.Conn.Read(b)
-	if err != nil {
-		return 0, nil, err
-	}
-	buf := bytes.NewBuffer(b[:n])
-	packet, err := gosocks5.ReadUDPDatagram(buf)
-	if err != nil {
-		return 0, nil, err
-	}
-	copy(b, packet.Data)
-	fromAddr, err := net.ResolveUDPAddr("udp", packet.Header.Addr.String())
-	if err != nil {
-		return 0, nil, err
-	}
-	return len(packet.Data), fromAddr, nil
-}
-
-func (c *socksUDPConn) Close() error {
-	err := c.Conn.Close()
-	return multierr.Append(err, c.tcpConn.Close())
-}
-
 // TODO performance metrics
 // TODO add/remove dynamic connectors
 
@@ -320,8 +356,19 @@ func (c *localForwardingConnector) DialContext(ctx context.Context, network, add
 type AddressMapper interface {
 	MapAddress(network, address string) (mappedAddress string, exists bool)
 	AddAddressMapping(network, fromAddress, toAddress string) error
+	RemoveAddressMapping(network, fromAddress string) error
+	AddressMappings() []AddressMapping
+}
+
+// AddressMapping maps the address or the port of any address to the target address.
+type AddressMapping struct {
+	Network     string `json:"network"`
+	FromAddress string `json:"from"`
+	ToAddress   string `json:"to"`
 }
 
+var ErrMappingNotFound = errors.New("address mapping not found")
+
 type addressMapper struct {
 	mu  sync.RWMutex
 	nat map[string]map[string]string
@@ -345,24 +392,66 @@ func (m *addressMapper) MapAddress(network, address string) (mappedAddress strin
 }
 
 func (m *addressMapper) AddAddressMapping(network, fromAddress, toAddress string) error {
+	fromAddress, err := mappingKey(fromAddress)
+	if err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if _, ok := m.nat[network]; !ok {
 		m.nat[network] = make(map[string]string)
 	}
+	m.nat[network][fromAddress] = toAddress
+	return nil
+}
+
+func (m *addressMapper) RemoveAddressMapping(network, fromAddress string) error {
+	fromAddress, err := mappingKey(fromAddress)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nat[network][fromAddress]; !ok {
+		return ErrMappingNotFound
+	}
+	delete(m.nat[network], fromAddress)
+	return nil
+}
+
+// AddressMappings returns all mappings ordered by network and source address.
+func (m *addressMapper) AddressMappings() []AddressMapping {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var result []AddressMapping
+	for network, nat := range m.nat {
+		for fromAddress, toAddress := range nat {
+			result = append(result, AddressMapping{Network: network, FromAddress: fromAddress, ToAddress: toAddress})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Network != result[j].Network {
+			return result[i].Network < result[j].Network
+		}
+		return result[i].FromAddress < result[j].FromAddress
+	})
+	return result
+}
+
+// mappingKey returns the port if the source address matches any host.
+func mappingKey(fromAddress string) (string, error) {
 	if !strings.Contains(fromAddress, ":") {
 		fromAddress = ":" + fromAddress
 	}
 	host, port, err := net.SplitHostPort(fromAddress)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
-		return err
+		return "", err
 	}
 	if host == "" || host == "0.0.0.0" {
-		fromAddress = port
+		return port, nil
 	}
-	m.nat[network][fromAddress] = toAddress
-	return nil
+	return fromAddress, nil
 }
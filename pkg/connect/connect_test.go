@@ -1,8 +1,14 @@
 package connect
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
 	"testing"
 
+	"github.com/ginuerzh/gosocks5"
+	"github.com/ginuerzh/gosocks5/server"
 	"github.com/stretchr/testify/require"
 )
 
@@ -125,5 +131,114 @@ func TestAddressMapper(t *testing.T) {
 		require.True(t, ok)
 		require.Equal(t, "127.0.0.1:5353", mappedAddress)
 	})
+	t.Run("RemoveMapping", func(t *testing.T) {
+		m := NewAddressMapper()
+		require.NoError(t, m.AddAddressMapping("udp", "53", "127.0.0.1:5353"))
+		require.NoError(t, m.AddAddressMapping("tcp", "1.1.1.1:53", "127.0.0.1:5353"))
+
+		require.NoError(t, m.RemoveAddressMapping("udp", "0.0.0.0:53"))
+		_, ok := m.MapAddress("udp", "1.1.1.1:53")
+		require.False(t, ok)
+		require.ErrorIs(t, m.RemoveAddressMapping("udp", "53"), ErrMappingNotFound)
+		require.ErrorIs(t, m.RemoveAddressMapping("tcp", "2.2.2.2:53"), ErrMappingNotFound)
+		require.Equal(t, []AddressMapping{
+			{Network: "tcp", FromAddress: "1.1.1.1:53", ToAddress: "127.0.0.1:5353"},
+		}, m.AddressMappings())
+	})
+	t.Run("ListMappings", func(t *testing.T) {
+		m := NewAddressMapper()
+		require.NoError(t, m.AddAddressMapping("udp", ":53", "127.0.0.1:5353"))
+		require.NoError(t, m.AddAddressMapping("tcp", "8.8.8.8:53", "127.0.0.1:5353"))
+		require.NoError(t, m.AddAddressMapping("tcp", "1.1.1.1:53", "127.0.0.1:5353"))
+
+		require.Equal(t, []AddressMapping{
+			{Network: "tcp", FromAddress: "1.1.1.1:53", ToAddress: "127.0.0.1:5353"},
+			{Network: "tcp", FromAddress: "8.8.8.8:53", ToAddress: "127.0.0.1:5353"},
+			{Network: "udp", FromAddress: "53", ToAddress: "127.0.0.1:5353"},
+		}, m.AddressMappings())
+	})
+}
+
+func TestSOCKS5ConnectorIPv6Address(t *testing.T) {
+	proxyConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	connector := NewSOCKS5Connector(&staticConnector{conn: proxyConn}, &SocksAddr{Address: "proxy:1080"})
+	go connector.DialContext(context.Background(), "tcp", "[2001:db8::1]:443") //nolint:errcheck
+
+	ss := gosocks5.ServerConn(serverConn, server.DefaultSelector)
+	require.NoError(t, ss.Handleshake())
+	req, err := gosocks5.ReadRequest(ss)
+	require.NoError(t, err)
+	require.Equal(t, uint8(gosocks5.AddrIPv6), req.Addr.Type)
+	require.Equal(t, "2001:db8::1", req.Addr.Host)
+	require.Equal(t, uint16(443), req.Addr.Port)
+}
+
+func TestSOCKS5ConnectorHalfClose(t *testing.T) {
+	proxyConn, serverConn := newTCPConnPair(t)
+	connector := NewSOCKS5Connector(&staticConnector{conn: proxyConn}, &SocksAddr{Address: "proxy:1080"})
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := connector.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+		dialed <- dialResult{conn, err}
+	}()
+
+	ss := gosocks5.ServerConn(serverConn, server.DefaultSelector)
+	require.NoError(t, ss.Handleshake())
+	_, err := gosocks5.ReadRequest(ss)
+	require.NoError(t, err)
+	require.NoError(t, gosocks5.NewReply(gosocks5.Succeeded, nil).Write(ss))
+	result := <-dialed
+	require.NoError(t, result.err)
+
+	// the write side of the proxy connection is shut down, the read side is still open
+	require.NoError(t, result.conn.(closeWriter).CloseWrite())
+	data, err := io.ReadAll(ss)
+	require.NoError(t, err)
+	require.Empty(t, data)
+	_, err = ss.Write([]byte("pong"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(result.conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+}
+
+func TestSOCKS5ConnectorRejected(t *testing.T) {
+	proxyConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	connector := NewSOCKS5Connector(&staticConnector{conn: proxyConn}, &SocksAddr{Address: "proxy:1080"})
+	go func() {
+		ss := gosocks5.ServerConn(serverConn, server.DefaultSelector)
+		if err := ss.Handleshake(); err != nil {
+			return
+		}
+		if _, err := gosocks5.ReadRequest(ss); err != nil {
+			return
+		}
+		//nolint:errcheck
+		gosocks5.NewReply(gosocks5.ConnRefused, nil).Write(ss)
+	}()
+
+	conn, err := connector.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.Nil(t, conn)
+	var replyErr *SOCKSReplyError
+	require.True(t, errors.As(err, &replyErr))
+	require.Equal(t, uint8(gosocks5.ConnRefused), replyErr.Reply)
+	// the connection to the proxy is closed
+	_, err = proxyConn.Write([]byte{1})
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+// staticConnector always returns the same connection
+type staticConnector struct {
+	conn net.Conn
+}
 
+func (c *staticConnector) DialContext(context.Context, string, string) (net.Conn, error) {
+	return c.conn, nil
 }
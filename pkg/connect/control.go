@@ -0,0 +1,237 @@
+package connect
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// ControlConfig holds the runtime state exposed by the control API,
+// nil fields disable corresponding endpoints.
+type ControlConfig struct {
+	Flows     *FlowTable
+	Upstreams []*UpstreamMonitor
+	Forward   *ForwardSwitch
+	Mappings  AddressMapper
+}
+
+// ForwardState is the active forward route and all available routes.
+type ForwardState struct {
+	Active    string   `json:"active"`
+	Available []string `json:"available"`
+}
+
+// LogLevel is the global log level.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// NewControlHandler returns the JSON/HTTP control API:
+//
+//	GET    /flows            list active flows
+//	DELETE /flows/{id}       close the flow
+//	GET    /upstreams        show upstream health
+//	GET    /forward          show the active forward route
+//	PUT    /forward          switch the active forward route {"name": "tor"}
+//	GET    /mappings         list address mappings
+//	POST   /mappings         add the address mapping {"network": "udp", "from": "53", "to": "1.1.1.1:53"}
+//	DELETE /mappings         remove the address mapping ?network=udp&from=53
+//	GET    /log-level        show the log level
+//	PUT    /log-level        change the log level {"level": "debug"}
+func NewControlHandler(log *zerolog.Logger, cfg ControlConfig) http.Handler {
+	h := &controlHandler{log: log, cfg: cfg}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flows", h.handleFlows)
+	mux.HandleFunc("/flows/", h.handleFlow)
+	mux.HandleFunc("/upstreams", h.handleUpstreams)
+	mux.HandleFunc("/forward", h.handleForward)
+	mux.HandleFunc("/mappings", h.handleMappings)
+	mux.HandleFunc("/log-level", h.handleLogLevel)
+	return mux
+}
+
+type controlHandler struct {
+	log *zerolog.Logger
+	cfg ControlConfig
+}
+
+func (h *controlHandler) handleFlows(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Flows == nil {
+		writeControlError(w, http.StatusNotFound, errors.New("flows are not tracked"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeControlJSON(w, h.cfg.Flows.List())
+}
+
+func (h *controlHandler) handleFlow(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Flows == nil {
+		writeControlError(w, http.StatusNotFound, errors.New("flows are not tracked"))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/flows/"), 10, 64)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, errors.New("invalid flow id"))
+		return
+	}
+	if err = h.cfg.Flows.Close(id); errors.Is(err, ErrFlowNotFound) {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		h.log.Debug().Err(err).Uint64("id", id).Msg("close flow error")
+	}
+	h.log.Info().Uint64("id", id).Msg("flow closed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *controlHandler) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	result := make([]UpstreamHealth, 0, len(h.cfg.Upstreams))
+	for _, upstream := range h.cfg.Upstreams {
+		result = append(result, upstream.Health())
+	}
+	writeControlJSON(w, result)
+}
+
+func (h *controlHandler) handleForward(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Forward == nil {
+		writeControlError(w, http.StatusNotFound, errors.New("no forward routes"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !readControlJSON(w, r, &req) {
+			return
+		}
+		if err := h.cfg.Forward.Switch(req.Name); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		h.log.Info().Str("forward", req.Name).Msg("forward switched")
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+		return
+	}
+	writeControlJSON(w, ForwardState{Active: h.cfg.Forward.Active(), Available: h.cfg.Forward.Names()})
+}
+
+func (h *controlHandler) handleMappings(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.Mappings == nil {
+		writeControlError(w, http.StatusNotFound, errors.New("address mappings are not supported"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var mapping AddressMapping
+		if !readControlJSON(w, r, &mapping) {
+			return
+		}
+		if err := checkMappingNetwork(mapping.Network); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := h.cfg.Mappings.AddAddressMapping(mapping.Network, mapping.FromAddress, mapping.ToAddress); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		h.log.Info().Str("network", mapping.Network).Str("from", mapping.FromAddress).
+			Str("to", mapping.ToAddress).Msg("address mapping added")
+	case http.MethodDelete:
+		query := r.URL.Query()
+		network, fromAddress := query.Get("network"), query.Get("from")
+		if err := checkMappingNetwork(network); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := h.cfg.Mappings.RemoveAddressMapping(network, fromAddress); errors.Is(err, ErrMappingNotFound) {
+			writeControlError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		h.log.Info().Str("network", network).Str("from", fromAddress).Msg("address mapping removed")
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+		return
+	}
+	writeControlJSON(w, h.cfg.Mappings.AddressMappings())
+}
+
+func checkMappingNetwork(network string) error {
+	if network != "tcp" && network != "udp" {
+		return errors.New("invalid network, expected tcp or udp")
+	}
+	return nil
+}
+
+func (h *controlHandler) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req LogLevel
+		if !readControlJSON(w, r, &req) {
+			return
+		}
+		level, err := zerolog.ParseLevel(req.Level)
+		if err != nil || req.Level == "" {
+			writeControlError(w, http.StatusBadRequest, errors.New("invalid log level"))
+			return
+		}
+		zerolog.SetGlobalLevel(level)
+		h.log.Info().Str("level", level.String()).Msg("log level changed")
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+		return
+	}
+	writeControlJSON(w, LogLevel{Level: zerolog.GlobalLevel().String()})
+}
+
+func readControlJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func writeControlJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(controlError{Error: err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeControlError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
@@ -0,0 +1,123 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func doControlRequest(t *testing.T, handler http.Handler, method, target, body string, result interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if result != nil && rec.Code < http.StatusBadRequest {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), result))
+	}
+	return rec.Code
+}
+
+func TestControlHandlerFlows(t *testing.T) {
+	log := zerolog.Nop()
+	flows := NewFlowTable()
+	handler := NewControlHandler(&log, ControlConfig{Flows: flows})
+	localConn, remoteConn := net.Pipe()
+	defer flows.Add(Flow{Network: "tcp", Source: "10.1.1.1:1234", Destination: "1.1.1.1:443", User: "alice"},
+		localConn, remoteConn)()
+
+	var list []Flow
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodGet, "/flows", "", &list))
+	require.Len(t, list, 1)
+	require.Equal(t, "alice", list[0].User)
+	require.Equal(t, "1.1.1.1:443", list[0].Destination)
+
+	require.Equal(t, http.StatusNoContent, doControlRequest(t, handler, http.MethodDelete, "/flows/1", "", nil))
+	_, err := localConn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+
+	require.Equal(t, http.StatusNotFound, doControlRequest(t, handler, http.MethodDelete, "/flows/2", "", nil))
+	require.Equal(t, http.StatusBadRequest, doControlRequest(t, handler, http.MethodDelete, "/flows/abc", "", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, doControlRequest(t, handler, http.MethodPost, "/flows", "", nil))
+}
+
+func TestControlHandlerUpstreamsAndForward(t *testing.T) {
+	log := zerolog.Nop()
+	monitor := NewUpstreamMonitor("127.0.0.1:1080")
+	forward := NewForwardSwitch()
+	forward.Add("tor", monitor.Connector(&failingConnector{err: errors.New("refused")}), &failingConnector{})
+	forward.Add("eu", &failingConnector{}, &failingConnector{})
+	handler := NewControlHandler(&log, ControlConfig{Upstreams: []*UpstreamMonitor{monitor}, Forward: forward})
+
+	_, err := forward.TCPConnector().DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.Error(t, err)
+	var upstreams []UpstreamHealth
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodGet, "/upstreams", "", &upstreams))
+	require.Len(t, upstreams, 1)
+	require.False(t, upstreams[0].Healthy)
+	require.Equal(t, "refused", upstreams[0].LastError)
+
+	var state ForwardState
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodGet, "/forward", "", &state))
+	require.Equal(t, ForwardState{Active: "tor", Available: []string{"eu", "tor"}}, state)
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodPut, "/forward", `{"name":"eu"}`, &state))
+	require.Equal(t, "eu", state.Active)
+	require.Equal(t, "eu", forward.Active())
+	require.Equal(t, http.StatusBadRequest, doControlRequest(t, handler, http.MethodPut, "/forward", `{"name":"us"}`, nil))
+	require.Equal(t, http.StatusBadRequest, doControlRequest(t, handler, http.MethodPut, "/forward", `{"forward":"eu"}`, nil))
+}
+
+func TestControlHandlerMappings(t *testing.T) {
+	log := zerolog.Nop()
+	nat := NewAddressMapper()
+	handler := NewControlHandler(&log, ControlConfig{Mappings: nat})
+
+	var mappings []AddressMapping
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodPost, "/mappings",
+		`{"network":"udp","from":":53","to":"127.0.0.1:5353"}`, &mappings))
+	require.Equal(t, []AddressMapping{{Network: "udp", FromAddress: "53", ToAddress: "127.0.0.1:5353"}}, mappings)
+	mappedAddress, ok := nat.MapAddress("udp", "1.1.1.1:53")
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:5353", mappedAddress)
+
+	require.Equal(t, http.StatusBadRequest, doControlRequest(t, handler, http.MethodPost, "/mappings",
+		`{"network":"icmp","from":":53","to":"127.0.0.1:5353"}`, nil))
+	require.Equal(t, http.StatusBadRequest, doControlRequest(t, handler, http.MethodPost, "/mappings",
+		`{"network":"udp","from":"abc","to":"127.0.0.1:5353"}`, nil))
+
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodDelete, "/mappings?network=udp&from=53", "", &mappings))
+	require.Empty(t, mappings)
+	_, ok = nat.MapAddress("udp", "1.1.1.1:53")
+	require.False(t, ok)
+	require.Equal(t, http.StatusNotFound, doControlRequest(t, handler, http.MethodDelete, "/mappings?network=udp&from=53", "", nil))
+}
+
+func TestControlHandlerLogLevel(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	log := zerolog.Nop()
+	handler := NewControlHandler(&log, ControlConfig{})
+
+	var level LogLevel
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodPut, "/log-level", `{"level":"debug"}`, &level))
+	require.Equal(t, "debug", level.Level)
+	require.Equal(t, zerolog.DebugLevel, zerolog.GlobalLevel())
+	require.Equal(t, http.StatusOK, doControlRequest(t, handler, http.MethodGet, "/log-level", "", &level))
+	require.Equal(t, "debug", level.Level)
+	require.Equal(t, http.StatusBadRequest, doControlRequest(t, handler, http.MethodPut, "/log-level", `{"level":"loud"}`, nil))
+}
+
+func TestControlHandlerDisabledEndpoints(t *testing.T) {
+	log := zerolog.Nop()
+	handler := NewControlHandler(&log, ControlConfig{})
+	for _, target := range []string{"/flows", "/forward", "/mappings"} {
+		require.Equal(t, http.StatusNotFound, doControlRequest(t, handler, http.MethodGet, target, "", nil), target)
+	}
+}
@@ -0,0 +1,104 @@
+package connect
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// dnsMaxMessageSize is the maximum size of a DNS message over TCP
+const dnsMaxMessageSize = 1<<16 - 1
+
+// dnsForwarder answers DNS queries received over UDP by forwarding them over TCP
+// to the upstream resolver, so that DNS works with proxies that don't support UDP.
+type dnsForwarder struct {
+	connector      Connector
+	upstream       string
+	ioTimeout      time.Duration
+	connectTimeout time.Duration
+}
+
+func newDNSForwarder(connector Connector, upstream string, ioTimeout, connectTimeout time.Duration) *dnsForwarder {
+	return &dnsForwarder{
+		connector:      connector,
+		upstream:       upstream,
+		ioTimeout:      ioTimeout,
+		connectTimeout: connectTimeout,
+	}
+}
+
+// serve forwards queries of the UDP flow until it is idle for the i/o timeout,
+// all queries of the flow share the same upstream TCP connection.
+func (f *dnsForwarder) serve(localConn net.Conn) (err error) {
+	var upstreamConn net.Conn
+	defer func() {
+		if upstreamConn != nil {
+			err = multierr.Append(err, upstreamConn.Close())
+		}
+	}()
+	query := make([]byte, dnsMaxMessageSize)
+	for {
+		if err = localConn.SetReadDeadline(ioDeadline(f.ioTimeout)); err != nil {
+			return
+		}
+		n, err := localConn.Read(query)
+		if err != nil {
+			var terr timeoutError
+			if errors.As(err, &terr) && terr.Timeout() {
+				return nil
+			}
+			return err
+		}
+		// retry once with a new connection, the upstream may close idle connections
+		var response []byte
+		for attempt := 0; attempt < 2; attempt++ {
+			if upstreamConn == nil {
+				if upstreamConn, err = f.dial(); err != nil {
+					return err
+				}
+			}
+			if response, err = f.exchange(upstreamConn, query[:n]); err == nil {
+				break
+			}
+			upstreamConn.Close()
+			upstreamConn = nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = localConn.Write(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *dnsForwarder) dial() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.connectTimeout)
+	defer cancel()
+	return f.connector.DialContext(ctx, "tcp", f.upstream)
+}
+
+// exchange sends the query with the two byte length prefix and reads the response, see RFC 7766.
+func (f *dnsForwarder) exchange(conn net.Conn, query []byte) (response []byte, err error) {
+	if err = conn.SetDeadline(ioDeadline(f.ioTimeout)); err != nil {
+		return
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err = conn.Write(msg); err != nil {
+		return
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	response = make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, response)
+	return
+}
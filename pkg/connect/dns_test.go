@@ -0,0 +1,49 @@
+package connect
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSForwarder(t *testing.T) {
+	connector := newPipeConnector()
+	f := newDNSForwarder(connector, "1.1.1.1:53", time.Second, time.Second)
+	localConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- f.serve(localConn)
+		localConn.Close()
+	}()
+
+	query := []byte{0x12, 0x34, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	go clientConn.Write(query) //nolint:errcheck
+	require.Equal(t, "1.1.1.1:53", <-connector.addresses)
+	upstreamConn := <-connector.conns
+
+	// the query is sent with the length prefix
+	msg := make([]byte, 2+len(query))
+	_, err := io.ReadFull(upstreamConn, msg)
+	require.NoError(t, err)
+	require.Equal(t, uint16(len(query)), binary.BigEndian.Uint16(msg))
+	require.Equal(t, query, msg[2:])
+
+	response := append([]byte{0x12, 0x34, 0x81, 0x80}, query[4:]...)
+	go func() {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(response)))
+		upstreamConn.Write(append(length[:], response...)) //nolint:errcheck
+	}()
+	buf := make([]byte, 512)
+	n, err := clientConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, response, buf[:n])
+
+	// the idle flow is closed without errors
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,94 @@
+package connect
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+var ErrFlowNotFound = errors.New("flow not found")
+
+// Flow is an active relayed flow.
+type Flow struct {
+	ID          uint64    `json:"id"`
+	Network     string    `json:"network"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	User        string    `json:"user,omitempty"`
+	Started     time.Time `json:"started"`
+}
+
+type flowEntry struct {
+	Flow
+	closers []io.Closer
+}
+
+// FlowTable keeps track of active flows so that they can be listed and closed at runtime.
+type FlowTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	flows  map[uint64]*flowEntry
+}
+
+func NewFlowTable() *FlowTable {
+	return &FlowTable{flows: make(map[uint64]*flowEntry)}
+}
+
+// Add registers the flow, closers are closed to terminate the flow. The returned
+// function removes the flow from the table when it ends.
+func (t *FlowTable) Add(flow Flow, closers ...io.Closer) (remove func()) {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	flow.ID = t.nextID
+	flow.Started = time.Now()
+	t.flows[flow.ID] = &flowEntry{Flow: flow, closers: closers}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.flows, flow.ID)
+	}
+}
+
+// List returns active flows ordered by their IDs.
+func (t *FlowTable) List() []Flow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]Flow, 0, len(t.flows))
+	for _, entry := range t.flows {
+		result = append(result, entry.Flow)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Close terminates the flow.
+func (t *FlowTable) Close(id uint64) (err error) {
+	t.mu.Lock()
+	entry, ok := t.flows[id]
+	t.mu.Unlock()
+	if !ok {
+		return ErrFlowNotFound
+	}
+	for _, closer := range entry.closers {
+		err = multierr.Append(err, closer.Close())
+	}
+	return
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,50 @@
+package connect
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowTable(t *testing.T) {
+	t.Run("AddAndRemove", func(t *testing.T) {
+		flows := NewFlowTable()
+		removeFirst := flows.Add(Flow{Network: "tcp", Source: "10.1.1.1:1234", Destination: "1.1.1.1:443"})
+		removeSecond := flows.Add(Flow{Network: "udp", Source: "10.1.1.1:4321", Destination: "1.1.1.1:53"})
+
+		list := flows.List()
+		require.Len(t, list, 2)
+		require.Equal(t, uint64(1), list[0].ID)
+		require.Equal(t, "1.1.1.1:443", list[0].Destination)
+		require.False(t, list[0].Started.IsZero())
+		require.Equal(t, uint64(2), list[1].ID)
+
+		removeFirst()
+		list = flows.List()
+		require.Len(t, list, 1)
+		require.Equal(t, uint64(2), list[0].ID)
+		removeSecond()
+		require.Empty(t, flows.List())
+	})
+	t.Run("Close", func(t *testing.T) {
+		flows := NewFlowTable()
+		localConn, remoteConn := net.Pipe()
+		defer flows.Add(Flow{Network: "tcp"}, localConn, remoteConn)()
+
+		require.NoError(t, flows.Close(1))
+		_, err := localConn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.ErrClosedPipe)
+		_, err = remoteConn.Write([]byte{1})
+		require.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+	t.Run("CloseUnknownFlow", func(t *testing.T) {
+		flows := NewFlowTable()
+		require.ErrorIs(t, flows.Close(1), ErrFlowNotFound)
+	})
+	t.Run("NilTable", func(t *testing.T) {
+		var flows *FlowTable
+		flows.Add(Flow{Network: "tcp"})()
+	})
+}
@@ -0,0 +1,434 @@
+//go:build linux
+
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/rs/zerolog"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// ICMPEchoMode defines how ICMP echo requests from the container are answered.
+type ICMPEchoMode int
+
+const (
+	// ICMPEchoDisabled drops all echo requests.
+	ICMPEchoDisabled ICMPEchoMode = iota
+	// ICMPEchoReply answers all echo requests immediately.
+	ICMPEchoReply
+	// ICMPEchoProbe answers echo requests only after a successful TCP connect
+	// to the target through the proxy, so the round-trip time approximates
+	// the connect time.
+	ICMPEchoProbe
+)
+
+// WithICMPEcho answers ICMP/ICMPv6 echo requests in the network stack itself,
+// probePort is the target TCP port used in the ICMPEchoProbe mode.
+func WithICMPEcho(mode ICMPEchoMode, probePort uint16) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.icmpEchoMode = mode
+		s.icmpProbePort = probePort
+	}
+}
+
+const (
+	// icmpMaxProbes is the max number of concurrent echo probes, echo requests to other targets are dropped
+	icmpMaxProbes = 64
+	// icmpMaxProbeReplies is the max number of echo replies waiting for the probe of the same target
+	icmpMaxProbeReplies = 16
+	// icmpProbeResultTTL is the time the probe result answers echo requests to the same target
+	icmpProbeResultTTL = 500 * time.Millisecond
+)
+
+// icmpEchoEndpoint is a link endpoint that answers echo requests sent by the container.
+type icmpEchoEndpoint struct {
+	nested.Endpoint
+	log            *zerolog.Logger
+	probeConn      Connector
+	probePort      uint16
+	connectTimeout time.Duration
+	probeSem       chan struct{}
+
+	mu sync.Mutex
+	// probes are running or recently completed probes of targets
+	probes map[tcpip.Address]*icmpProbe
+}
+
+// icmpProbe coalesces echo requests to the same target into one probe.
+type icmpProbe struct {
+	// replies wait for the running probe
+	replies []icmpReply
+	done    bool
+	ok      bool
+}
+
+type icmpReply struct {
+	protocol tcpip.NetworkProtocolNumber
+	packet   []byte
+}
+
+var _ stack.LinkEndpoint = (*icmpEchoEndpoint)(nil)
+var _ stack.NetworkDispatcher = (*icmpEchoEndpoint)(nil)
+
+// newICMPEchoEndpoint answers echo requests immediately if probeConn is nil.
+func newICMPEchoEndpoint(log *zerolog.Logger, lower stack.LinkEndpoint,
+	probeConn Connector, probePort uint16, connectTimeout time.Duration) stack.LinkEndpoint {
+	e := &icmpEchoEndpoint{
+		log:            log,
+		probeConn:      probeConn,
+		probePort:      probePort,
+		connectTimeout: connectTimeout,
+		probeSem:       make(chan struct{}, icmpMaxProbes),
+		probes:         make(map[tcpip.Address]*icmpProbe),
+	}
+	e.Endpoint.Init(lower, e)
+	return e
+}
+
+func (e *icmpEchoEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if !isICMPPacket(protocol, pkt) {
+		e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+		return
+	}
+	reply, target := newICMPEchoReply(protocol, pkt.Data().AsRange().ToSlice())
+	if reply == nil {
+		e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+		return
+	}
+	if e.probeConn == nil {
+		e.writeReply(protocol, reply)
+		return
+	}
+	e.probeAndReply(protocol, reply, target)
+}
+
+// probeAndReply answers the echo request after the probe of the target succeeds. Requests to the target
+// that is already probed wait for the same probe, its result answers further requests for a short time.
+func (e *icmpEchoEndpoint) probeAndReply(protocol tcpip.NetworkProtocolNumber, reply []byte, target tcpip.Address) {
+	e.mu.Lock()
+	if probe, ok := e.probes[target]; ok {
+		if !probe.done && len(probe.replies) < icmpMaxProbeReplies {
+			probe.replies = append(probe.replies, icmpReply{protocol: protocol, packet: reply})
+		}
+		reachable := probe.done && probe.ok
+		e.mu.Unlock()
+		if reachable {
+			e.writeReply(protocol, reply)
+		}
+		return
+	}
+	select {
+	case e.probeSem <- struct{}{}:
+	default:
+		e.mu.Unlock()
+		e.log.Debug().Str("handler", "icmp").Stringer("dstAddr", target).Msg("too many echo probes")
+		return
+	}
+	probe := &icmpProbe{replies: []icmpReply{{protocol: protocol, packet: reply}}}
+	e.probes[target] = probe
+	e.mu.Unlock()
+	go e.probe(target, probe)
+}
+
+func (e *icmpEchoEndpoint) probe(target tcpip.Address, probe *icmpProbe) {
+	address := net.JoinHostPort(target.String(), strconv.Itoa(int(e.probePort)))
+	ctx, cancel := context.WithTimeout(context.Background(), e.connectTimeout)
+	defer cancel()
+	conn, err := e.probeConn.DialContext(ctx, "tcp", address)
+	<-e.probeSem
+	if err != nil {
+		e.log.Debug().Str("handler", "icmp").Str("dstAddr", address).Err(err).Msg("echo probe failed")
+	} else {
+		conn.Close()
+	}
+
+	e.mu.Lock()
+	probe.done = true
+	probe.ok = err == nil
+	replies := probe.replies
+	probe.replies = nil
+	e.mu.Unlock()
+	time.AfterFunc(icmpProbeResultTTL, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.probes[target] == probe {
+			delete(e.probes, target)
+		}
+	})
+	if err == nil {
+		for _, reply := range replies {
+			e.writeReply(reply.protocol, reply.packet)
+		}
+	}
+}
+
+func (e *icmpEchoEndpoint) writeReply(protocol tcpip.NetworkProtocolNumber, reply []byte) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(reply)})
+	defer pkt.DecRef()
+	pkt.NetworkProtocolNumber = protocol
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+	if _, err := e.Endpoint.WritePackets(pkts); err != nil {
+		e.log.Error().Str("handler", "icmp").Stringer("error", err).Msg("")
+	}
+}
+
+// isICMPPacket checks the IP header without copying the whole packet.
+func isICMPPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) bool {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+		return ok && header.IPv4(h).Protocol() == uint8(header.ICMPv4ProtocolNumber)
+	case header.IPv6ProtocolNumber:
+		h, ok := pkt.Data().PullUp(header.IPv6MinimumSize)
+		return ok && header.IPv6(h).TransportProtocol() == header.ICMPv6ProtocolNumber
+	}
+	return false
+}
+
+// newICMPEchoReply returns the echo reply and the target address if the packet is an echo request.
+// Fragmented requests and IPv6 extension headers are not supported.
+func newICMPEchoReply(protocol tcpip.NetworkProtocolNumber, packet []byte) (reply []byte, target tcpip.Address) {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || ip.Protocol() != uint8(header.ICMPv4ProtocolNumber) ||
+			ip.More() || ip.FragmentOffset() != 0 {
+			return nil, ""
+		}
+		headerLen := int(ip.HeaderLength())
+		icmp := header.ICMPv4(packet[headerLen:ip.TotalLength()])
+		if len(icmp) < header.ICMPv4MinimumSize || icmp.Type() != header.ICMPv4Echo {
+			return nil, ""
+		}
+		reply = append([]byte(nil), packet[:ip.TotalLength()]...)
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		replyIP := header.IPv4(reply)
+		replyIP.SetSourceAddress(dst)
+		replyIP.SetDestinationAddress(src)
+		replyIP.SetTTL(64)
+		replyIP.SetChecksum(0)
+		replyIP.SetChecksum(^replyIP.CalculateChecksum())
+		replyICMP := header.ICMPv4(reply[headerLen:])
+		replyICMP.SetType(header.ICMPv4EchoReply)
+		replyICMP.SetChecksum(0)
+		replyICMP.SetChecksum(^header.Checksum(replyICMP, 0))
+		return reply, dst
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return nil, ""
+		}
+		totalLen := header.IPv6MinimumSize + int(ip.PayloadLength())
+		icmp := header.ICMPv6(packet[header.IPv6MinimumSize:totalLen])
+		if len(icmp) < header.ICMPv6EchoMinimumSize || icmp.Type() != header.ICMPv6EchoRequest {
+			return nil, ""
+		}
+		reply = append([]byte(nil), packet[:totalLen]...)
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		replyIP := header.IPv6(reply)
+		replyIP.SetSourceAddress(dst)
+		replyIP.SetDestinationAddress(src)
+		replyIP.SetHopLimit(64)
+		replyICMP := header.ICMPv6(reply[header.IPv6MinimumSize:])
+		replyICMP.SetType(header.ICMPv6EchoReply)
+		replyICMP.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: replyICMP,
+			Src:    dst,
+			Dst:    src,
+		}))
+		return reply, dst
+	}
+	return nil, ""
+}
+
+// unreachableReason is the reason of the ICMP destination unreachable error.
+type unreachableReason int
+
+const (
+	networkUnreachable unreachableReason = iota
+	hostUnreachable
+	portUnreachable
+)
+
+// unreachableReasonOf returns the reason of the ICMP error that reports the failed flow,
+// false means that the failure isn't reported with an ICMP error.
+func unreachableReasonOf(err error) (unreachableReason, bool) {
+	var replyErr *SOCKSReplyError
+	if !errors.As(err, &replyErr) {
+		return 0, false
+	}
+	switch replyErr.Reply {
+	case gosocks5.NetUnreachable:
+		return networkUnreachable, true
+	case gosocks5.HostUnreachable:
+		return hostUnreachable, true
+	}
+	return 0, false
+}
+
+// newICMPUnreachable returns the ICMP destination unreachable error that quotes the packet
+// and is sent from its destination back to the source.
+func newICMPUnreachable(protocol tcpip.NetworkProtocolNumber, quote []byte, reason unreachableReason) []byte {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(quote)
+		if len(quote) < header.IPv4MinimumSize || len(quote) < int(ip.HeaderLength()) {
+			return nil
+		}
+		// the error must not exceed the minimum MTU of 576 bytes
+		if maxQuote := 576 - header.IPv4MinimumSize - header.ICMPv4MinimumSize; len(quote) > maxQuote {
+			quote = quote[:maxQuote]
+		}
+		packet := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(quote))
+		replyIP := header.IPv4(packet)
+		replyIP.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     ip.DestinationAddress(),
+			DstAddr:     ip.SourceAddress(),
+		})
+		replyIP.SetChecksum(^replyIP.CalculateChecksum())
+		icmp := header.ICMPv4(packet[header.IPv4MinimumSize:])
+		icmp.SetType(header.ICMPv4DstUnreachable)
+		switch reason {
+		case networkUnreachable:
+			icmp.SetCode(header.ICMPv4NetUnreachable)
+		case hostUnreachable:
+			icmp.SetCode(header.ICMPv4HostUnreachable)
+		case portUnreachable:
+			icmp.SetCode(header.ICMPv4PortUnreachable)
+		}
+		copy(icmp[header.ICMPv4MinimumSize:], quote)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+		return packet
+	case header.IPv6ProtocolNumber:
+		if len(quote) < header.IPv6MinimumSize {
+			return nil
+		}
+		ip := header.IPv6(quote)
+		// the error must not exceed the minimum IPv6 MTU
+		if maxQuote := header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6ErrorHeaderSize; len(quote) > maxQuote {
+			quote = quote[:maxQuote]
+		}
+		packet := make([]byte, header.IPv6MinimumSize+header.ICMPv6ErrorHeaderSize+len(quote))
+		src, dst := ip.DestinationAddress(), ip.SourceAddress()
+		header.IPv6(packet).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(packet) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           src,
+			DstAddr:           dst,
+		})
+		icmp := header.ICMPv6(packet[header.IPv6MinimumSize:])
+		icmp.SetType(header.ICMPv6DstUnreachable)
+		switch reason {
+		case networkUnreachable:
+			icmp.SetCode(header.ICMPv6NetworkUnreachable)
+		case hostUnreachable:
+			icmp.SetCode(header.ICMPv6AddressUnreachable)
+		case portUnreachable:
+			icmp.SetCode(header.ICMPv6PortUnreachable)
+		}
+		copy(icmp[header.ICMPv6ErrorHeaderSize:], quote)
+		icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmp,
+			Src:    src,
+			Dst:    dst,
+		}))
+		return packet
+	}
+	return nil
+}
+
+// flowPackets keeps headers of packets that start flows until the flow is set up or fails,
+// ICMP errors about the failed flow quote them.
+type flowPackets struct {
+	mu      sync.Mutex
+	headers map[stack.TransportEndpointID]flowPacket
+	// max number of kept packets
+	limit int
+	// packets of flow requests dropped by forwarders are never taken, they expire after ttl
+	ttl time.Duration
+}
+
+type flowPacket struct {
+	protocol tcpip.NetworkProtocolNumber
+	headers  []byte
+	expires  time.Time
+}
+
+func newFlowPackets(limit int, ttl time.Duration) *flowPackets {
+	return &flowPackets{headers: make(map[stack.TransportEndpointID]flowPacket), limit: limit, ttl: ttl}
+}
+
+// handler wraps the transport protocol handler of the stack to keep headers of TCP SYN
+// and UDP packets it handles.
+func (p *flowPackets) handler(h func(stack.TransportEndpointID, *stack.PacketBuffer) bool,
+) func(stack.TransportEndpointID, *stack.PacketBuffer) bool {
+	return func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		p.put(id, pkt)
+		return h(id, pkt)
+	}
+}
+
+func (p *flowPackets) put(id stack.TransportEndpointID, pkt *stack.PacketBuffer) {
+	transportHeader := pkt.TransportHeader().Slice()
+	if pkt.TransportProtocolNumber == header.TCPProtocolNumber {
+		// ECN setup SYNs carry ECE and CWR flags as well
+		if len(transportHeader) < header.TCPMinimumSize ||
+			header.TCP(transportHeader).Flags()&(header.TCPFlagSyn|header.TCPFlagAck) != header.TCPFlagSyn {
+			return
+		}
+	}
+	networkHeader := pkt.NetworkHeader().Slice()
+	headers := make([]byte, 0, len(networkHeader)+len(transportHeader))
+	headers = append(append(headers, networkHeader...), transportHeader...)
+
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.headers[id]; !ok && len(p.headers) >= p.limit {
+		p.expire(now)
+		if len(p.headers) >= p.limit {
+			return
+		}
+	}
+	p.headers[id] = flowPacket{protocol: pkt.NetworkProtocolNumber, headers: headers, expires: now.Add(p.ttl)}
+}
+
+// expire removes expired packets, mu must be held.
+func (p *flowPackets) expire(now time.Time) {
+	for id, packet := range p.headers {
+		if now.After(packet.expires) {
+			delete(p.headers, id)
+		}
+	}
+}
+
+// take removes and returns the kept packet of the flow.
+func (p *flowPackets) take(id stack.TransportEndpointID) (flowPacket, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	packet, ok := p.headers[id]
+	delete(p.headers, id)
+	return packet, ok
+}
+
+func (p *flowPackets) remove(id stack.TransportEndpointID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.headers, id)
+}
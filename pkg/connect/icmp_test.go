@@ -0,0 +1,287 @@
+//go:build linux
+
+package connect
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/bufferv2"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func newTestICMPv4Echo(src, dst tcpip.Address, icmpType header.ICMPv4Type) []byte {
+	packet := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+4)
+	ip := header.IPv4(packet)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(packet[header.IPv4MinimumSize:])
+	icmp.SetType(icmpType)
+	icmp.SetIdent(1)
+	icmp.SetSequence(2)
+	copy(icmp.Payload(), "ping")
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	return packet
+}
+
+func TestNewICMPEchoReplyIPv4(t *testing.T) {
+	src := tcpip.Address("\x0a\x01\x01\x01")
+	dst := tcpip.Address("\x01\x01\x01\x01")
+	reply, target := newICMPEchoReply(header.IPv4ProtocolNumber, newTestICMPv4Echo(src, dst, header.ICMPv4Echo))
+	require.Equal(t, dst, target)
+
+	ip := header.IPv4(reply)
+	require.True(t, ip.IsValid(len(reply)))
+	require.True(t, ip.IsChecksumValid())
+	require.Equal(t, dst, ip.SourceAddress())
+	require.Equal(t, src, ip.DestinationAddress())
+	icmp := header.ICMPv4(ip.Payload())
+	require.Equal(t, header.ICMPv4EchoReply, icmp.Type())
+	require.Equal(t, uint16(1), icmp.Ident())
+	require.Equal(t, uint16(2), icmp.Sequence())
+	require.Equal(t, "ping", string(icmp.Payload()))
+	require.Equal(t, uint16(0xffff), header.Checksum(icmp, 0))
+}
+
+func TestNewICMPEchoReplyIPv6(t *testing.T) {
+	src := tcpip.Address("\xfd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+	dst := tcpip.Address("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	packet := make([]byte, header.IPv6MinimumSize+header.ICMPv6EchoMinimumSize)
+	header.IPv6(packet).Encode(&header.IPv6Fields{
+		PayloadLength:     header.ICMPv6EchoMinimumSize,
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	icmp := header.ICMPv6(packet[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6EchoRequest)
+	icmp.SetIdent(3)
+
+	reply, target := newICMPEchoReply(header.IPv6ProtocolNumber, packet)
+	require.Equal(t, dst, target)
+	ip := header.IPv6(reply)
+	require.Equal(t, dst, ip.SourceAddress())
+	require.Equal(t, src, ip.DestinationAddress())
+	replyICMP := header.ICMPv6(ip.Payload())
+	require.Equal(t, header.ICMPv6EchoReply, replyICMP.Type())
+	require.Equal(t, uint16(3), replyICMP.Ident())
+	require.Equal(t, replyICMP.Checksum(), header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: replyICMP,
+		Src:    dst,
+		Dst:    src,
+	}))
+}
+
+func TestNewICMPEchoReplyIgnoresOtherPackets(t *testing.T) {
+	src := tcpip.Address("\x0a\x01\x01\x01")
+	dst := tcpip.Address("\x01\x01\x01\x01")
+	reply, _ := newICMPEchoReply(header.IPv4ProtocolNumber, newTestICMPv4Echo(src, dst, header.ICMPv4EchoReply))
+	require.Nil(t, reply)
+	reply, _ = newICMPEchoReply(header.IPv4ProtocolNumber, []byte{0x45, 0})
+	require.Nil(t, reply)
+}
+
+func TestNewICMPUnreachable(t *testing.T) {
+	src := tcpip.Address("\x0a\x01\x01\x01")
+	dst := tcpip.Address("\x01\x01\x01\x01")
+	t.Run("IPv4", func(t *testing.T) {
+		quote := newTestICMPv4Echo(src, dst, header.ICMPv4Echo)
+		packet := newICMPUnreachable(header.IPv4ProtocolNumber, quote, hostUnreachable)
+
+		ip := header.IPv4(packet)
+		require.True(t, ip.IsValid(len(packet)))
+		require.True(t, ip.IsChecksumValid())
+		require.Equal(t, dst, ip.SourceAddress())
+		require.Equal(t, src, ip.DestinationAddress())
+		icmp := header.ICMPv4(ip.Payload())
+		require.Equal(t, header.ICMPv4DstUnreachable, icmp.Type())
+		require.Equal(t, header.ICMPv4HostUnreachable, icmp.Code())
+		require.Equal(t, quote, []byte(icmp[header.ICMPv4MinimumSize:]))
+		require.Equal(t, uint16(0xffff), header.Checksum(icmp, 0))
+	})
+	t.Run("IPv6", func(t *testing.T) {
+		src6 := tcpip.Address(net.ParseIP("fd00::1"))
+		dst6 := tcpip.Address(net.ParseIP("2001:db8::1"))
+		quote := make([]byte, header.IPv6MinimumSize+header.UDPMinimumSize)
+		header.IPv6(quote).Encode(&header.IPv6Fields{
+			PayloadLength:     header.UDPMinimumSize,
+			TransportProtocol: header.UDPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           src6,
+			DstAddr:           dst6,
+		})
+		packet := newICMPUnreachable(header.IPv6ProtocolNumber, quote, networkUnreachable)
+
+		ip := header.IPv6(packet)
+		require.True(t, ip.IsValid(len(packet)))
+		require.Equal(t, dst6, ip.SourceAddress())
+		require.Equal(t, src6, ip.DestinationAddress())
+		icmp := header.ICMPv6(ip.Payload())
+		require.Equal(t, header.ICMPv6DstUnreachable, icmp.Type())
+		require.Equal(t, header.ICMPv6NetworkUnreachable, icmp.Code())
+		require.Equal(t, quote, []byte(icmp[header.ICMPv6ErrorHeaderSize:]))
+		require.Equal(t, icmp.Checksum(), header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmp,
+			Src:    dst6,
+			Dst:    src6,
+		}))
+	})
+	t.Run("Reasons", func(t *testing.T) {
+		quote := newTestICMPv4Echo(src, dst, header.ICMPv4Echo)
+		for reason, code := range map[unreachableReason]header.ICMPv4Code{
+			networkUnreachable: header.ICMPv4NetUnreachable,
+			hostUnreachable:    header.ICMPv4HostUnreachable,
+			portUnreachable:    header.ICMPv4PortUnreachable,
+		} {
+			packet := newICMPUnreachable(header.IPv4ProtocolNumber, quote, reason)
+			require.Equal(t, code, header.ICMPv4(header.IPv4(packet).Payload()).Code())
+		}
+	})
+	t.Run("Truncated", func(t *testing.T) {
+		require.Nil(t, newICMPUnreachable(header.IPv4ProtocolNumber, make([]byte, 10), hostUnreachable))
+	})
+}
+
+func newTestTCPPacket(t *testing.T, srcPort uint16, flags header.TCPFlags) (stack.TransportEndpointID, *stack.PacketBuffer) {
+	src := tcpip.Address("\x0a\x01\x01\x01")
+	dst := tcpip.Address("\x01\x01\x01\x01")
+	packet := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	header.IPv4(packet).Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(packet)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	header.TCP(packet[header.IPv4MinimumSize:]).Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    80,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+	})
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: bufferv2.MakeWithData(packet)})
+	t.Cleanup(pkt.DecRef)
+	_, ok := pkt.NetworkHeader().Consume(header.IPv4MinimumSize)
+	require.True(t, ok)
+	_, ok = pkt.TransportHeader().Consume(header.TCPMinimumSize)
+	require.True(t, ok)
+	pkt.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	pkt.TransportProtocolNumber = header.TCPProtocolNumber
+	id := stack.TransportEndpointID{LocalAddress: dst, LocalPort: 80, RemoteAddress: src, RemotePort: srcPort}
+	return id, pkt
+}
+
+func TestFlowPackets(t *testing.T) {
+	t.Run("SYN", func(t *testing.T) {
+		for name, flags := range map[string]header.TCPFlags{
+			"Plain": header.TCPFlagSyn,
+			"ECN":   header.TCPFlagSyn | header.TCPFlagEce | header.TCPFlagCwr,
+		} {
+			packets := newFlowPackets(10, time.Minute)
+			id, pkt := newTestTCPPacket(t, 1000, flags)
+			packets.put(id, pkt)
+			packet, ok := packets.take(id)
+			require.True(t, ok, name)
+			require.Equal(t, header.IPv4ProtocolNumber, packet.protocol)
+			require.Len(t, packet.headers, header.IPv4MinimumSize+header.TCPMinimumSize)
+		}
+	})
+	t.Run("NotSYN", func(t *testing.T) {
+		packets := newFlowPackets(10, time.Minute)
+		for _, flags := range []header.TCPFlags{header.TCPFlagSyn | header.TCPFlagAck, header.TCPFlagAck} {
+			id, pkt := newTestTCPPacket(t, 1000, flags)
+			packets.put(id, pkt)
+			_, ok := packets.take(id)
+			require.False(t, ok)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		const ttl = 10 * time.Millisecond
+		packets := newFlowPackets(1, ttl)
+		id1, pkt1 := newTestTCPPacket(t, 1000, header.TCPFlagSyn)
+		packets.put(id1, pkt1)
+		id2, pkt2 := newTestTCPPacket(t, 1001, header.TCPFlagSyn)
+		// the limit is reached until the kept packet expires
+		packets.put(id2, pkt2)
+		_, ok := packets.take(id2)
+		require.False(t, ok)
+
+		time.Sleep(2 * ttl)
+		packets.put(id2, pkt2)
+		_, ok = packets.take(id2)
+		require.True(t, ok)
+		_, ok = packets.take(id1)
+		require.False(t, ok)
+	})
+}
+
+// blockingProbeConnector counts dials that wait until release is closed
+type blockingProbeConnector struct {
+	dials   int32
+	release chan struct{}
+}
+
+func (c *blockingProbeConnector) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	atomic.AddInt32(&c.dials, 1)
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestICMPEchoEndpointProbes(t *testing.T) {
+	log := zerolog.Nop()
+	lower := channel.New(256, 1500, "")
+	defer lower.Close()
+	connector := &blockingProbeConnector{release: make(chan struct{})}
+	ep := newICMPEchoEndpoint(&log, lower, connector, 80, 5*time.Second)
+	src := tcpip.Address("\x0a\x01\x01\x01")
+	sendEcho := func(dst tcpip.Address) {
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: bufferv2.MakeWithData(newTestICMPv4Echo(src, dst, header.ICMPv4Echo)),
+		})
+		defer pkt.DecRef()
+		ep.(stack.NetworkDispatcher).DeliverNetworkPacket(header.IPv4ProtocolNumber, pkt)
+	}
+
+	// echo requests to the same target wait for one probe
+	target := tcpip.Address("\x01\x01\x01\x01")
+	for i := 0; i < 3; i++ {
+		sendEcho(target)
+	}
+	// echo requests to other targets are dropped when too many probes are running
+	for i := 0; i < icmpMaxProbes; i++ {
+		sendEcho(tcpip.Address([]byte{2, 2, byte(i >> 8), byte(i)}))
+	}
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&connector.dials) == icmpMaxProbes
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(connector.release)
+	require.Eventually(t, func() bool {
+		return lower.NumQueued() == 3+icmpMaxProbes-1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the recent probe result answers right away
+	sendEcho(target)
+	require.Equal(t, 3+icmpMaxProbes, lower.NumQueued())
+	require.Equal(t, int32(icmpMaxProbes), atomic.LoadInt32(&connector.dials))
+}
@@ -0,0 +1,44 @@
+package connect
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// minLimiterBurst is the minimum burst size of byte limiters, so that
+// a single relay buffer can be waited for in a few steps.
+const minLimiterBurst = 1 << 14
+
+// newByteLimiter creates a token bucket limiter of bytesPerSecond rate,
+// it returns nil if the rate is not positive, i.e. unlimited.
+func newByteLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := bytesPerSecond
+	if burst < minLimiterBurst {
+		burst = minLimiterBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst))
+}
+
+// waitBytes blocks until limiters allow n bytes to be transferred. Nil limiters are skipped.
+func waitBytes(ctx context.Context, n int, limiters ...*rate.Limiter) error {
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		for rest := n; rest > 0; {
+			chunk := rest
+			if burst := limiter.Burst(); chunk > burst {
+				chunk = burst
+			}
+			if err := limiter.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			rest -= chunk
+		}
+	}
+	return nil
+}
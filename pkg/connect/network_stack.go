@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
+	"gvisor.dev/gvisor/pkg/bufferv2"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -23,6 +25,14 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
+const (
+	defaultNICID tcpip.NICID = 0x01
+	// tcpMaxInFlight is the max number of TCP connection requests waiting for upstream connects
+	tcpMaxInFlight = 2 << 10
+	// udpMaxInFlight is the max number of UDP flows waiting for upstream associations
+	udpMaxInFlight = 2 << 10
+)
+
 type NetworkStack struct {
 	*stack.Stack
 	log            *zerolog.Logger
@@ -32,10 +42,92 @@ type NetworkStack struct {
 	TcpIOTimeout   time.Duration
 	UdpIOTimeout   time.Duration
 	ConnectTimeout time.Duration
+	TcpLifetime    time.Duration
+	UdpLifetime    time.Duration
+	TcpKeepAlive   time.Duration
+	packetCapture  *PacketCapture
+	sniffTimeout   time.Duration
+	icmpEchoMode   ICMPEchoMode
+	icmpProbePort  uint16
+	dnsAddress     string
+	dnsForwarder   *dnsForwarder
+	hostAddresses  []net.IP
+	loopbackConn   Connector
+	loopbackPorts  []PortRange
+	flows          *FlowTable
+	tcpPackets     *flowPackets
+	udpPackets     *flowPackets
+}
+
+// NetworkStackOption configures optional network stack settings.
+type NetworkStackOption func(s *NetworkStack)
+
+// WithStackTimeouts overrides default connect timeout, idle timeouts, lifetimes and
+// TCP keepalive of relayed flows, it must precede options that depend on the timeouts.
+func WithStackTimeouts(timeouts Timeouts) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.ConnectTimeout = timeouts.Connect
+		s.TcpIOTimeout = timeouts.TCPIdle
+		s.UdpIOTimeout = timeouts.UDPIdle
+		s.TcpLifetime = timeouts.TCPLifetime
+		s.UdpLifetime = timeouts.UDPLifetime
+		s.TcpKeepAlive = timeouts.TCPKeepAlive
+	}
+}
+
+// WithStackFlows registers relayed flows in the flow table.
+func WithStackFlows(flows *FlowTable) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.flows = flows
+	}
+}
+
+// WithPacketCapture captures all IP packets of the tun device.
+func WithPacketCapture(capture *PacketCapture) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.packetCapture = capture
+	}
+}
+
+// WithHostnameSniffing recovers destination hostnames of TCP flows from the TLS ClientHello SNI
+// or the HTTP Host header and connects to the hostname instead of the destination IP.
+func WithHostnameSniffing() NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.sniffTimeout = sniffTimeout
+	}
 }
 
-func NewNetworkStack(log *zerolog.Logger, fd int, mtu uint32, tunNetworkAddr string,
-	socksTCPConn Connector, socksUDPConn Connector, transporter Transporter) (*NetworkStack, error) {
+// WithDNSForwarder answers DNS queries sent to the UDP address by forwarding them
+// over TCP through the proxy to the upstream resolver.
+func WithDNSForwarder(address, upstream string) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.dnsAddress = address
+		s.dnsForwarder = newDNSForwarder(s.socksTCPConn, upstream, s.UdpIOTimeout, s.ConnectTimeout)
+	}
+}
+
+// WithHostAddresses sets addresses that represent the host in the container subnets,
+// they are source addresses of connections dialed into the container.
+func WithHostAddresses(addresses ...net.IP) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.hostAddresses = addresses
+	}
+}
+
+// WithHostLoopback routes TCP and UDP flows sent to the host addresses directly to the same
+// ports of the host loopback interface using the connector. Only the given ports are reachable,
+// TCP connections to other ports of the host addresses are reset and UDP packets are dropped.
+func WithHostLoopback(connector Connector, ports ...PortRange) NetworkStackOption {
+	return func(s *NetworkStack) {
+		s.loopbackConn = connector
+		s.loopbackPorts = ports
+	}
+}
+
+// NewNetworkStack creates the network stack that processes packets of the tun device,
+// each fd is a separate queue of the device read by its own dispatcher.
+func NewNetworkStack(log *zerolog.Logger, fds []int, mtu uint32, tunNetworkAddrs []string,
+	socksTCPConn Connector, socksUDPConn Connector, transporter Transporter, opts ...NetworkStackOption) (*NetworkStack, error) {
 	s := &NetworkStack{
 		log:            log,
 		socksTCPConn:   socksTCPConn,
@@ -43,6 +135,7 @@ func NewNetworkStack(log *zerolog.Logger, fd int, mtu uint32, tunNetworkAddr str
 		TcpIOTimeout:   tcpIOTimeout,
 		UdpIOTimeout:   udpIOTimeout,
 		ConnectTimeout: connectTimeout,
+		TcpKeepAlive:   tcpKeepAlive,
 		transporter:    transporter,
 		Stack: stack.New(stack.Options{
 			NetworkProtocols: []stack.NetworkProtocolFactory{
@@ -56,18 +149,38 @@ func NewNetworkStack(log *zerolog.Logger, fd int, mtu uint32, tunNetworkAddr str
 			DefaultIPTables: defaultIPTables,
 		}),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// flow requests wait for upstream connects at most for the connect timeout
+	s.tcpPackets = newFlowPackets(tcpMaxInFlight, 2*s.ConnectTimeout)
+	s.udpPackets = newFlowPackets(udpMaxInFlight, 2*s.ConnectTimeout)
 
 	ep, err := fdbased.New(&fdbased.Options{
 		MTU: mtu,
-		FDs: []int{fd},
+		FDs: fds,
 		// TUN only
 		EthernetHeader: false,
+		// packets are generated by the local kernel with valid checksums,
+		// GSO is supported by fdbased endpoints only for socket fds, not for tun devices
+		RXChecksumOffload: true,
 	})
 	if err != nil {
 		return nil, err
 	}
+	if s.packetCapture != nil {
+		ep = newSniffingEndpoint(ep, s.packetCapture)
+	}
+	switch s.icmpEchoMode {
+	case ICMPEchoReply:
+		ep = newICMPEchoEndpoint(log, ep, nil, 0, s.ConnectTimeout)
+	case ICMPEchoProbe:
+		ep = newICMPEchoEndpoint(log, ep, s.socksTCPConn, s.icmpProbePort, s.ConnectTimeout)
+	}
 
-	var defaultNICID tcpip.NICID = 0x01
+	// the NIC dispatches packets as soon as it is created
+	s.setTCPHandler()
+	s.setUDPHandler()
 	if err := s.CreateNIC(defaultNICID, ep); err != nil {
 		return nil, errors.New(err.String())
 	}
@@ -78,12 +191,12 @@ func NewNetworkStack(log *zerolog.Logger, fd int, mtu uint32, tunNetworkAddr str
 	if err := s.SetSpoofing(defaultNICID, true); err != nil {
 		return nil, errors.New(err.String())
 	}
-	if err = s.SetupRouting(defaultNICID, tunNetworkAddr); err != nil {
-		return nil, err
+	for _, tunNetworkAddr := range tunNetworkAddrs {
+		if err = s.SetupRouting(defaultNICID, tunNetworkAddr); err != nil {
+			return nil, err
+		}
 	}
 
-	s.setTCPHandler()
-	s.setUDPHandler()
 	return s, nil
 }
 
@@ -107,29 +220,111 @@ func (s *NetworkStack) SetupRouting(nic tcpip.NICID, assignNet string) error {
 	return nil
 }
 
+// DialContext connects to the address inside the container from the host address
+// of the same family, it is used to publish container ports on the host.
+func (s *NetworkStack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid container address: %s", address)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid container port: %w", err)
+	}
+	proto := header.IPv6ProtocolNumber
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, proto = ip4, header.IPv4ProtocolNumber
+	}
+	var localAddr *tcpip.FullAddress
+	for _, hostIP := range s.hostAddresses {
+		if hostIP4 := hostIP.To4(); hostIP4 != nil {
+			hostIP = hostIP4
+		}
+		if len(hostIP) == len(ip) {
+			localAddr = &tcpip.FullAddress{NIC: defaultNICID, Addr: tcpip.Address(hostIP)}
+			break
+		}
+	}
+	if localAddr == nil {
+		return nil, fmt.Errorf("no host address to dial %s", address)
+	}
+	remoteAddr := &tcpip.FullAddress{NIC: defaultNICID, Addr: tcpip.Address(ip), Port: uint16(port)}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return gonet.DialTCPWithBind(ctx, s.Stack, *localAddr, *remoteAddr, proto)
+	case "udp", "udp4", "udp6":
+		return gonet.DialUDP(s.Stack, localAddr, remoteAddr, proto)
+	}
+	return nil, fmt.Errorf("unsupported network: %s", network)
+}
+
+// setTCPHandler handles TCP connection requests of the container. The handshake is completed
+// only after the upstream connect succeeds, so programs in the container get real connect errors.
 func (s *NetworkStack) setTCPHandler() {
-	tcpForwarder := tcp.NewForwarder(s.Stack, 0, 2<<10, func(r *tcp.ForwarderRequest) {
-		var wq waiter.Queue
+	tcpForwarder := tcp.NewForwarder(s.Stack, 0, tcpMaxInFlight, func(r *tcp.ForwarderRequest) {
 		id := r.ID()
 		s.log.Debug().Str("handler", "tcp").
 			Stringer("localAddress", id.LocalAddress).Uint16("localPort", id.LocalPort).
 			Stringer("fromAddress", id.RemoteAddress).Uint16("fromPort", id.RemotePort).Msg("received request")
-		ep, err := r.CreateEndpoint(&wq)
-		if err != nil {
-			s.log.Error().Str("handler", "tcp").Stringer("error", err).Msg("")
-			// prevent potential half-open TCP connection leak.
+		if toHost, allowed := s.hostLoopbackPort(&id); toHost && !allowed {
+			s.log.Debug().Str("handler", "tcp").Uint16("port", id.LocalPort).Msg("host port is not allowed")
 			r.Complete(true)
+			s.tcpPackets.remove(id)
 			return
 		}
-		r.Complete(false)
-
-		go func() {
-			if err := s.handleTCP(gonet.NewTCPConn(&wq, ep), &id); err != nil {
-				s.log.Error().Str("handler", "tcp").Err(err).Msg("")
-			}
-		}()
+		// the forwarder runs each request in its own goroutine
+		if err := s.handleTCP(r, &id); err != nil {
+			s.log.Error().Str("handler", "tcp").Err(err).Msg("")
+		}
 	})
-	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, s.tcpPackets.handler(tcpForwarder.HandlePacket))
+}
+
+// acceptTCP completes the TCP handshake of the connection request.
+func (s *NetworkStack) acceptTCP(r *tcp.ForwarderRequest) (net.Conn, error) {
+	// the request is released on completion
+	id := r.ID()
+	defer s.tcpPackets.remove(id)
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		// prevent potential half-open TCP connection leak.
+		r.Complete(true)
+		return nil, errors.New(err.String())
+	}
+	r.Complete(false)
+	if s.TcpKeepAlive > 0 {
+		setKeepAlive(ep, s.TcpKeepAlive)
+	}
+	return gonet.NewTCPConn(&wq, ep), nil
+}
+
+// refuseTCP rejects the connection request of the failed flow. Unreachable networks and hosts
+// reported by the proxy are answered with ICMP errors, other failures with RST.
+func (s *NetworkStack) refuseTCP(r *tcp.ForwarderRequest, id *stack.TransportEndpointID, dialErr error) {
+	reason, ok := unreachableReasonOf(dialErr)
+	packet, found := s.tcpPackets.take(*id)
+	if !ok || !found {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	s.writeICMPUnreachable(packet, reason)
+}
+
+func (s *NetworkStack) writeICMPUnreachable(packet flowPacket, reason unreachableReason) {
+	icmp := newICMPUnreachable(packet.protocol, packet.headers, reason)
+	if icmp == nil {
+		return
+	}
+	if err := s.WriteRawPacket(defaultNICID, packet.protocol, bufferv2.MakeWithData(icmp)); err != nil {
+		s.log.Error().Str("handler", "icmp").Stringer("error", err).Msg("")
+	}
 }
 
 func (s *NetworkStack) setUDPHandler() {
@@ -139,9 +334,17 @@ func (s *NetworkStack) setUDPHandler() {
 		s.log.Debug().Str("handler", "udp").
 			Stringer("localAddress", id.LocalAddress).Uint16("localPort", id.LocalPort).
 			Stringer("fromAddress", id.RemoteAddress).Uint16("fromPort", id.RemotePort).Msg("received request")
+		if toHost, allowed := s.hostLoopbackPort(&id); toHost && !allowed && !s.isDNSAddress(&id) {
+			s.log.Debug().Str("handler", "udp").Uint16("port", id.LocalPort).Msg("host port is not allowed")
+			if packet, found := s.udpPackets.take(id); found {
+				s.writeICMPUnreachable(packet, portUnreachable)
+			}
+			return
+		}
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
 			s.log.Error().Str("handler", "udp").Stringer("error", err).Msg("")
+			s.udpPackets.remove(id)
 			return
 		}
 		go func() {
@@ -150,46 +353,164 @@ func (s *NetworkStack) setUDPHandler() {
 			}
 		}()
 	})
-	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, s.udpPackets.handler(udpForwarder.HandlePacket))
 }
 
-func (s *NetworkStack) handleTCP(localConn net.Conn, id *stack.TransportEndpointID) (err error) {
-	defer localConn.Close()
+func (s *NetworkStack) handleTCP(r *tcp.ForwarderRequest, id *stack.TransportEndpointID) (err error) {
+	address := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+	connector := s.socksTCPConn
+	toHost, _ := s.hostLoopbackPort(id)
+	if toHost {
+		connector, address = s.loopbackConn, hostLoopbackAddress(id.LocalAddress, id.LocalPort)
+		s.log.Debug().Str("network", "tcp").Stringer("hostAddr", id.LocalAddress).Str("dstAddr", address).Msg("host loopback")
+	}
 
-	address := fmt.Sprintf("%s:%v", id.LocalAddress, id.LocalPort)
+	// the hostname is sniffed from the first data, so the handshake can't wait for the upstream
+	var localConn net.Conn
+	var hostname string
+	if s.sniffTimeout > 0 && !toHost {
+		if localConn, err = s.acceptTCP(r); err != nil {
+			return
+		}
+		defer localConn.Close()
+		if hostname, localConn, err = sniffHostname(localConn, s.sniffTimeout); err != nil {
+			return
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), s.ConnectTimeout)
 	defer cancel()
-	dstConn, err := s.socksTCPConn.DialContext(ctx, "tcp", address)
+	if hostname != "" {
+		s.log.Debug().Str("dstAddr", address).Str("hostname", hostname).Msg("sniffed destination hostname")
+		ctx = withDestinationHostname(ctx, hostname)
+	}
+	dstConn, err := connector.DialContext(ctx, "tcp", address)
 	if err != nil {
+		if localConn == nil {
+			s.refuseTCP(r, id, err)
+		}
 		return
 	}
 	defer dstConn.Close()
+	if localConn == nil {
+		if localConn, err = s.acceptTCP(r); err != nil {
+			return
+		}
+		defer localConn.Close()
+	}
 
-	localConn = NewTimeoutConn(localConn, s.TcpIOTimeout)
-	dstConn = NewTimeoutConn(dstConn, s.TcpIOTimeout)
+	localConn = NewTimeoutConn(localConn, s.TcpIOTimeout).WithLifetime(s.TcpLifetime)
+	dstConn = NewTimeoutConn(dstConn, s.TcpIOTimeout).WithLifetime(s.TcpLifetime)
 	// relay TCP connections
-	return s.transporter.Transport(localConn, dstConn)
+	return s.transport("tcp", address, localConn, dstConn)
 }
 
 func (s *NetworkStack) handleUDP(localConn net.Conn, id *stack.TransportEndpointID) (err error) {
 	defer localConn.Close()
+	// the first datagram of the flow is quoted by the ICMP error if the flow fails
+	packet, found := s.udpPackets.take(*id)
 
-	dstAddress := fmt.Sprintf("%s:%v", id.LocalAddress, id.LocalPort)
+	dstAddress := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
 	s.log.Debug().Str("dstAddr", dstAddress).Msg("handleUDP called")
+	if s.isDNSAddress(id) {
+		return s.dnsForwarder.serve(localConn)
+	}
+	if toHost, _ := s.hostLoopbackPort(id); toHost {
+		return s.handleHostLoopback("udp", localConn, id.LocalAddress, id.LocalPort)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), s.ConnectTimeout)
 	defer cancel()
 	dstConn, err := s.socksUDPConn.DialContext(ctx, "udp", dstAddress)
 	if err != nil {
+		// unreachable networks and hosts reported by the proxy are passed through,
+		// other failures of the association are reported as the unreachable port
+		reason, ok := unreachableReasonOf(err)
+		if !ok {
+			reason = portUnreachable
+		}
+		if found {
+			s.writeICMPUnreachable(packet, reason)
+		}
 		return
 	}
 	defer dstConn.Close()
 
-	localConn = NewTimeoutConn(localConn, s.UdpIOTimeout)
-	dstConn = NewTimeoutConn(dstConn, s.UdpIOTimeout)
+	localConn = NewTimeoutConn(localConn, s.UdpIOTimeout).WithLifetime(s.UdpLifetime)
+	dstConn = NewTimeoutConn(dstConn, s.UdpIOTimeout).WithLifetime(s.UdpLifetime)
 	// relay UDP connections
-	return s.transporter.Transport(localConn, dstConn)
+	return s.transport("udp", dstAddress, localConn, dstConn)
+}
+
+// handleHostLoopback relays the flow sent to the host address to the same port of the host loopback interface.
+func (s *NetworkStack) handleHostLoopback(network string, localConn net.Conn, hostAddress tcpip.Address, port uint16) error {
+	address := hostLoopbackAddress(hostAddress, port)
+	s.log.Debug().Str("network", network).Stringer("hostAddr", hostAddress).Str("dstAddr", address).Msg("host loopback")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ConnectTimeout)
+	defer cancel()
+	dstConn, err := s.loopbackConn.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	timeout, lifetime := s.TcpIOTimeout, s.TcpLifetime
+	if network == "udp" {
+		timeout, lifetime = s.UdpIOTimeout, s.UdpLifetime
+	}
+	return s.transport(network, address, NewTimeoutConn(localConn, timeout).WithLifetime(lifetime),
+		NewTimeoutConn(dstConn, timeout).WithLifetime(lifetime))
+}
+
+// hostLoopbackAddress returns the address of the port on the host loopback interface
+// of the same family as the host address.
+func hostLoopbackAddress(hostAddress tcpip.Address, port uint16) string {
+	loopback := net.IPv6loopback.String()
+	if len(hostAddress) == net.IPv4len {
+		loopback = "127.0.0.1"
+	}
+	return net.JoinHostPort(loopback, strconv.Itoa(int(port)))
+}
+
+// hostLoopbackPort reports whether the flow is sent to one of the host addresses routed
+// to the host loopback interface and whether its destination port is allowed.
+func (s *NetworkStack) hostLoopbackPort(id *stack.TransportEndpointID) (toHost, allowed bool) {
+	if s.loopbackConn == nil {
+		return false, false
+	}
+	dstIP := net.IP(id.LocalAddress)
+	for _, hostIP := range s.hostAddresses {
+		if hostIP.Equal(dstIP) {
+			toHost = true
+			break
+		}
+	}
+	if !toHost {
+		return false, false
+	}
+	for _, ports := range s.loopbackPorts {
+		if ports.Contains(id.LocalPort) {
+			return true, true
+		}
+	}
+	return true, false
+}
+
+func (s *NetworkStack) isDNSAddress(id *stack.TransportEndpointID) bool {
+	return s.dnsForwarder != nil &&
+		net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort))) == s.dnsAddress
+}
+
+// transport relays the flow from the container to the destination address
+func (s *NetworkStack) transport(network, address string, localConn, dstConn net.Conn) error {
+	defer s.flows.Add(Flow{Network: network, Source: addrString(localConn.RemoteAddr()), Destination: address},
+		localConn, dstConn)()
+	transporter := s.transporter
+	if dt, ok := transporter.(DestinationTransporter); ok {
+		transporter = dt.ForDestination(network, address)
+	}
+	return transporter.Transport(localConn, dstConn)
 }
 
 // defaultIPTables creates iptables rules that allow only TCP and UDP traffic
@@ -273,3 +594,13 @@ func defaultIPTables(clock tcpip.Clock, rand *rand.Rand) *stack.IPTables {
 
 	return iptables
 }
+
+// setKeepAlive enables keepalive probes of the container TCP connection, the connection
+// is reset after the default number of unanswered probes.
+func setKeepAlive(ep tcpip.Endpoint, period time.Duration) {
+	idle := tcpip.KeepaliveIdleOption(period)
+	interval := tcpip.KeepaliveIntervalOption(period)
+	ep.SocketOptions().SetKeepAlive(true)
+	_ = ep.SetSockOpt(&idle)
+	_ = ep.SetSockOpt(&interval)
+}
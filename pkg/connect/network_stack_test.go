@@ -0,0 +1,262 @@
+//go:build linux
+
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// discardConnector returns connections that discard all written data
+type discardConnector struct{}
+
+func (*discardConnector) DialContext(context.Context, string, string) (net.Conn, error) {
+	conn1, conn2 := net.Pipe()
+	go func() {
+		io.Copy(io.Discard, conn2) //nolint:errcheck
+		conn2.Close()
+	}()
+	return conn1, nil
+}
+
+// newContainerStack creates the network stack of the container side connected
+// to the wirez network stack with packet socket pairs instead of tun queues.
+func newContainerStack(t testing.TB, queues int, socksTCPConn, socksUDPConn Connector,
+	opts ...NetworkStackOption) (containerStack *stack.Stack, wirezStack *NetworkStack) {
+	t.Helper()
+	const mtu = 1500
+	containerFds := make([]int, 0, queues)
+	wirezFds := make([]int, 0, queues)
+	for i := 0; i < queues; i++ {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+		require.NoError(t, err)
+		containerFds = append(containerFds, fds[0])
+		wirezFds = append(wirezFds, fds[1])
+	}
+	t.Cleanup(func() {
+		for _, fd := range append(containerFds, wirezFds...) {
+			unix.Close(fd)
+		}
+	})
+
+	log := zerolog.Nop()
+	wirezStack, err := NewNetworkStack(&log, wirezFds, mtu, []string{"10.1.1.1/24"},
+		socksTCPConn, socksUDPConn, NewTransporter(&log), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { closeStack(wirezStack.Stack) })
+
+	containerStack = stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	t.Cleanup(func() { closeStack(containerStack) })
+	ep, err := fdbased.New(&fdbased.Options{MTU: mtu, FDs: containerFds, RXChecksumOffload: true})
+	require.NoError(t, err)
+	require.Nil(t, containerStack.CreateNIC(1, ep))
+	require.Nil(t, containerStack.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.Address(net.IPv4(10, 1, 1, 1).To4()).WithPrefix(),
+	}, stack.AddressProperties{}))
+	containerStack.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	return
+}
+
+// closeStack stops the stack together with dispatchers of its NICs, leaked dispatchers
+// that block in poll can stall the runtime when tests run on a single CPU.
+func closeStack(s *stack.Stack) {
+	s.Close()
+	s.Wait()
+}
+
+func TestNetworkStackRelaysTCP(t *testing.T) {
+	containerStack, _ := newContainerStack(t, 2, &discardConnector{}, &discardConnector{})
+	conn, err := gonet.DialTCP(containerStack, tcpip.FullAddress{
+		NIC:  1,
+		Addr: tcpip.Address(net.IPv4(1, 2, 3, 4).To4()),
+		Port: 80,
+	}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+}
+
+func TestNetworkStackDialsContainer(t *testing.T) {
+	containerStack, wirezStack := newContainerStack(t, 1, &discardConnector{}, &discardConnector{},
+		WithHostAddresses(net.IPv4(10, 1, 1, 2)))
+	ln, err := gonet.ListenTCP(containerStack, tcpip.FullAddress{
+		NIC:  1,
+		Addr: tcpip.Address(net.IPv4(10, 1, 1, 1).To4()),
+		Port: 8080,
+	}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := wirezStack.DialContext(ctx, "tcp", "10.1.1.1:8080")
+	require.NoError(t, err)
+	defer conn.Close()
+	containerConn := <-accepted
+	defer containerConn.Close()
+	require.Equal(t, "10.1.1.2", containerConn.RemoteAddr().(*net.TCPAddr).IP.String())
+
+	// no host address of the address family
+	_, err = wirezStack.DialContext(ctx, "tcp", "[fd00::1]:8080")
+	require.Error(t, err)
+}
+
+func TestNetworkStackHostLoopback(t *testing.T) {
+	connector := newPipeConnector()
+	containerStack, _ := newContainerStack(t, 1, &discardConnector{}, &discardConnector{}, WithHostAddresses(net.IPv4(10, 1, 1, 2)),
+		WithHostLoopback(connector, PortRange{Start: 5432, End: 5432}))
+	hostAddr := tcpip.FullAddress{NIC: 1, Addr: tcpip.Address(net.IPv4(10, 1, 1, 2).To4()), Port: 5432}
+	conn, err := gonet.DialTCP(containerStack, hostAddr, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	require.Equal(t, "127.0.0.1:5432", <-connector.addresses)
+	hostConn := <-connector.conns
+	buf := make([]byte, 4)
+	_, err = hostConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	// ports outside of the allowlist are refused
+	hostAddr.Port = 22
+	_, err = gonet.DialTCP(containerStack, hostAddr, ipv4.ProtocolNumber)
+	require.Error(t, err)
+	require.Empty(t, connector.addresses)
+}
+
+// BenchmarkNetworkStackUpload measures throughput of parallel TCP uploads from the container.
+func BenchmarkNetworkStackUpload(b *testing.B) {
+	for _, queues := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("Queues%d", queues), func(b *testing.B) {
+			containerStack, _ := newContainerStack(b, queues, &discardConnector{}, &discardConnector{})
+			const flows = 8
+			const chunkSize = 64 << 10
+			conns := make([]net.Conn, 0, flows)
+			for i := 0; i < flows; i++ {
+				conn, err := gonet.DialTCP(containerStack, tcpip.FullAddress{
+					NIC:  1,
+					Addr: tcpip.Address(net.IPv4(1, 2, 3, byte(i+1)).To4()),
+					Port: 80,
+				}, ipv4.ProtocolNumber)
+				require.NoError(b, err)
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+
+			chunk := make([]byte, chunkSize)
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i, conn := range conns {
+				n := b.N / flows
+				if i < b.N%flows {
+					n++
+				}
+				wg.Add(1)
+				go func(conn net.Conn, n int) {
+					defer wg.Done()
+					for j := 0; j < n; j++ {
+						if _, err := conn.Write(chunk); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(conn, n)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestNetworkStackRefusesFailedTCP(t *testing.T) {
+	tests := []struct {
+		name        string
+		reply       uint8
+		expectedErr string
+	}{
+		{name: "ConnectionRefused", reply: gosocks5.ConnRefused, expectedErr: "connection was refused"},
+		// the container stack ignores ICMP network unreachable errors unlike Linux
+		{name: "NetworkUnreachable", reply: gosocks5.NetUnreachable, expectedErr: "deadline exceeded"},
+		{name: "HostUnreachable", reply: gosocks5.HostUnreachable, expectedErr: "no route"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failingConn := &failingConnector{err: &SOCKSReplyError{Address: "1.2.3.4:80", Reply: tt.reply}}
+			containerStack, _ := newContainerStack(t, 1, failingConn, &discardConnector{})
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			_, err := gonet.DialContextTCP(ctx, containerStack, tcpip.FullAddress{
+				NIC:  1,
+				Addr: tcpip.Address(net.IPv4(1, 2, 3, 4).To4()),
+				Port: 80,
+			}, ipv4.ProtocolNumber)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.expectedErr)
+		})
+	}
+}
+
+func TestNetworkStackRefusesFailedUDP(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "AssociationFailed", err: errors.New("connection refused")},
+		{name: "HostUnreachable", err: &SOCKSReplyError{Address: "1.2.3.4:53", Reply: gosocks5.HostUnreachable}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containerStack, _ := newContainerStack(t, 1, &discardConnector{}, &failingConnector{err: tt.err})
+			conn, err := gonet.DialUDP(containerStack, nil, &tcpip.FullAddress{
+				NIC:  1,
+				Addr: tcpip.Address(net.IPv4(1, 2, 3, 4).To4()),
+				Port: 53,
+			}, ipv4.ProtocolNumber)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("query"))
+			require.NoError(t, err)
+
+			// the container stack doesn't wake up blocked reads on ICMP errors unlike Linux
+			dstUnreachable := containerStack.Stats().ICMP.V4.PacketsReceived.DstUnreachable
+			require.Eventually(t, func() bool {
+				return dstUnreachable.Value() == 1
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package connect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options, see https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/
+const (
+	pcapngSectionHeaderBlock  = 0x0A0D0D0A
+	pcapngInterfaceBlock      = 0x00000001
+	pcapngEnhancedPacketBlock = 0x00000006
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+	pcapngLinkTypeRaw         = 101
+	pcapngOptionEndOfOpt      = 0
+	pcapngOptionIfName        = 2
+	pcapngOptionEPBFlags      = 2
+	pcapngDirectionInbound    = 1
+	pcapngDirectionOutbound   = 2
+)
+
+// PacketCapture writes raw IP packets to a pcapng file with a single interface.
+type PacketCapture struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	filter *PacketFilter
+	err    error
+}
+
+// NewPacketCapture writes the pcapng section header to w. Only packets matching
+// the filter are captured, a nil filter matches all packets.
+func NewPacketCapture(w io.Writer, ifName string, filter *PacketFilter) (*PacketCapture, error) {
+	c := &PacketCapture{w: bufio.NewWriter(w), filter: filter}
+	if err := c.writeHeader(ifName); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *PacketCapture) writeHeader(ifName string) error {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeaderBlock)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	// version 1.0
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	// unspecified section length
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	nameLen := len(ifName)
+	// header, if_name option, opt_endofopt and trailing block length
+	idbLen := 16 + 4 + pad4(nameLen) + 4 + 4
+	idb := make([]byte, idbLen)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterfaceBlock)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(idbLen))
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	// zero snap length means no limit
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint16(idb[16:], pcapngOptionIfName)
+	binary.LittleEndian.PutUint16(idb[18:], uint16(nameLen))
+	copy(idb[20:], ifName)
+	// opt_endofopt is already zeroed
+	binary.LittleEndian.PutUint32(idb[idbLen-4:], uint32(idbLen))
+
+	if _, err := c.w.Write(shb); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(idb); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// WritePacket writes the IP packet made of the given slices as an enhanced packet block.
+// Outbound packets are sent by the container, inbound packets are received by the container.
+func (c *PacketCapture) WritePacket(ts time.Time, outbound bool, slices ...[]byte) error {
+	var packet []byte
+	if len(slices) == 1 {
+		packet = slices[0]
+	} else {
+		for _, s := range slices {
+			packet = append(packet, s...)
+		}
+	}
+	if c.filter != nil && !c.filter.Match(packet) {
+		return nil
+	}
+
+	blockLen := 28 + pad4(len(packet)) + 12 + 4
+	block := make([]byte, blockLen)
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacketBlock)
+	binary.LittleEndian.PutUint32(block[4:], uint32(blockLen))
+	// interface id 0
+	micros := uint64(ts.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(block[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+	copy(block[28:], packet)
+	opts := block[28+pad4(len(packet)):]
+	direction := uint32(pcapngDirectionInbound)
+	if outbound {
+		direction = pcapngDirectionOutbound
+	}
+	binary.LittleEndian.PutUint16(opts[0:], pcapngOptionEPBFlags)
+	binary.LittleEndian.PutUint16(opts[2:], 4)
+	binary.LittleEndian.PutUint32(opts[4:], direction)
+	binary.LittleEndian.PutUint16(opts[8:], pcapngOptionEndOfOpt)
+	binary.LittleEndian.PutUint32(block[blockLen-4:], uint32(blockLen))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// keep the first error, the capture file is broken anyway
+	if c.err == nil {
+		_, c.err = c.w.Write(block)
+	}
+	return c.err
+}
+
+// Flush writes buffered packets to the underlying writer.
+func (c *PacketCapture) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.w.Flush()
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// PacketFilter matches IP packets by transport protocol and port. Its expression is
+// a subset of BPF syntax: primitives tcp, udp, icmp and port N combined with "and"
+// and "or" (and binds tighter), e.g. "tcp and port 443 or udp and port 53".
+type PacketFilter struct {
+	alternatives [][]packetMatcher
+}
+
+type packetMatcher func(p *packetInfo) bool
+
+type packetInfo struct {
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+	hasPorts bool
+}
+
+const (
+	ipProtocolICMP   = 1
+	ipProtocolTCP    = 6
+	ipProtocolUDP    = 17
+	ipProtocolICMPv6 = 58
+)
+
+func ParsePacketFilter(expr string) (*PacketFilter, error) {
+	tokens := strings.Fields(strings.ToLower(expr))
+	if len(tokens) == 0 {
+		return nil, errors.New("empty packet filter")
+	}
+	f := &PacketFilter{}
+	var conj []packetMatcher
+	expectPrimitive := true
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if !expectPrimitive {
+			switch token {
+			case "and":
+			case "or":
+				f.alternatives = append(f.alternatives, conj)
+				conj = nil
+			default:
+				return nil, fmt.Errorf("expected and/or, got %s", token)
+			}
+			expectPrimitive = true
+			continue
+		}
+		var m packetMatcher
+		switch token {
+		case "tcp":
+			m = matchProtocol(ipProtocolTCP)
+		case "udp":
+			m = matchProtocol(ipProtocolUDP)
+		case "icmp":
+			m = matchProtocol(ipProtocolICMP, ipProtocolICMPv6)
+		case "port":
+			if i+1 >= len(tokens) {
+				return nil, errors.New("missing port number")
+			}
+			i++
+			port, err := strconv.ParseUint(tokens[i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %s: %w", tokens[i], err)
+			}
+			m = matchPort(uint16(port))
+		default:
+			return nil, fmt.Errorf("unknown packet filter primitive %s", token)
+		}
+		conj = append(conj, m)
+		expectPrimitive = false
+	}
+	if expectPrimitive {
+		return nil, errors.New("packet filter ends with an operator")
+	}
+	f.alternatives = append(f.alternatives, conj)
+	return f, nil
+}
+
+func matchProtocol(protocols ...uint8) packetMatcher {
+	return func(p *packetInfo) bool {
+		for _, protocol := range protocols {
+			if p.protocol == protocol {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchPort(port uint16) packetMatcher {
+	return func(p *packetInfo) bool {
+		return p.hasPorts && (p.srcPort == port || p.dstPort == port)
+	}
+}
+
+// Match reports whether the raw IP packet matches the filter.
+func (f *PacketFilter) Match(packet []byte) bool {
+	info, ok := parsePacketInfo(packet)
+	if !ok {
+		return false
+	}
+	for _, conj := range f.alternatives {
+		matched := true
+		for _, m := range conj {
+			if !m(info) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePacketInfo extracts the transport protocol and ports of the IP packet.
+// IPv6 extension headers and non-first fragments are not parsed for ports.
+func parsePacketInfo(packet []byte) (*packetInfo, bool) {
+	if len(packet) == 0 {
+		return nil, false
+	}
+	info := &packetInfo{}
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, false
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		if headerLen < 20 || len(packet) < headerLen {
+			return nil, false
+		}
+		info.protocol = packet[9]
+		// fragment offset
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			transport = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return nil, false
+		}
+		info.protocol = packet[6]
+		transport = packet[40:]
+	default:
+		return nil, false
+	}
+	if (info.protocol == ipProtocolTCP || info.protocol == ipProtocolUDP) && len(transport) >= 4 {
+		info.srcPort = binary.BigEndian.Uint16(transport[0:2])
+		info.dstPort = binary.BigEndian.Uint16(transport[2:4])
+		info.hasPorts = true
+	}
+	return info, true
+}
@@ -0,0 +1,127 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIPv4Packet(protocol uint8, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	packet[9] = protocol
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	return packet
+}
+
+func newTestIPv6Packet(protocol uint8, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 48)
+	packet[0] = 0x60
+	packet[6] = protocol
+	binary.BigEndian.PutUint16(packet[40:], srcPort)
+	binary.BigEndian.PutUint16(packet[42:], dstPort)
+	return packet
+}
+
+func TestPacketCaptureWritePacket(t *testing.T) {
+	buf := &bytes.Buffer{}
+	capture, err := NewPacketCapture(buf, "tun0", nil)
+	require.NoError(t, err)
+	headerLen := buf.Len()
+	// SHB and IDB with padded if_name option
+	require.Equal(t, 28+32, headerLen)
+	require.Equal(t, uint32(pcapngSectionHeaderBlock), binary.LittleEndian.Uint32(buf.Bytes()))
+	require.Equal(t, uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(buf.Bytes()[8:]))
+	require.Equal(t, uint16(pcapngLinkTypeRaw), binary.LittleEndian.Uint16(buf.Bytes()[28+8:]))
+
+	packet := newTestIPv4Packet(ipProtocolUDP, 1234, 53)
+	ts := time.Unix(1, 500)
+	require.NoError(t, capture.WritePacket(ts, true, packet[:10], packet[10:]))
+	require.NoError(t, capture.Flush())
+
+	block := buf.Bytes()[headerLen:]
+	require.Len(t, block, 28+len(packet)+16)
+	require.Equal(t, uint32(pcapngEnhancedPacketBlock), binary.LittleEndian.Uint32(block))
+	require.Equal(t, uint32(len(block)), binary.LittleEndian.Uint32(block[4:]))
+	require.Equal(t, uint32(len(block)), binary.LittleEndian.Uint32(block[len(block)-4:]))
+	require.Equal(t, uint32(1_000_000), binary.LittleEndian.Uint32(block[16:]))
+	require.Equal(t, uint32(len(packet)), binary.LittleEndian.Uint32(block[20:]))
+	require.Equal(t, packet, block[28:28+len(packet)])
+	require.Equal(t, uint32(pcapngDirectionOutbound), binary.LittleEndian.Uint32(block[28+len(packet)+4:]))
+}
+
+func TestPacketCaptureFilter(t *testing.T) {
+	filter, err := ParsePacketFilter("tcp")
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	capture, err := NewPacketCapture(buf, "tun0", filter)
+	require.NoError(t, err)
+	headerLen := buf.Len()
+
+	require.NoError(t, capture.WritePacket(time.Now(), false, newTestIPv4Packet(ipProtocolUDP, 1234, 53)))
+	require.NoError(t, capture.Flush())
+	require.Equal(t, headerLen, buf.Len())
+}
+
+func TestParsePacketFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		matches [][]byte
+		skips   [][]byte
+	}{
+		{
+			name:    "Protocol",
+			expr:    "udp",
+			matches: [][]byte{newTestIPv4Packet(ipProtocolUDP, 1, 2), newTestIPv6Packet(ipProtocolUDP, 1, 2)},
+			skips:   [][]byte{newTestIPv4Packet(ipProtocolTCP, 1, 2), {0x45}},
+		},
+		{
+			name:    "ICMP",
+			expr:    "icmp",
+			matches: [][]byte{newTestIPv4Packet(ipProtocolICMP, 0, 0), newTestIPv6Packet(ipProtocolICMPv6, 0, 0)},
+			skips:   [][]byte{newTestIPv4Packet(ipProtocolTCP, 1, 2)},
+		},
+		{
+			name:    "SourceOrDestinationPort",
+			expr:    "port 443",
+			matches: [][]byte{newTestIPv4Packet(ipProtocolTCP, 443, 2), newTestIPv6Packet(ipProtocolUDP, 1, 443)},
+			skips:   [][]byte{newTestIPv4Packet(ipProtocolTCP, 1, 2), newTestIPv4Packet(ipProtocolICMP, 443, 443)},
+		},
+		{
+			name: "AndOr",
+			expr: "tcp and port 443 or udp and port 53",
+			matches: [][]byte{
+				newTestIPv4Packet(ipProtocolTCP, 1, 443),
+				newTestIPv4Packet(ipProtocolUDP, 53, 1),
+			},
+			skips: [][]byte{
+				newTestIPv4Packet(ipProtocolTCP, 1, 53),
+				newTestIPv4Packet(ipProtocolUDP, 443, 1),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := ParsePacketFilter(tt.expr)
+			require.NoError(t, err)
+			for _, packet := range tt.matches {
+				require.True(t, filter.Match(packet))
+			}
+			for _, packet := range tt.skips {
+				require.False(t, filter.Match(packet))
+			}
+		})
+	}
+}
+
+func TestParsePacketFilterInvalid(t *testing.T) {
+	for _, expr := range []string{"", "tcp and", "port", "port abc", "host 1.1.1.1", "tcp udp"} {
+		_, err := ParsePacketFilter(expr)
+		require.Error(t, err, expr)
+	}
+}
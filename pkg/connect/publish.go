@@ -0,0 +1,227 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.uber.org/multierr"
+)
+
+const (
+	// maxUDPPacketSize is the maximum size of a UDP payload
+	maxUDPPacketSize = 1<<16 - 1
+	// publishMaxUDPFlows is the default max number of host clients of each published UDP port
+	publishMaxUDPFlows = 1024
+)
+
+var errTooManyUDPFlows = errors.New("too many udp flows")
+
+// PortPublisher accepts connections on host addresses and relays them to container
+// addresses dialed with the container connector.
+type PortPublisher struct {
+	log            *zerolog.Logger
+	connector      Connector
+	transporter    Transporter
+	TcpIOTimeout   time.Duration
+	UdpIOTimeout   time.Duration
+	ConnectTimeout time.Duration
+	TcpLifetime    time.Duration
+	UdpLifetime    time.Duration
+	// MaxUdpFlows limits the number of host clients of each published UDP port, datagrams of other clients are dropped
+	MaxUdpFlows int
+
+	mu        sync.Mutex
+	listeners []interface{ Close() error }
+}
+
+func NewPortPublisher(log *zerolog.Logger, connector Connector, transporter Transporter) *PortPublisher {
+	return &PortPublisher{
+		log:            log,
+		connector:      connector,
+		transporter:    transporter,
+		TcpIOTimeout:   tcpIOTimeout,
+		UdpIOTimeout:   udpIOTimeout,
+		ConnectTimeout: connectTimeout,
+		MaxUdpFlows:    publishMaxUDPFlows,
+	}
+}
+
+// Publish starts listening on the host address and returns the actual listening address.
+func (p *PortPublisher) Publish(network, hostAddress, containerAddress string) (net.Addr, error) {
+	switch network {
+	case "tcp":
+		ln, err := net.Listen(network, hostAddress)
+		if err != nil {
+			return nil, err
+		}
+		p.addListener(ln)
+		go p.serveTCP(ln, containerAddress)
+		return ln.Addr(), nil
+	case "udp":
+		ln, err := net.ListenPacket(network, hostAddress)
+		if err != nil {
+			return nil, err
+		}
+		p.addListener(ln)
+		go p.serveUDP(ln, containerAddress)
+		return ln.LocalAddr(), nil
+	}
+	return nil, errors.New("unsupported network: " + network)
+}
+
+// Close stops listening on all host addresses.
+func (p *PortPublisher) Close() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ln := range p.listeners {
+		err = multierr.Append(err, ln.Close())
+	}
+	p.listeners = nil
+	return
+}
+
+func (p *PortPublisher) addListener(ln interface{ Close() error }) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listeners = append(p.listeners, ln)
+}
+
+func (p *PortPublisher) serveTCP(ln net.Listener, containerAddress string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.log.Error().Str("handler", "publish").Err(err).Msg("")
+			}
+			return
+		}
+		go func() {
+			if err := p.handleTCP(conn, containerAddress); err != nil {
+				p.log.Error().Str("handler", "publish").Str("containerAddr", containerAddress).Err(err).Msg("")
+			}
+		}()
+	}
+}
+
+func (p *PortPublisher) handleTCP(conn net.Conn, containerAddress string) error {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), p.ConnectTimeout)
+	defer cancel()
+	dstConn, err := p.connector.DialContext(ctx, "tcp", containerAddress)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	return p.transporter.Transport(NewTimeoutConn(conn, p.TcpIOTimeout).WithLifetime(p.TcpLifetime),
+		NewTimeoutConn(dstConn, p.TcpIOTimeout).WithLifetime(p.TcpLifetime))
+}
+
+// serveUDP relays datagrams of each host client through its own container flow.
+func (p *PortPublisher) serveUDP(ln net.PacketConn, containerAddress string) {
+	flows := &publishedUDPFlows{flows: make(map[string]net.Conn)}
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, clientAddr, err := ln.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.log.Error().Str("handler", "publish").Err(err).Msg("")
+			}
+			flows.closeAll()
+			return
+		}
+		// the flow may expire right before the write, the datagram is sent through the new flow then
+		for attempt := 0; attempt < 2; attempt++ {
+			flow, err := p.udpFlow(ln, flows, clientAddr, containerAddress)
+			if errors.Is(err, errTooManyUDPFlows) {
+				p.log.Debug().Str("handler", "publish").Stringer("clientAddr", clientAddr).Err(err).Msg("")
+				break
+			}
+			if err != nil {
+				p.log.Error().Str("handler", "publish").Str("containerAddr", containerAddress).Err(err).Msg("")
+				break
+			}
+			if _, err = flow.Write(buf[:n]); err == nil {
+				break
+			}
+			p.log.Debug().Str("handler", "publish").Err(err).Msg("")
+			flows.remove(clientAddr.String(), flow)
+		}
+	}
+}
+
+// udpFlow returns the container flow of the host client, the new flow is dialed if the client has none.
+func (p *PortPublisher) udpFlow(ln net.PacketConn, flows *publishedUDPFlows,
+	clientAddr net.Addr, containerAddress string) (net.Conn, error) {
+	key := clientAddr.String()
+	flows.mu.Lock()
+	flow, ok := flows.flows[key]
+	full := len(flows.flows) >= p.MaxUdpFlows
+	flows.mu.Unlock()
+	if ok {
+		return flow, nil
+	}
+	if full {
+		return nil, errTooManyUDPFlows
+	}
+	flow, err := p.dialUDP(containerAddress)
+	if err != nil {
+		return nil, err
+	}
+	flows.mu.Lock()
+	flows.flows[key] = flow
+	flows.mu.Unlock()
+	go func() {
+		p.relayUDPReplies(ln, clientAddr, flow)
+		flows.remove(key, flow)
+	}()
+	return flow, nil
+}
+
+// publishedUDPFlows are container flows of host clients of the published UDP port.
+type publishedUDPFlows struct {
+	mu    sync.Mutex
+	flows map[string]net.Conn
+}
+
+// remove closes the flow and removes it unless it has been replaced already.
+func (f *publishedUDPFlows) remove(key string, flow net.Conn) {
+	f.mu.Lock()
+	if f.flows[key] == flow {
+		delete(f.flows, key)
+	}
+	f.mu.Unlock()
+	flow.Close()
+}
+
+func (f *publishedUDPFlows) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, flow := range f.flows {
+		flow.Close()
+	}
+}
+
+func (p *PortPublisher) dialUDP(containerAddress string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.ConnectTimeout)
+	defer cancel()
+	return p.connector.DialContext(ctx, "udp", containerAddress)
+}
+
+// relayUDPReplies sends container replies to the host client until the flow is idle or expires.
+func (p *PortPublisher) relayUDPReplies(ln net.PacketConn, clientAddr net.Addr, flow net.Conn) {
+	buf := make([]byte, maxUDPPacketSize)
+	flow = NewTimeoutConn(flow, p.UdpIOTimeout).WithLifetime(p.UdpLifetime)
+	for {
+		n, err := flow.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = ln.WriteTo(buf[:n], clientAddr); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package connect
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortPublisherTCP(t *testing.T) {
+	log := zerolog.Nop()
+	connector := newPipeConnector()
+	publisher := NewPortPublisher(&log, connector, NewTransporter(&log))
+	defer publisher.Close()
+	addr, err := publisher.Publish("tcp", "127.0.0.1:0", "10.1.1.1:80")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	require.Equal(t, "10.1.1.1:80", <-connector.addresses)
+	containerConn := <-connector.conns
+	buf := make([]byte, 4)
+	_, err = containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	_, err = containerConn.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+}
+
+func TestPortPublisherUDP(t *testing.T) {
+	log := zerolog.Nop()
+	connector := newPipeConnector()
+	publisher := NewPortPublisher(&log, connector, NewTransporter(&log))
+	defer publisher.Close()
+	addr, err := publisher.Publish("udp", "127.0.0.1:0", "10.1.1.1:53")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("query1"))
+	require.NoError(t, err)
+
+	require.Equal(t, "10.1.1.1:53", <-connector.addresses)
+	containerConn := <-connector.conns
+	buf := make([]byte, 16)
+	n, err := containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query1", string(buf[:n]))
+	_, err = containerConn.Write([]byte("reply1"))
+	require.NoError(t, err)
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "reply1", string(buf[:n]))
+
+	// datagrams of the same client share the container flow
+	_, err = conn.Write([]byte("query2"))
+	require.NoError(t, err)
+	n, err = containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query2", string(buf[:n]))
+	require.Empty(t, connector.addresses)
+}
+
+func TestPortPublisherUnsupportedNetwork(t *testing.T) {
+	log := zerolog.Nop()
+	publisher := NewPortPublisher(&log, newPipeConnector(), NewTransporter(&log))
+	_, err := publisher.Publish("sctp", "127.0.0.1:0", "10.1.1.1:80")
+	require.Error(t, err)
+}
+
+func TestPortPublisherUDPRedialsClosedFlow(t *testing.T) {
+	log := zerolog.Nop()
+	connector := newPipeConnector()
+	publisher := NewPortPublisher(&log, connector, NewTransporter(&log))
+	defer publisher.Close()
+	addr, err := publisher.Publish("udp", "127.0.0.1:0", "10.1.1.1:53")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("query1"))
+	require.NoError(t, err)
+	<-connector.addresses
+	containerConn := <-connector.conns
+	buf := make([]byte, 16)
+	require.NoError(t, containerConn.SetDeadline(time.Now().Add(5*time.Second)))
+	n, err := containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query1", string(buf[:n]))
+
+	// the datagram to the closed flow is sent through the new one
+	require.NoError(t, containerConn.Close())
+	_, err = conn.Write([]byte("query2"))
+	require.NoError(t, err)
+	require.Equal(t, "10.1.1.1:53", <-connector.addresses)
+	containerConn = <-connector.conns
+	require.NoError(t, containerConn.SetDeadline(time.Now().Add(5*time.Second)))
+	n, err = containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query2", string(buf[:n]))
+}
+
+func TestPortPublisherUDPMaxFlows(t *testing.T) {
+	log := zerolog.Nop()
+	connector := newPipeConnector()
+	publisher := NewPortPublisher(&log, connector, NewTransporter(&log))
+	publisher.MaxUdpFlows = 1
+	defer publisher.Close()
+	addr, err := publisher.Publish("udp", "127.0.0.1:0", "10.1.1.1:53")
+	require.NoError(t, err)
+
+	conn1, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	defer conn1.Close()
+	conn2, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	_, err = conn1.Write([]byte("query1"))
+	require.NoError(t, err)
+	<-connector.addresses
+	containerConn := <-connector.conns
+	require.NoError(t, containerConn.SetDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 16)
+	n, err := containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query1", string(buf[:n]))
+
+	// datagrams of other clients are dropped, datagrams are handled in order
+	_, err = conn2.Write([]byte("dropped"))
+	require.NoError(t, err)
+	_, err = conn1.Write([]byte("query2"))
+	require.NoError(t, err)
+	n, err = containerConn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query2", string(buf[:n]))
+	require.Empty(t, connector.addresses)
+}
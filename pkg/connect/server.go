@@ -1,10 +1,12 @@
 package connect
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"net"
+	"syscall"
 	"time"
 
 	"github.com/ginuerzh/gosocks5"
@@ -13,14 +15,59 @@ import (
 	"go.uber.org/multierr"
 )
 
-func NewSOCKS5ServerHandler(log *zerolog.Logger, socksTCPConn Connector, socksUDPConn Connector, transporter Transporter) server.Handler {
-	return &serverHandler{
+// ServerOption configures optional server handler settings.
+type ServerOption func(h *serverHandler)
+
+// WithUsers enables username/password authentication of clients and enforces user limits.
+func WithUsers(users *UserManager) ServerOption {
+	return func(h *serverHandler) {
+		h.users = users
+	}
+}
+
+// WithFlows registers relayed flows in the flow table.
+func WithFlows(flows *FlowTable) ServerOption {
+	return func(h *serverHandler) {
+		h.flows = flows
+	}
+}
+
+// WithTimeouts overrides default connect timeout, idle timeouts and lifetimes of relayed flows.
+func WithTimeouts(timeouts Timeouts) ServerOption {
+	return func(h *serverHandler) {
+		h.connectTimeout = timeouts.Connect
+		h.tcpIOTimeout = timeouts.TCPIdle
+		h.udpIOTimeout = timeouts.UDPIdle
+		h.tcpLifetime = timeouts.TCPLifetime
+		h.udpLifetime = timeouts.UDPLifetime
+	}
+}
+
+func NewSOCKS5ServerHandler(log *zerolog.Logger, socksTCPConn Connector, socksUDPConn Connector, transporter Transporter,
+	opts ...ServerOption) server.Handler {
+	return newServerHandler(log, socksTCPConn, socksUDPConn, transporter, opts...)
+}
+
+// NewServerHandler returns a handler that detects the proxy protocol by the first byte
+// of the connection and serves SOCKS5, SOCKS4/4a and HTTP proxy requests.
+func NewServerHandler(log *zerolog.Logger, socksTCPConn Connector, socksUDPConn Connector, transporter Transporter,
+	opts ...ServerOption) server.Handler {
+	return &sniffingServerHandler{newServerHandler(log, socksTCPConn, socksUDPConn, transporter, opts...)}
+}
+
+func newServerHandler(log *zerolog.Logger, socksTCPConn Connector, socksUDPConn Connector, transporter Transporter,
+	opts ...ServerOption) *serverHandler {
+	h := &serverHandler{
 		log: log, selector: server.DefaultSelector,
 		socksTCPConn: socksTCPConn, socksUDPConn: socksUDPConn, transporter: transporter,
 		tcpIOTimeout:   tcpIOTimeout,
 		udpIOTimeout:   udpIOTimeout,
 		connectTimeout: connectTimeout,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 type serverHandler struct {
@@ -32,6 +79,12 @@ type serverHandler struct {
 	tcpIOTimeout   time.Duration
 	udpIOTimeout   time.Duration
 	connectTimeout time.Duration
+	// flow lifetimes, zero means no limit
+	tcpLifetime time.Duration
+	udpLifetime time.Duration
+	// users is nil if authentication is disabled
+	users *UserManager
+	flows *FlowTable
 }
 
 func (h *serverHandler) Handle(conn net.Conn) (err error) {
@@ -40,29 +93,46 @@ func (h *serverHandler) Handle(conn net.Conn) (err error) {
 			h.log.Error().Err(err).Msg("")
 		}
 	}()
-	conn = gosocks5.ServerConn(conn, h.selector)
+	return h.handleSOCKS5(conn)
+}
+
+func (h *serverHandler) handleSOCKS5(conn net.Conn) error {
+	selector := h.selector
+	var userSel *userSelector
+	if h.users != nil {
+		userSel = &userSelector{users: h.users}
+		selector = userSel
+	}
+	conn = newSOCKSConn(gosocks5.ServerConn(conn, selector), conn)
 	defer conn.Close()
 	req, err := gosocks5.ReadRequest(conn)
 	if err != nil {
 		return err
 	}
 
+	var user *userState
+	if userSel != nil {
+		user = userSel.user
+		if err = h.users.checkQuota(user); err != nil {
+			return multierr.Append(fmt.Errorf("user %s: %w", user.Name, err),
+				gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn))
+		}
+	}
+
 	switch req.Cmd {
 	case gosocks5.CmdConnect:
-		return h.handleConnect(conn, req)
+		return h.handleConnect(conn, req, user)
 	case gosocks5.CmdUdp:
-		return h.handleUDPAssociate(conn, req)
+		return h.handleUDPAssociate(conn, req, user)
 	default:
 		return fmt.Errorf("%d: unsupported command", gosocks5.CmdUnsupported)
 	}
 }
 
-func (h *serverHandler) handleConnect(localConn net.Conn, req *gosocks5.Request) error {
-	ctx, cancel := context.WithTimeout(context.Background(), h.connectTimeout)
-	defer cancel()
-	dstConn, err := h.socksTCPConn.DialContext(ctx, "tcp", req.Addr.String())
+func (h *serverHandler) handleConnect(localConn net.Conn, req *gosocks5.Request, user *userState) error {
+	dstConn, err := h.dialTCP(req.Addr.String())
 	if err != nil {
-		return multierr.Append(err, gosocks5.NewReply(gosocks5.HostUnreachable, nil).Write(localConn))
+		return multierr.Append(err, gosocks5.NewReply(connectReply(err), nil).Write(localConn))
 	}
 	defer dstConn.Close()
 
@@ -70,23 +140,50 @@ func (h *serverHandler) handleConnect(localConn net.Conn, req *gosocks5.Request)
 	if err := rep.Write(localConn); err != nil {
 		return err
 	}
+	return h.relayTCP(localConn, dstConn, req.Addr.String(), user)
+}
 
-	localConn = NewTimeoutConn(localConn, h.tcpIOTimeout)
-	dstConn = NewTimeoutConn(dstConn, h.tcpIOTimeout)
-	return h.transporter.Transport(localConn, dstConn)
+// connectReply returns the SOCKS5 reply to the failed connect, replies of upstream proxies are passed through,
+// so that clients can tell refused connections from unreachable networks.
+func connectReply(err error) uint8 {
+	var replyErr *SOCKSReplyError
+	switch {
+	case errors.As(err, &replyErr):
+		return replyErr.Reply
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return gosocks5.ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return gosocks5.NetUnreachable
+	}
+	return gosocks5.HostUnreachable
 }
 
-func (h *serverHandler) handleUDPAssociate(localConn net.Conn, req *gosocks5.Request) error {
+func (h *serverHandler) dialTCP(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.connectTimeout)
+	defer cancel()
+	return h.socksTCPConn.DialContext(ctx, "tcp", address)
+}
 
-	localHost, _, err := net.SplitHostPort(localConn.LocalAddr().String())
-	if err != nil {
-		return err
+// relayTCP relays the client connection of the authenticated user (nil if authentication is disabled)
+func (h *serverHandler) relayTCP(localConn, dstConn net.Conn, address string, user *userState) error {
+	if user != nil {
+		localConn = h.users.newConn(localConn, user)
 	}
-	listenAddr, err := net.ResolveUDPAddr("udp", localHost+":")
-	if err != nil {
-		return err
+	// the wrapped connection is closed to interrupt relays waiting for user limits
+	defer h.flows.Add(h.newFlow("tcp", localConn, address, user), localConn, dstConn)()
+	localConn = NewTimeoutConn(localConn, h.tcpIOTimeout).WithLifetime(h.tcpLifetime)
+	dstConn = NewTimeoutConn(dstConn, h.tcpIOTimeout).WithLifetime(h.tcpLifetime)
+	return h.transporter.Transport(localConn, dstConn)
+}
+
+func (h *serverHandler) handleUDPAssociate(localConn net.Conn, req *gosocks5.Request, user *userState) error {
+	// the UDP relay listens on the address of the TCP listener, unix listeners have no IP address
+	localAddr, ok := localConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return multierr.Append(fmt.Errorf("udp associate is not supported on %s listeners", localConn.LocalAddr().Network()),
+			gosocks5.NewReply(gosocks5.CmdUnsupported, nil).Write(localConn))
 	}
-	listenConn, err := net.ListenUDP("udp", listenAddr)
+	listenConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
 	if err != nil {
 		return err
 	}
@@ -105,6 +202,16 @@ func (h *serverHandler) handleUDPAssociate(localConn net.Conn, req *gosocks5.Req
 	if err != nil {
 		return err
 	}
+	// the first datagram is relayed like the following ones, so that it is accounted to the user
+	var localUDPConn net.Conn = &firstConnectUDPConn{
+		UDPConn:    listenConn,
+		targetAddr: sourceAddr,
+		first:      append([]byte(nil), buf[:n]...),
+	}
+	trPool.Put(buf) //nolint:staticcheck
+	if user != nil {
+		localUDPConn = h.users.newConn(localUDPConn, user)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), h.connectTimeout)
 	defer cancel()
@@ -116,23 +223,33 @@ func (h *serverHandler) handleUDPAssociate(localConn net.Conn, req *gosocks5.Req
 	if err != nil {
 		return err
 	}
-	dstConn = NewTimeoutConn(dstConn, h.udpIOTimeout)
-	if _, err = dstConn.Write(buf[:n]); err != nil {
-		return err
-	}
-	trPool.Put(buf) //nolint:staticcheck
+	dstConn = NewTimeoutConn(dstConn, h.udpIOTimeout).WithLifetime(h.udpLifetime)
 
-	localUDPConn := &firstConnectUDPConn{UDPConn: listenConn, targetAddr: sourceAddr}
-	localConn = NewTimeoutConn(localConn, h.udpIOTimeout)
+	// datagrams of the association may be sent to any destination
+	defer h.flows.Add(h.newFlow("udp", localConn, "*", user), localConn, localUDPConn, dstConn)()
 	return h.transporter.Transport(localUDPConn, dstConn)
 }
 
+func (h *serverHandler) newFlow(network string, localConn net.Conn, address string, user *userState) Flow {
+	flow := Flow{Network: network, Source: addrString(localConn.RemoteAddr()), Destination: address}
+	if user != nil {
+		flow.User = user.Name
+	}
+	return flow
+}
+
 type firstConnectUDPConn struct {
 	*net.UDPConn
 	targetAddr *net.UDPAddr
+	// first is the already received datagram returned by the first read
+	first []byte
 }
 
 func (c *firstConnectUDPConn) Read(b []byte) (n int, err error) {
+	if c.first != nil {
+		n, c.first = copy(b, c.first), nil
+		return
+	}
 	n, addr, err := c.UDPConn.ReadFromUDP(b)
 	if err != nil {
 		return
@@ -146,3 +263,53 @@ func (c *firstConnectUDPConn) Read(b []byte) (n int, err error) {
 func (c *firstConnectUDPConn) Write(b []byte) (n int, err error) {
 	return c.UDPConn.WriteToUDP(b, c.targetAddr)
 }
+
+// sniffingServerHandler serves several proxy protocols on the same listener.
+type sniffingServerHandler struct {
+	*serverHandler
+}
+
+func (h *sniffingServerHandler) Handle(conn net.Conn) (err error) {
+	defer func() {
+		if err != nil {
+			h.log.Error().Err(err).Msg("")
+		}
+	}()
+	bconn := newBufferedConn(conn)
+	version, err := bconn.Peek(1)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	switch version[0] {
+	case gosocks5.Ver5:
+		return h.handleSOCKS5(bconn)
+	case socks4Version:
+		return h.handleSOCKS4(bconn)
+	default:
+		return h.handleHTTP(bconn)
+	}
+}
+
+// bufferedConn is a net.Conn that allows to peek at the first bytes without consuming them.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,124 @@
+package connect
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/ginuerzh/gosocks5"
+	"go.uber.org/multierr"
+)
+
+// hopHeaders are removed from plain HTTP requests before forwarding them to the destination server.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+func (h *serverHandler) handleHTTP(conn *bufferedConn) error {
+	defer conn.Close()
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return err
+	}
+	user, err := h.authenticateHTTP(conn, req)
+	if err != nil {
+		return err
+	}
+	if req.Method == http.MethodConnect {
+		return h.handleHTTPConnect(conn, req, user)
+	}
+	return h.handleHTTPForward(conn, req, user)
+}
+
+// authenticateHTTP checks proxy basic authentication credentials of the request, if authentication is enabled.
+func (h *serverHandler) authenticateHTTP(conn net.Conn, req *http.Request) (*userState, error) {
+	if h.users == nil {
+		return nil, nil
+	}
+	// reuse basic auth parsing of the Authorization header
+	authReq := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	username, password, ok := authReq.BasicAuth()
+	var user *userState
+	if ok {
+		user = h.users.authenticate(username, password)
+	}
+	if user == nil {
+		return nil, multierr.Append(gosocks5.ErrAuthFailure,
+			writeHTTPStatus(conn, req, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="wirez"`}}))
+	}
+	if err := h.users.checkQuota(user); err != nil {
+		return nil, multierr.Append(fmt.Errorf("user %s: %w", user.Name, err),
+			writeHTTPStatus(conn, req, http.StatusForbidden, nil))
+	}
+	return user, nil
+}
+
+func (h *serverHandler) handleHTTPConnect(conn net.Conn, req *http.Request, user *userState) error {
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return multierr.Append(err, writeHTTPStatus(conn, req, http.StatusBadRequest, nil))
+	}
+	dstConn, err := h.dialTCP(address)
+	if err != nil {
+		return multierr.Append(err, writeHTTPStatus(conn, req, http.StatusBadGateway, nil))
+	}
+	defer dstConn.Close()
+
+	if _, err = fmt.Fprintf(conn, "HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor); err != nil {
+		return err
+	}
+	return h.relayTCP(conn, dstConn, address, user)
+}
+
+// handleHTTPForward serves plain HTTP proxy requests with an absolute URI. Only one request
+// is forwarded per client connection, the destination server is asked to close the connection
+// after the response.
+func (h *serverHandler) handleHTTPForward(conn net.Conn, req *http.Request, user *userState) error {
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" || req.URL.Host == "" {
+		return multierr.Append(fmt.Errorf("invalid proxy request uri %s", req.RequestURI),
+			writeHTTPStatus(conn, req, http.StatusBadRequest, nil))
+	}
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		address = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	dstConn, err := h.dialTCP(address)
+	if err != nil {
+		return multierr.Append(err, writeHTTPStatus(conn, req, http.StatusBadGateway, nil))
+	}
+	defer dstConn.Close()
+
+	for _, header := range hopHeaders {
+		req.Header.Del(header)
+	}
+	req.Close = true
+	// the request body is uploaded by the user too
+	var reqWriter io.Writer = dstConn
+	if user != nil {
+		reqWriter = h.users.newConn(dstConn, user)
+	}
+	if err = req.Write(reqWriter); err != nil {
+		return err
+	}
+	return h.relayTCP(conn, dstConn, address, user)
+}
+
+func writeHTTPStatus(w io.Writer, req *http.Request, statusCode int, header http.Header) error {
+	resp := &http.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Request:    req,
+		Close:      true,
+	}
+	return resp.Write(w)
+}
@@ -0,0 +1,135 @@
+package connect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"go.uber.org/multierr"
+)
+
+const (
+	socks4Version      = 4
+	socks4ReplyVersion = 0
+
+	socks4CmdConnect = 1
+
+	socks4Granted  = 90
+	socks4Rejected = 91
+
+	// maxSocks4FieldLength limits the length of USERID and hostname fields
+	maxSocks4FieldLength = 255
+)
+
+var errSocks4FieldTooLong = errors.New("socks4 request field is too long")
+
+/*
+SOCKS4 request
+
+	+----+----+----+----+----+----+----+----+----+----+....+----+
+	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	+----+----+----+----+----+----+----+----+----+----+....+----+
+	   1    1      2              4           variable       1
+
+SOCKS4a extends the request with a hostname if DSTIP is 0.0.0.x (x != 0)
+
+	+----+....+----+
+	| HOSTNAME |NULL|
+	+----+....+----+
+*/
+type socks4Request struct {
+	Cmd    uint8
+	Port   uint16
+	IP     net.IP
+	UserID string
+	Host   string
+}
+
+func readSOCKS4Request(r *bufio.Reader) (*socks4Request, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("invalid socks4 version %d", header[0])
+	}
+	req := &socks4Request{
+		Cmd:  header[1],
+		Port: binary.BigEndian.Uint16(header[2:4]),
+		IP:   net.IPv4(header[4], header[5], header[6], header[7]).To4(),
+	}
+	var err error
+	if req.UserID, err = readSOCKS4String(r); err != nil {
+		return nil, err
+	}
+	if req.IP[0] == 0 && req.IP[1] == 0 && req.IP[2] == 0 && req.IP[3] != 0 {
+		if req.Host, err = readSOCKS4String(r); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func readSOCKS4String(r *bufio.Reader) (string, error) {
+	var result []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(result), nil
+		}
+		if len(result) >= maxSocks4FieldLength {
+			return "", errSocks4FieldTooLong
+		}
+		result = append(result, b)
+	}
+}
+
+// Address returns the destination address of the request in host:port format.
+func (r *socks4Request) Address() string {
+	host := r.Host
+	if host == "" {
+		host = r.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+}
+
+func writeSOCKS4Reply(w io.Writer, code uint8) error {
+	reply := [8]byte{socks4ReplyVersion, code}
+	_, err := w.Write(reply[:])
+	return err
+}
+
+func (h *serverHandler) handleSOCKS4(conn *bufferedConn) error {
+	defer conn.Close()
+	req, err := readSOCKS4Request(conn.r)
+	if err != nil {
+		return err
+	}
+	// SOCKS4 has no password authentication
+	if h.users != nil {
+		return multierr.Append(errors.New("socks4 is not allowed with user authentication"),
+			writeSOCKS4Reply(conn, socks4Rejected))
+	}
+	if req.Cmd != socks4CmdConnect {
+		return multierr.Append(fmt.Errorf("%d: unsupported socks4 command", req.Cmd),
+			writeSOCKS4Reply(conn, socks4Rejected))
+	}
+
+	dstConn, err := h.dialTCP(req.Address())
+	if err != nil {
+		return multierr.Append(err, writeSOCKS4Reply(conn, socks4Rejected))
+	}
+	defer dstConn.Close()
+
+	if err = writeSOCKS4Reply(conn, socks4Granted); err != nil {
+		return err
+	}
+	return h.relayTCP(conn, dstConn, req.Address(), nil)
+}
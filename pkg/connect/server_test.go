@@ -0,0 +1,234 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+type pipeConnector struct {
+	addresses chan string
+	conns     chan net.Conn
+	err       error
+}
+
+func newPipeConnector() *pipeConnector {
+	return &pipeConnector{addresses: make(chan string, 1), conns: make(chan net.Conn, 1)}
+}
+
+func (c *pipeConnector) DialContext(_ context.Context, _, address string) (net.Conn, error) {
+	c.addresses <- address
+	if c.err != nil {
+		return nil, c.err
+	}
+	conn1, conn2 := net.Pipe()
+	c.conns <- conn2
+	return conn1, nil
+}
+
+func startServerHandler(t *testing.T, connector Connector) net.Conn {
+	t.Helper()
+	log := zerolog.Nop()
+	h := NewServerHandler(&log, connector, connector, NewTransporter(&log))
+	clientConn, serverConn := net.Pipe()
+	go h.Handle(serverConn) //nolint:errcheck
+	t.Cleanup(func() { clientConn.Close() })
+	return clientConn
+}
+
+func requireEcho(t *testing.T, clientConn io.ReadWriter, dstConn io.ReadWriter) {
+	t.Helper()
+	go func() {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(dstConn, buf); err == nil {
+			dstConn.Write(buf) //nolint:errcheck
+		}
+	}()
+	_, err := clientConn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(clientConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+}
+
+func TestServerHandlerSOCKS5(t *testing.T) {
+	connector := newPipeConnector()
+	conn := startServerHandler(t, connector)
+
+	go conn.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodNoAuth}) //nolint:errcheck
+	br := bufio.NewReader(conn)
+	method := make([]byte, 2)
+	_, err := io.ReadFull(br, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{gosocks5.Ver5, gosocks5.MethodNoAuth}, method)
+
+	req := gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{
+		Type: gosocks5.AddrDomain, Host: "example.com", Port: 80})
+	go req.Write(conn) //nolint:errcheck
+	reply, err := gosocks5.ReadReply(br)
+	require.NoError(t, err)
+	require.Equal(t, uint8(gosocks5.Succeeded), reply.Rep)
+
+	require.Equal(t, "example.com:80", <-connector.addresses)
+	dstConn := <-connector.conns
+
+	requireEcho(t, &bufferedConn{Conn: conn, r: br}, dstConn)
+}
+
+func TestServerHandlerSOCKS5Rejected(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectedReply uint8
+	}{
+		{name: "UpstreamReply", err: &SOCKSReplyError{Address: "example.com:80", Reply: gosocks5.NetUnreachable},
+			expectedReply: gosocks5.NetUnreachable},
+		{name: "ConnectionRefused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+			expectedReply: gosocks5.ConnRefused},
+		{name: "OtherError", err: errors.New("unreachable"), expectedReply: gosocks5.HostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector := newPipeConnector()
+			connector.err = tt.err
+			conn := startServerHandler(t, connector)
+
+			go conn.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodNoAuth}) //nolint:errcheck
+			br := bufio.NewReader(conn)
+			method := make([]byte, 2)
+			_, err := io.ReadFull(br, method)
+			require.NoError(t, err)
+
+			req := gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{
+				Type: gosocks5.AddrDomain, Host: "example.com", Port: 80})
+			go req.Write(conn) //nolint:errcheck
+			<-connector.addresses
+			reply, err := gosocks5.ReadReply(br)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedReply, reply.Rep)
+		})
+	}
+}
+
+func TestServerHandlerSOCKS5UDPAssociateUnsupported(t *testing.T) {
+	// the pipe listener has no IP address to bind the UDP relay to, like unix listeners
+	conn := startServerHandler(t, newPipeConnector())
+
+	go conn.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodNoAuth}) //nolint:errcheck
+	br := bufio.NewReader(conn)
+	method := make([]byte, 2)
+	_, err := io.ReadFull(br, method)
+	require.NoError(t, err)
+
+	req := gosocks5.NewRequest(gosocks5.CmdUdp, &gosocks5.Addr{Type: gosocks5.AddrIPv4})
+	go req.Write(conn) //nolint:errcheck
+	reply, err := gosocks5.ReadReply(br)
+	require.NoError(t, err)
+	require.Equal(t, uint8(gosocks5.CmdUnsupported), reply.Rep)
+}
+
+func TestServerHandlerSOCKS4(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  []byte
+		expected string
+	}{
+		{
+			name:     "SOCKS4",
+			request:  []byte{4, 1, 0, 80, 1, 2, 3, 4, 'u', 0},
+			expected: "1.2.3.4:80",
+		},
+		{
+			name:     "SOCKS4a",
+			request:  append([]byte{4, 1, 0x1, 0xbb, 0, 0, 0, 1, 0}, []byte("example.com\x00")...),
+			expected: "example.com:443",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector := newPipeConnector()
+			conn := startServerHandler(t, connector)
+
+			go conn.Write(tt.request) //nolint:errcheck
+			require.Equal(t, tt.expected, <-connector.addresses)
+			dstConn := <-connector.conns
+
+			reply := make([]byte, 8)
+			_, err := io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			require.Equal(t, []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}, reply)
+
+			requireEcho(t, conn, dstConn)
+		})
+	}
+}
+
+func TestServerHandlerSOCKS4Rejected(t *testing.T) {
+	connector := newPipeConnector()
+	connector.err = errors.New("unreachable")
+	conn := startServerHandler(t, connector)
+
+	go conn.Write([]byte{4, 1, 0, 80, 1, 2, 3, 4, 0}) //nolint:errcheck
+	<-connector.addresses
+
+	reply := make([]byte, 8)
+	_, err := io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, uint8(socks4Rejected), reply[1])
+}
+
+func TestServerHandlerHTTPConnect(t *testing.T) {
+	connector := newPipeConnector()
+	conn := startServerHandler(t, connector)
+
+	go conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")) //nolint:errcheck
+	require.Equal(t, "example.com:443", <-connector.addresses)
+	dstConn := <-connector.conns
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	requireEcho(t, &bufferedConn{Conn: conn, r: br}, dstConn)
+}
+
+func TestServerHandlerHTTPForward(t *testing.T) {
+	connector := newPipeConnector()
+	conn := startServerHandler(t, connector)
+
+	go conn.Write([]byte("GET http://example.com/index.html HTTP/1.1\r\n" + //nolint:errcheck
+		"Host: example.com\r\nProxy-Connection: keep-alive\r\n\r\n"))
+	require.Equal(t, "example.com:80", <-connector.addresses)
+	dstConn := <-connector.conns
+
+	req, err := http.ReadRequest(bufio.NewReader(dstConn))
+	require.NoError(t, err)
+	require.Equal(t, "/index.html", req.RequestURI)
+	require.Equal(t, "example.com", req.Host)
+	require.Empty(t, req.Header.Get("Proxy-Connection"))
+	require.True(t, req.Close)
+}
+
+func TestServerHandlerHTTPForwardBadGateway(t *testing.T) {
+	connector := newPipeConnector()
+	connector.err = errors.New("unreachable")
+	conn := startServerHandler(t, connector)
+
+	go conn.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")) //nolint:errcheck
+	<-connector.addresses
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
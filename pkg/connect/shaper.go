@@ -0,0 +1,137 @@
+package connect
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit describes bandwidth limits in bytes per second, zero values mean unlimited.
+type RateLimit struct {
+	Upload   int64
+	Download int64
+}
+
+// ShapingRule overrides the default rate limit for flows to the destination network.
+type ShapingRule struct {
+	Destination *net.IPNet
+	Limit       RateLimit
+}
+
+// DestinationTransporter is implemented by transporters that apply per-destination settings.
+type DestinationTransporter interface {
+	Transporter
+	// ForDestination returns the transporter for flows to the given destination address.
+	ForDestination(network, address string) Transporter
+}
+
+// NewShapingTransporter returns a transporter that limits the aggregate bandwidth of all flows.
+// Flows to destinations matching one of the rules share the limit of the first matching rule instead.
+// Upload is the direction from the first relayed connection to the second one.
+func NewShapingTransporter(transporter Transporter, limit RateLimit, rules []*ShapingRule) DestinationTransporter {
+	t := &shapingTransporter{
+		transporter: transporter,
+		limiters:    newFlowLimiters(limit),
+		rules:       make([]*shapingRuleLimiters, 0, len(rules)),
+	}
+	for _, rule := range rules {
+		t.rules = append(t.rules, &shapingRuleLimiters{
+			destination: rule.Destination,
+			limiters:    newFlowLimiters(rule.Limit),
+		})
+	}
+	return t
+}
+
+type shapingTransporter struct {
+	transporter Transporter
+	limiters    *flowLimiters
+	rules       []*shapingRuleLimiters
+}
+
+type shapingRuleLimiters struct {
+	destination *net.IPNet
+	limiters    *flowLimiters
+}
+
+type flowLimiters struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func newFlowLimiters(limit RateLimit) *flowLimiters {
+	return &flowLimiters{
+		upload:   newByteLimiter(limit.Upload),
+		download: newByteLimiter(limit.Download),
+	}
+}
+
+func (t *shapingTransporter) Transport(rw1, rw2 io.ReadWriter) error {
+	return t.limiters.transport(t.transporter, rw1, rw2)
+}
+
+func (t *shapingTransporter) ForDestination(_, address string) Transporter {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return t
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return t
+	}
+	for _, rule := range t.rules {
+		if rule.destination.Contains(ip) {
+			return &boundShapingTransporter{transporter: t.transporter, limiters: rule.limiters}
+		}
+	}
+	return t
+}
+
+// boundShapingTransporter applies limiters of the matched shaping rule.
+type boundShapingTransporter struct {
+	transporter Transporter
+	limiters    *flowLimiters
+}
+
+func (t *boundShapingTransporter) Transport(rw1, rw2 io.ReadWriter) error {
+	return t.limiters.transport(t.transporter, rw1, rw2)
+}
+
+func (l *flowLimiters) transport(transporter Transporter, rw1, rw2 io.ReadWriter) error {
+	// the relay that is still waiting for the limiter stops with the flow
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if l.upload != nil {
+		rw1 = &shapedReadWriter{ReadWriter: rw1, limiter: l.upload, ctx: ctx}
+	}
+	if l.download != nil {
+		rw2 = &shapedReadWriter{ReadWriter: rw2, limiter: l.download, ctx: ctx}
+	}
+	return transporter.Transport(rw1, rw2)
+}
+
+// shapedReadWriter delays subsequent reads until the limiter allows the bytes that have been read.
+type shapedReadWriter struct {
+	io.ReadWriter
+	limiter *rate.Limiter
+	// ctx is canceled when the flow is done
+	ctx context.Context
+}
+
+func (rw *shapedReadWriter) CloseWrite() error {
+	return closeWrite(rw.ReadWriter)
+}
+
+func (rw *shapedReadWriter) Read(b []byte) (n int, err error) {
+	if n, err = rw.ReadWriter.Read(b); n > 0 {
+		if werr := waitBytes(rw.ctx, n, rw.limiter); werr != nil {
+			if rw.ctx.Err() != nil {
+				werr = net.ErrClosed
+			}
+			return n, werr
+		}
+	}
+	return
+}
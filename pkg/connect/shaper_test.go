@@ -0,0 +1,88 @@
+package connect
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShapingTransporterForDestination(t *testing.T) {
+	log := zerolog.Nop()
+	_, intranet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	tr := NewShapingTransporter(NewTransporter(&log), RateLimit{Upload: 1 << 20},
+		[]*ShapingRule{{Destination: intranet, Limit: RateLimit{Download: 1 << 10}}}).(*shapingTransporter)
+
+	require.Same(t, tr, tr.ForDestination("tcp", "1.1.1.1:80"))
+	require.Same(t, tr, tr.ForDestination("tcp", "example.com:80"))
+
+	bound, ok := tr.ForDestination("udp", "10.1.2.3:53").(*boundShapingTransporter)
+	require.True(t, ok)
+	require.Nil(t, bound.limiters.upload)
+	require.NotNil(t, bound.limiters.download)
+	// flows to the same rule share limiters
+	require.Same(t, bound.limiters, tr.ForDestination("tcp", "10.3.2.1:80").(*boundShapingTransporter).limiters)
+}
+
+type halfReadWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestShapingTransporterLimitsBandwidth(t *testing.T) {
+	log := zerolog.Nop()
+	const limit = minLimiterBurst
+	tr := NewShapingTransporter(NewTransporter(&log), RateLimit{Upload: limit}, nil)
+
+	upload := &bytes.Buffer{}
+	data := make([]byte, 2*limit)
+	start := time.Now()
+	err := tr.Transport(
+		&halfReadWriter{Reader: bytes.NewReader(data), Writer: io.Discard},
+		&halfReadWriter{Reader: &blockingReader{}, Writer: upload})
+	require.NoError(t, err)
+	require.Equal(t, len(data), upload.Len())
+	// the first half is allowed by the burst, the second one is delayed
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestShapingTransporterStopsWaitingRelay(t *testing.T) {
+	log := zerolog.Nop()
+	tr := NewShapingTransporter(NewTransporter(&log), RateLimit{Upload: 1}, nil)
+
+	uploaded := make(chan struct{})
+	// the download ends right away, while the upload waits for hours at the limit
+	err := tr.Transport(
+		&halfReadWriter{Reader: bytes.NewReader(make([]byte, 4*minLimiterBurst)), Writer: io.Discard},
+		&halfReadWriter{Reader: bytes.NewReader(nil), Writer: &notifyWriter{written: uploaded}})
+	require.NoError(t, err)
+	select {
+	case <-uploaded:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "upload relay still waits for the limiter")
+	}
+}
+
+// notifyWriter closes the channel on the first write
+type notifyWriter struct {
+	written chan struct{}
+	once    sync.Once
+}
+
+func (w *notifyWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { close(w.written) })
+	return len(b), nil
+}
+
+// blockingReader never returns any data
+type blockingReader struct{}
+
+func (*blockingReader) Read([]byte) (int, error) {
+	select {}
+}
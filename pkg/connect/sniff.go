@@ -0,0 +1,239 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// sniffTimeout is the default time to wait for the first bytes of a TCP flow.
+	// Protocols where the server speaks first are delayed by this timeout.
+	sniffTimeout = 500 * time.Millisecond
+	// sniffMaxBytes limits the amount of data buffered while sniffing.
+	sniffMaxBytes = 16 << 10
+)
+
+var (
+	errSniffIncomplete = errors.New("incomplete data")
+	errSniffNoHostname = errors.New("no hostname")
+)
+
+type hostnameContextKey struct{}
+
+// withDestinationHostname returns a copy of ctx with the hostname of the destination address.
+func withDestinationHostname(ctx context.Context, hostname string) context.Context {
+	return context.WithValue(ctx, hostnameContextKey{}, hostname)
+}
+
+// destinationHostname returns the hostname of the destination address if it is known.
+func destinationHostname(ctx context.Context) string {
+	hostname, _ := ctx.Value(hostnameContextKey{}).(string)
+	return hostname
+}
+
+// sniffHostname peeks at the first bytes sent by the client and extracts the destination
+// hostname from the TLS ClientHello SNI extension or the HTTP/1 Host header. The returned
+// connection replays the peeked bytes unchanged.
+func sniffHostname(conn net.Conn, timeout time.Duration) (hostname string, _ net.Conn, err error) {
+	br := bufio.NewReaderSize(conn, sniffMaxBytes)
+	bconn := &bufferedConn{Conn: conn, r: br}
+	if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	for n := 1; n <= sniffMaxBytes; n = br.Buffered() + 1 {
+		// read errors are returned to the client later with the replayed bytes
+		data, perr := br.Peek(n)
+		if hostname, err = parseHostname(data); !errors.Is(err, errSniffIncomplete) || perr != nil {
+			break
+		}
+	}
+	return hostname, bconn, conn.SetReadDeadline(time.Time{})
+}
+
+func parseHostname(data []byte) (hostname string, err error) {
+	if len(data) == 0 {
+		return "", errSniffIncomplete
+	}
+	if data[0] == tlsRecordTypeHandshake {
+		hostname, err = parseTLSServerName(data)
+	} else {
+		hostname, err = parseHTTPHost(data)
+	}
+	if err != nil {
+		return
+	}
+	if !validHostname(hostname) {
+		return "", errSniffNoHostname
+	}
+	return
+}
+
+// validHostname rejects IP literals and names that can't be sent as a SOCKS5 domain address.
+func validHostname(hostname string) bool {
+	if hostname == "" || len(hostname) > 255 || net.ParseIP(hostname) != nil {
+		return false
+	}
+	for i := 0; i < len(hostname); i++ {
+		if c := hostname[i]; c <= ' ' || c >= 0x7f || c == '/' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	tlsRecordTypeHandshake      = 22
+	tlsHandshakeTypeClientHello = 1
+	tlsExtensionServerName      = 0
+	tlsServerNameTypeHostName   = 0
+)
+
+// parseTLSServerName extracts the server name from the TLS ClientHello message
+// that may span several handshake records.
+func parseTLSServerName(data []byte) (string, error) {
+	var handshake []byte
+	for {
+		if len(data) < 5 {
+			return "", errSniffIncomplete
+		}
+		if data[0] != tlsRecordTypeHandshake || data[1] != 3 {
+			return "", errSniffNoHostname
+		}
+		recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+recordLen {
+			return "", errSniffIncomplete
+		}
+		handshake = append(handshake, data[5:5+recordLen]...)
+		data = data[5+recordLen:]
+		if len(handshake) < 4 {
+			continue
+		}
+		if handshake[0] != tlsHandshakeTypeClientHello {
+			return "", errSniffNoHostname
+		}
+		msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if len(handshake) >= 4+msgLen {
+			return parseClientHelloServerName(handshake[4 : 4+msgLen])
+		}
+	}
+}
+
+func parseClientHelloServerName(msg []byte) (string, error) {
+	r := &byteCursor{data: msg}
+	// legacy version and random
+	r.skip(2 + 32)
+	// session id, cipher suites and compression methods
+	r.skip(int(r.uint8()))
+	r.skip(int(r.uint16()))
+	r.skip(int(r.uint8()))
+	extensions := &byteCursor{data: r.bytes(int(r.uint16()))}
+	for r.err == nil && extensions.err == nil && len(extensions.data) > 0 {
+		extType := extensions.uint16()
+		ext := &byteCursor{data: extensions.bytes(int(extensions.uint16()))}
+		if extType != tlsExtensionServerName {
+			continue
+		}
+		names := &byteCursor{data: ext.bytes(int(ext.uint16()))}
+		for names.err == nil && len(names.data) > 0 {
+			nameType := names.uint8()
+			name := names.bytes(int(names.uint16()))
+			if names.err == nil && nameType == tlsServerNameTypeHostName {
+				return string(name), nil
+			}
+		}
+	}
+	return "", errSniffNoHostname
+}
+
+// byteCursor reads big-endian fields and remembers the first out of bounds error.
+type byteCursor struct {
+	data []byte
+	err  error
+}
+
+func (c *byteCursor) bytes(n int) []byte {
+	if c.err != nil || len(c.data) < n {
+		c.err = errSniffNoHostname
+		c.data = nil
+		return nil
+	}
+	b := c.data[:n]
+	c.data = c.data[n:]
+	return b
+}
+
+func (c *byteCursor) skip(n int) {
+	c.bytes(n)
+}
+
+func (c *byteCursor) uint8() uint8 {
+	if b := c.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (c *byteCursor) uint16() uint16 {
+	if b := c.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// parseHTTPHost extracts the hostname from the Host header of the HTTP/1 request.
+func parseHTTPHost(data []byte) (string, error) {
+	if !hasHTTPMethod(data) {
+		return "", errSniffNoHostname
+	}
+	// skip the request line
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	if lineEnd < 0 {
+		return "", errSniffIncomplete
+	}
+	data = data[lineEnd+2:]
+	for {
+		lineEnd = bytes.Index(data, []byte("\r\n"))
+		if lineEnd < 0 {
+			return "", errSniffIncomplete
+		}
+		line := string(data[:lineEnd])
+		data = data[lineEnd+2:]
+		if line == "" {
+			return "", errSniffNoHostname
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(name, "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, nil
+	}
+}
+
+func hasHTTPMethod(data []byte) bool {
+	for _, method := range httpMethods {
+		n := len(method) + 1
+		if len(data) < n {
+			// wait for more data if the prefix matches
+			if strings.HasPrefix(method+" ", string(data)) {
+				return true
+			}
+			continue
+		}
+		if string(data[:n]) == method+" " {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package connect
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5/server"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffHostnameTLS(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	hello := make(chan []byte, 1)
+	recorder := &recordingConn{Conn: clientConn, written: hello}
+	go tls.Client(recorder, &tls.Config{ServerName: "example.com"}).Handshake() //nolint:errcheck
+
+	hostname, conn, err := sniffHostname(serverConn, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", hostname)
+
+	// peeked bytes are replayed unchanged
+	expected := <-hello
+	data := make([]byte, len(expected))
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	require.Equal(t, expected, data)
+}
+
+// recordingConn sends the first written buffer to the channel
+type recordingConn struct {
+	net.Conn
+	written chan []byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	select {
+	case c.written <- append([]byte(nil), b...):
+	default:
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSniffHostnameTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	hostname, conn, err := sniffHostname(serverConn, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Empty(t, hostname)
+
+	go clientConn.Write([]byte("SSH-2.0-OpenSSH\r\n")) //nolint:errcheck
+	data := make([]byte, 17)
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	require.Equal(t, "SSH-2.0-OpenSSH\r\n", string(data))
+}
+
+func TestParseHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		hostname string
+		err      error
+	}{
+		{name: "HTTPHost", data: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", hostname: "example.com"},
+		{name: "HTTPHostWithPort", data: "POST /a HTTP/1.1\r\nAccept: */*\r\nhost: example.com:8080\r\n", hostname: "example.com"},
+		{name: "HTTPHostIP", data: "GET / HTTP/1.1\r\nHost: 1.1.1.1\r\n\r\n", err: errSniffNoHostname},
+		{name: "HTTPNoHost", data: "GET / HTTP/1.0\r\n\r\n", err: errSniffNoHostname},
+		{name: "HTTPIncompleteMethod", data: "GE", err: errSniffIncomplete},
+		{name: "HTTPIncompleteHeaders", data: "GET / HTTP/1.1\r\nAccept: */*\r\n", err: errSniffIncomplete},
+		{name: "NotHTTP", data: "SSH-2.0-OpenSSH\r\n", err: errSniffNoHostname},
+		{name: "TLSIncomplete", data: "\x16\x03\x01\x02\x00\x01", err: errSniffIncomplete},
+		{name: "TLSNotClientHello", data: "\x16\x03\x03\x00\x04\x02\x00\x00\x00", err: errSniffNoHostname},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname, err := parseHostname([]byte(tt.data))
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.hostname, hostname)
+		})
+	}
+}
+
+// serverHandlerConnector connects to the in-memory SOCKS5 server handler
+type serverHandlerConnector struct {
+	handler server.Handler
+}
+
+func (c *serverHandlerConnector) DialContext(context.Context, string, string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	go c.handler.Handle(serverConn) //nolint:errcheck
+	return clientConn, nil
+}
+
+func TestSOCKS5ConnectorDestinationHostname(t *testing.T) {
+	log := zerolog.Nop()
+	dstConnector := newPipeConnector()
+	handler := NewServerHandler(&log, dstConnector, dstConnector, NewTransporter(&log))
+	connector := NewSOCKS5Connector(&serverHandlerConnector{handler: handler}, &SocksAddr{Address: "proxy:1080"})
+
+	ctx := withDestinationHostname(context.Background(), "example.com")
+	go func() {
+		conn, err := connector.DialContext(ctx, "tcp", "1.2.3.4:443")
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	require.Equal(t, "example.com:443", <-dstConnector.addresses)
+}
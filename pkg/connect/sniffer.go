@@ -0,0 +1,45 @@
+//go:build linux
+
+package connect
+
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// sniffingEndpoint is a link endpoint that captures all IP packets traversing the lower endpoint.
+type sniffingEndpoint struct {
+	nested.Endpoint
+	capture *PacketCapture
+}
+
+var _ stack.LinkEndpoint = (*sniffingEndpoint)(nil)
+var _ stack.NetworkDispatcher = (*sniffingEndpoint)(nil)
+
+func newSniffingEndpoint(lower stack.LinkEndpoint, capture *PacketCapture) stack.LinkEndpoint {
+	e := &sniffingEndpoint{capture: capture}
+	e.Endpoint.Init(lower, e)
+	return e
+}
+
+// DeliverNetworkPacket captures packets sent by the container.
+func (e *sniffingEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	e.writePacket(true, pkt)
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+// WritePackets captures packets sent to the container.
+func (e *sniffingEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pkt := range pkts.AsSlice() {
+		e.writePacket(false, pkt)
+	}
+	return e.Endpoint.WritePackets(pkts)
+}
+
+func (e *sniffingEndpoint) writePacket(outbound bool, pkt *stack.PacketBuffer) {
+	// write errors are reported on flush
+	_ = e.capture.WritePacket(time.Now(), outbound, pkt.AsSlices()...)
+}
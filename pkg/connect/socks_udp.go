@@ -0,0 +1,388 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"go.uber.org/multierr"
+)
+
+const (
+	// udpAssociationIdleTimeout is the time an association without flows is kept for new flows
+	udpAssociationIdleTimeout = 30 * time.Second
+	// udpFlowQueueSize is the number of received datagrams queued for each flow, extra datagrams are dropped
+	udpFlowQueueSize = 64
+)
+
+// socksUDPAssociation multiplexes UDP flows to different destinations over one SOCKS5 UDP association.
+// Replies are demultiplexed by the source address of the SOCKS5 UDP header, so flows of the same
+// association have distinct destinations.
+type socksUDPAssociation struct {
+	connector *socks5UDPConnector
+	// udpConn sends datagrams to the UDP relay of the proxy
+	udpConn net.Conn
+	// tcpConn is the control connection, the association terminates with it
+	tcpConn net.Conn
+
+	mu        sync.Mutex
+	flows     map[netip.AddrPort]*socksUDPFlowConn
+	idleTimer *time.Timer
+	closed    bool
+}
+
+func newSOCKSUDPAssociation(connector *socks5UDPConnector, udpConn, tcpConn net.Conn) *socksUDPAssociation {
+	a := &socksUDPAssociation{
+		connector: connector,
+		udpConn:   udpConn,
+		tcpConn:   tcpConn,
+		flows:     make(map[netip.AddrPort]*socksUDPFlowConn),
+	}
+	go a.readDatagrams()
+	go func() {
+		//nolint:errcheck
+		io.Copy(io.Discard, tcpConn)
+		// A UDP association terminates when the TCP connection that the UDP
+		// ASSOCIATE request arrived on terminates. RFC1928
+		a.close()
+	}()
+	return a
+}
+
+// open returns the new flow to the destination or false if the association is closed
+// or already has the flow to the same destination.
+func (a *socksUDPAssociation) open(dstAddr *net.UDPAddr) (*socksUDPFlowConn, bool) {
+	key := udpAddrKey(dstAddr.AddrPort())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, exists := a.flows[key]; exists || a.closed {
+		return nil, false
+	}
+	if a.idleTimer != nil {
+		a.idleTimer.Stop()
+		a.idleTimer = nil
+	}
+	flow := newSOCKSUDPFlowConn(a, dstAddr, key)
+	a.flows[key] = flow
+	return flow, true
+}
+
+// remove removes the closed flow, the association without flows is closed after the idle timeout.
+func (a *socksUDPAssociation) remove(flow *socksUDPFlowConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.flows[flow.key] != flow {
+		return
+	}
+	delete(a.flows, flow.key)
+	if len(a.flows) == 0 && !a.closed {
+		a.idleTimer = time.AfterFunc(a.connector.idleTimeout, a.closeIdle)
+	}
+}
+
+func (a *socksUDPAssociation) closeIdle() {
+	a.mu.Lock()
+	idle := len(a.flows) == 0
+	a.mu.Unlock()
+	if idle {
+		a.close()
+	}
+}
+
+// close terminates the association together with all its flows.
+func (a *socksUDPAssociation) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	if a.idleTimer != nil {
+		a.idleTimer.Stop()
+	}
+	flows := make([]*socksUDPFlowConn, 0, len(a.flows))
+	for _, flow := range a.flows {
+		flows = append(flows, flow)
+	}
+	a.mu.Unlock()
+
+	a.connector.removeAssociation(a)
+	if err := multierr.Append(a.udpConn.Close(), a.tcpConn.Close()); err != nil {
+		a.connector.log.Debug().Err(err).Msg("close udp association")
+	}
+	for _, flow := range flows {
+		flow.closeDone()
+	}
+	a.connector.log.Debug().Str("socksAddr", a.connector.socksAddress).Msg("udp association closed")
+}
+
+func (a *socksUDPAssociation) readDatagrams() {
+	defer a.close()
+	buf := trPool.Get().([]byte)
+	defer trPool.Put(buf) //nolint:staticcheck
+	for {
+		n, err := a.udpConn.Read(buf)
+		if err != nil {
+			return
+		}
+		packet, err := gosocks5.ReadUDPDatagram(bytes.NewReader(buf[:n]))
+		if err != nil {
+			a.connector.log.Debug().Err(err).Msg("invalid udp datagram")
+			continue
+		}
+		fromAddr, err := netip.ParseAddrPort(packet.Header.Addr.String())
+		if err != nil {
+			a.connector.log.Debug().Err(err).Msg("invalid udp datagram address")
+			continue
+		}
+		a.mu.Lock()
+		flow := a.flows[udpAddrKey(fromAddr)]
+		a.mu.Unlock()
+		if flow == nil {
+			a.connector.log.Debug().Stringer("fromAddr", fromAddr).Msg("udp datagram of unknown flow")
+			continue
+		}
+		flow.deliver(packet.Data)
+	}
+}
+
+func (a *socksUDPAssociation) writeTo(b []byte, dstAddr *net.UDPAddr) (n int, err error) {
+	toAddr, err := gosocks5.NewAddr(dstAddr.String())
+	if err != nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	h := &gosocks5.UDPHeader{Addr: toAddr}
+	if err = h.Write(buf); err != nil {
+		return
+	}
+	if _, err = buf.Write(b); err != nil {
+		return
+	}
+	_, err = a.udpConn.Write(buf.Bytes())
+	return len(b), err
+}
+
+// udpAddrKey unmaps IPv4-mapped IPv6 addresses, so that replies match destinations
+// regardless of the address family reported by the proxy.
+func udpAddrKey(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// socksUDPFlowConn is the UDP flow to the destination relayed over the shared association.
+type socksUDPFlowConn struct {
+	association   *socksUDPAssociation
+	dstAddr       *net.UDPAddr
+	key           netip.AddrPort
+	packets       chan []byte
+	done          chan struct{}
+	doneOnce      sync.Once
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+}
+
+var _ net.Conn = (*socksUDPFlowConn)(nil)
+
+func newSOCKSUDPFlowConn(association *socksUDPAssociation, dstAddr *net.UDPAddr, key netip.AddrPort) *socksUDPFlowConn {
+	return &socksUDPFlowConn{
+		association:   association,
+		dstAddr:       dstAddr,
+		key:           key,
+		packets:       make(chan []byte, udpFlowQueueSize),
+		done:          make(chan struct{}),
+		readDeadline:  makeConnDeadline(),
+		writeDeadline: makeConnDeadline(),
+	}
+}
+
+// deliver queues the received datagram, it is dropped if the queue is full.
+func (c *socksUDPFlowConn) deliver(data []byte) {
+	select {
+	case c.packets <- data:
+	default:
+	}
+}
+
+func (c *socksUDPFlowConn) Read(b []byte) (int, error) {
+	select {
+	case data := <-c.packets:
+		return copy(b, data), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *socksUDPFlowConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	return c.association.writeTo(b, c.dstAddr)
+}
+
+func (c *socksUDPFlowConn) Close() error {
+	c.association.remove(c)
+	c.closeDone()
+	return nil
+}
+
+func (c *socksUDPFlowConn) closeDone() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *socksUDPFlowConn) LocalAddr() net.Addr {
+	return c.association.udpConn.LocalAddr()
+}
+
+func (c *socksUDPFlowConn) RemoteAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *socksUDPFlowConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *socksUDPFlowConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *socksUDPFlowConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// connDeadline signals the deadline of blocking operations by closing the channel, like net.Pipe deadlines.
+type connDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeConnDeadline() connDeadline {
+	return connDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, zero time means no deadline.
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// wait for the timer callback to close the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns the channel that is closed when the deadline is exceeded.
+func (d *connDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// errAssociationUnavailable is returned when the new association is closed before the flow is opened.
+var errAssociationUnavailable = errors.New("udp association is unavailable")
+
+// dialAssociated opens the flow to the destination over the shared association,
+// a new association is requested only if all associations already have flows to the destination.
+func (c *socks5UDPConnector) dialAssociated(ctx context.Context, address string, dstAddr *net.UDPAddr) (net.Conn, error) {
+	if flow, ok := c.openFlow(dstAddr); ok {
+		return flow, nil
+	}
+	// concurrent flows wait for the requested association instead of requesting their own
+	select {
+	case c.dialSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-c.dialSem }()
+	if flow, ok := c.openFlow(dstAddr); ok {
+		return flow, nil
+	}
+
+	udpConn, tcpConn, err := c.associate(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	association := newSOCKSUDPAssociation(c, udpConn, tcpConn)
+	c.mu.Lock()
+	c.associations = append(c.associations, association)
+	c.mu.Unlock()
+	c.log.Debug().Str("socksAddr", c.socksAddress).Msg("udp association opened")
+	flow, ok := association.open(dstAddr)
+	if !ok {
+		// the proxy terminated the association right away
+		c.removeAssociation(association)
+		return nil, errAssociationUnavailable
+	}
+	return flow, nil
+}
+
+func (c *socks5UDPConnector) openFlow(dstAddr *net.UDPAddr) (*socksUDPFlowConn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, association := range c.associations {
+		if flow, ok := association.open(dstAddr); ok {
+			return flow, true
+		}
+	}
+	return nil, false
+}
+
+func (c *socks5UDPConnector) removeAssociation(association *socksUDPAssociation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, a := range c.associations {
+		if a == association {
+			c.associations = append(c.associations[:i], c.associations[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/ginuerzh/gosocks5/server"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// udpEchoProxy is the SOCKS5 proxy whose UDP relays send datagrams back to the client as
+// replies of their destinations.
+type udpEchoProxy struct {
+	t            *testing.T
+	associations int32
+	controlConns chan net.Conn
+}
+
+func newUDPEchoProxy(t *testing.T) *udpEchoProxy {
+	return &udpEchoProxy{t: t, controlConns: make(chan net.Conn, 16)}
+}
+
+func (p *udpEchoProxy) DialContext(context.Context, string, string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	p.t.Cleanup(func() { serverConn.Close() })
+	go p.serve(serverConn)
+	return clientConn, nil
+}
+
+func (p *udpEchoProxy) serve(conn net.Conn) {
+	ss := gosocks5.ServerConn(conn, server.DefaultSelector)
+	if err := ss.Handleshake(); err != nil {
+		return
+	}
+	if _, err := gosocks5.ReadRequest(ss); err != nil {
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	relayAddr, err := gosocks5.NewAddr(relay.LocalAddr().String())
+	if err != nil {
+		return
+	}
+	atomic.AddInt32(&p.associations, 1)
+	if err = gosocks5.NewReply(gosocks5.Succeeded, relayAddr).Write(ss); err != nil {
+		return
+	}
+	p.controlConns <- conn
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if _, err = relay.WriteToUDP(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 1)
+	//nolint:errcheck
+	conn.Read(buf)
+}
+
+func newTestSOCKS5UDPConnector(proxy *udpEchoProxy, idleTimeout time.Duration) *socks5UDPConnector {
+	log := zerolog.Nop()
+	connector := NewSOCKS5UDPConnector(&log, proxy, &net.Dialer{}, &SocksAddr{Address: "proxy:1080"}).(*socks5UDPConnector)
+	connector.idleTimeout = idleTimeout
+	return connector
+}
+
+func requireUDPEcho(t *testing.T, conn net.Conn, data string) {
+	t.Helper()
+	_, err := conn.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, data, string(buf[:n]))
+}
+
+func TestSOCKS5UDPConnectorSharesAssociation(t *testing.T) {
+	proxy := newUDPEchoProxy(t)
+	connector := newTestSOCKS5UDPConnector(proxy, time.Minute)
+	ctx := context.Background()
+
+	conn1, err := connector.DialContext(ctx, "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	conn2, err := connector.DialContext(ctx, "udp", "[2001:db8::1]:53")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&proxy.associations))
+
+	// replies are demultiplexed by their source addresses
+	requireUDPEcho(t, conn1, "first")
+	requireUDPEcho(t, conn2, "second")
+	require.Equal(t, "192.0.2.1:53", conn1.RemoteAddr().String())
+
+	// concurrent flows to the same destination need their own associations
+	conn3, err := connector.DialContext(ctx, "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&proxy.associations))
+	requireUDPEcho(t, conn3, "third")
+	requireUDPEcho(t, conn1, "fourth")
+
+	// the closed flow releases its destination
+	require.NoError(t, conn1.Close())
+	conn4, err := connector.DialContext(ctx, "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&proxy.associations))
+	requireUDPEcho(t, conn4, "fifth")
+
+	_, err = conn1.Write([]byte("closed"))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestSOCKS5UDPConnectorIdleAssociation(t *testing.T) {
+	proxy := newUDPEchoProxy(t)
+	const idleTimeout = 100 * time.Millisecond
+	connector := newTestSOCKS5UDPConnector(proxy, idleTimeout)
+	ctx := context.Background()
+
+	conn, err := connector.DialContext(ctx, "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// the association without flows is reused until the idle timeout
+	conn, err = connector.DialContext(ctx, "udp", "192.0.2.2:53")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&proxy.associations))
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		connector.mu.Lock()
+		defer connector.mu.Unlock()
+		return len(connector.associations) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn, err = connector.DialContext(ctx, "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&proxy.associations))
+	requireUDPEcho(t, conn, "ping")
+}
+
+func TestSOCKS5UDPConnectorClosedAssociation(t *testing.T) {
+	proxy := newUDPEchoProxy(t)
+	connector := newTestSOCKS5UDPConnector(proxy, time.Minute)
+
+	conn, err := connector.DialContext(context.Background(), "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	controlConn := <-proxy.controlConns
+
+	// flows are closed together with the control connection of their association
+	require.NoError(t, controlConn.Close())
+	_, err = conn.Read(make([]byte, 1500))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestSOCKS5UDPConnectorReadDeadline(t *testing.T) {
+	proxy := newUDPEchoProxy(t)
+	connector := newTestSOCKS5UDPConnector(proxy, time.Minute)
+
+	conn, err := connector.DialContext(context.Background(), "udp", "192.0.2.1:53")
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 1500))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the reset deadline unblocks reads again
+	requireUDPEcho(t, conn, "ping")
+}
@@ -0,0 +1,156 @@
+package connect
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// spliceChunkSize limits data spliced between activity updates
+	spliceChunkSize = 1 << 20
+	// spliceIdleSlices is the number of deadline windows per idle timeout,
+	// idle flows are closed within 1+1/spliceIdleSlices of the idle timeout
+	spliceIdleSlices = 4
+)
+
+// connUnwrapper is implemented by connection wrappers that relay data to the underlying
+// connection unchanged, so the transporter can bypass them.
+type connUnwrapper interface {
+	// unwrapConn returns the underlying connection or false if the wrapper can't be bypassed.
+	unwrapConn() (net.Conn, bool)
+}
+
+func (c *socksConn) unwrapConn() (net.Conn, bool) {
+	// the handshake is done, data is relayed over the raw connection as is
+	return c.rawConn, true
+}
+
+func (c *trackedConn) unwrapConn() (net.Conn, bool) {
+	return c.Conn, true
+}
+
+func (c *bufferedConn) unwrapConn() (net.Conn, bool) {
+	// peeked data must be read from the buffer first
+	return c.Conn, c.r.Buffered() == 0
+}
+
+// spliceFlow holds timeouts shared by both directions of the spliced flow.
+type spliceFlow struct {
+	// max amount of time without data in both directions, zero means no limit
+	idleTimeout time.Duration
+	// the time after which the flow fails, zero means no limit
+	deadline time.Time
+	// unix time in nanoseconds of the last relayed data
+	lastActive int64
+}
+
+func (f *spliceFlow) touch() {
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+// deadlines returns the read deadline of the next splice window and the write deadline
+// of the flow or false if the flow is idle or its lifetime is over.
+func (f *spliceFlow) deadlines() (readDeadline, writeDeadline time.Time, ok bool) {
+	now := time.Now()
+	if f.idleTimeout > 0 {
+		writeDeadline = time.Unix(0, atomic.LoadInt64(&f.lastActive)).Add(f.idleTimeout)
+	}
+	if !f.deadline.IsZero() && (writeDeadline.IsZero() || f.deadline.Before(writeDeadline)) {
+		writeDeadline = f.deadline
+	}
+	if !writeDeadline.IsZero() && !now.Before(writeDeadline) {
+		return
+	}
+	readDeadline = writeDeadline
+	if f.idleTimeout > 0 {
+		// short windows detect the activity of the opposite direction and trickling data
+		if window := now.Add(f.idleTimeout / spliceIdleSlices); window.Before(readDeadline) {
+			readDeadline = window
+		}
+	}
+	return readDeadline, writeDeadline, true
+}
+
+// spliceConn is the kernel TCP socket of the spliced flow.
+type spliceConn struct {
+	*net.TCPConn
+	flow *spliceFlow
+}
+
+// newSplicePair unwraps both relayed connections to TCP sockets, so that data is copied
+// by the kernel with splice(2) on Linux. Idle timeouts and lifetimes of TimeoutConn
+// wrappers are preserved, the earliest ones are applied to the whole flow.
+func newSplicePair(rw1, rw2 io.ReadWriter) (conn1, conn2 *spliceConn, ok bool) {
+	flow := &spliceFlow{}
+	if conn1, ok = unwrapSpliceConn(rw1, flow); !ok {
+		return
+	}
+	if conn2, ok = unwrapSpliceConn(rw2, flow); !ok {
+		return
+	}
+	flow.touch()
+	return
+}
+
+func unwrapSpliceConn(rw io.ReadWriter, flow *spliceFlow) (*spliceConn, bool) {
+	for {
+		switch conn := rw.(type) {
+		case *net.TCPConn:
+			return &spliceConn{TCPConn: conn, flow: flow}, true
+		case *TimeoutConn:
+			if conn.IOTimeout > 0 && (flow.idleTimeout == 0 || conn.IOTimeout < flow.idleTimeout) {
+				flow.idleTimeout = conn.IOTimeout
+			}
+			if !conn.Deadline.IsZero() && (flow.deadline.IsZero() || conn.Deadline.Before(flow.deadline)) {
+				flow.deadline = conn.Deadline
+			}
+			rw = conn.Conn
+		case connUnwrapper:
+			inner, ok := conn.unwrapConn()
+			if !ok {
+				return nil, false
+			}
+			rw = inner
+		default:
+			return nil, false
+		}
+	}
+}
+
+// spliceFrom copies data from src until EOF. Data is spliced in read deadline windows,
+// so the flow fails only if neither direction relays data during the idle timeout.
+func (c *spliceConn) spliceFrom(src *spliceConn) error {
+	for {
+		readDeadline, writeDeadline, ok := c.flow.deadlines()
+		if !ok {
+			return os.ErrDeadlineExceeded
+		}
+		if err := src.SetReadDeadline(readDeadline); err != nil {
+			return err
+		}
+		if err := c.SetWriteDeadline(writeDeadline); err != nil {
+			return err
+		}
+		r := &io.LimitedReader{R: src.TCPConn, N: spliceChunkSize}
+		n, err := c.TCPConn.ReadFrom(r)
+		if n > 0 {
+			c.flow.touch()
+		}
+		if err != nil {
+			// only the read window may be over, data read before the write timeout is lost
+			var terr timeoutError
+			if errors.As(err, &terr) && terr.Timeout() && time.Now().Before(writeDeadline) {
+				continue
+			}
+			return err
+		}
+		// the chunk isn't exhausted only on EOF
+		if r.N > 0 {
+			return nil
+		}
+	}
+}
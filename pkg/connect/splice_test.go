@@ -0,0 +1,215 @@
+//go:build linux
+
+package connect
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// plainConn hides the TCP socket from the transporter.
+type plainConn struct {
+	net.Conn
+}
+
+func TestNewSplicePair(t *testing.T) {
+	lifetime := time.Now().Add(time.Minute)
+	tests := []struct {
+		name     string
+		wrap     func(conn net.Conn) io.ReadWriter
+		ok       bool
+		idle     time.Duration
+		deadline time.Time
+	}{
+		{
+			name: "TCPConn",
+			wrap: func(conn net.Conn) io.ReadWriter { return conn },
+			ok:   true,
+		},
+		{
+			name: "TimeoutConn",
+			wrap: func(conn net.Conn) io.ReadWriter {
+				return &TimeoutConn{Conn: conn, IOTimeout: time.Second, Deadline: lifetime}
+			},
+			ok:       true,
+			idle:     time.Second,
+			deadline: lifetime,
+		},
+		{
+			name: "SOCKSConn",
+			wrap: func(conn net.Conn) io.ReadWriter {
+				buffered := newBufferedConn(&trackedConn{Conn: conn})
+				return NewTimeoutConn(newSOCKSConn(nil, buffered), time.Second)
+			},
+			ok:   true,
+			idle: time.Second,
+		},
+		{
+			name: "BufferedData",
+			wrap: func(conn net.Conn) io.ReadWriter {
+				buffered := newBufferedConn(conn)
+				_, err := buffered.Peek(1)
+				require.NoError(t, err)
+				return buffered
+			},
+		},
+		{
+			name: "ShapedConn",
+			wrap: func(conn net.Conn) io.ReadWriter { return &shapedReadWriter{ReadWriter: conn} },
+		},
+		{
+			name: "PlainConn",
+			wrap: func(conn net.Conn) io.ReadWriter { return NewTimeoutConn(plainConn{conn}, time.Second) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTCPConnPair(t)
+			_, err := client.Write([]byte{1})
+			require.NoError(t, err)
+
+			conn1, _, ok := newSplicePair(tt.wrap(server), NewTimeoutConn(client, time.Hour))
+			require.Equal(t, tt.ok, ok)
+			if !ok {
+				return
+			}
+			require.Same(t, server, conn1.TCPConn)
+			expectedIdle := tt.idle
+			if expectedIdle == 0 {
+				expectedIdle = time.Hour
+			}
+			require.Equal(t, expectedIdle, conn1.flow.idleTimeout)
+			require.Equal(t, tt.deadline, conn1.flow.deadline)
+		})
+	}
+}
+
+func TestTransporterSplice(t *testing.T) {
+	log := zerolog.Nop()
+	client, localConn := newTCPConnPair(t)
+	dstConn, server := newTCPConnPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- NewTransporter(&log).Transport(NewTimeoutConn(localConn, time.Minute),
+			NewTimeoutConn(dstConn, time.Minute))
+	}()
+
+	request := bytes.Repeat([]byte("ping"), 1<<20)
+	go func() {
+		_, _ = client.Write(request)
+		_ = client.(*net.TCPConn).CloseWrite()
+	}()
+	data, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, request, data)
+
+	// the response is relayed after the request side is closed
+	_, err = server.Write([]byte("pong"))
+	require.NoError(t, err)
+	require.NoError(t, server.Close())
+	data, err = io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(data))
+
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("transport is not finished")
+	}
+}
+
+func TestTransporterSpliceIdleTimeout(t *testing.T) {
+	log := zerolog.Nop()
+	client, localConn := newTCPConnPair(t)
+	dstConn, server := newTCPConnPair(t)
+	const idleTimeout = 200 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- NewTransporter(&log).Transport(NewTimeoutConn(localConn, idleTimeout),
+			NewTimeoutConn(dstConn, idleTimeout))
+	}()
+
+	// data in one direction keeps the whole flow active
+	go func() {
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	for i := 0; i < 10; i++ {
+		_, err := server.Write([]byte{1})
+		require.NoError(t, err)
+		time.Sleep(idleTimeout / 4)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("active flow is closed: %v", err)
+	default:
+	}
+
+	idleStarted := time.Now()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, time.Since(idleStarted), idleTimeout*3/4)
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow is not closed")
+	}
+}
+
+// BenchmarkTransporter compares throughput and CPU time of relaying TCP connections
+// through the user space buffer and splice.
+func BenchmarkTransporter(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		wrap func(conn net.Conn) net.Conn
+	}{
+		{name: "Copy", wrap: func(conn net.Conn) net.Conn { return plainConn{conn} }},
+		{name: "Splice", wrap: func(conn net.Conn) net.Conn { return conn }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			log := zerolog.Nop()
+			client, localConn := newTCPConnPair(b)
+			dstConn, server := newTCPConnPair(b)
+			go func() {
+				_ = NewTransporter(&log).Transport(NewTimeoutConn(bench.wrap(localConn), time.Minute),
+					NewTimeoutConn(bench.wrap(dstConn), time.Minute))
+			}()
+			const chunkSize = 64 << 10
+			chunk := make([]byte, chunkSize)
+			b.SetBytes(chunkSize)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := io.CopyN(io.Discard, server, int64(b.N)*chunkSize); err != nil {
+					b.Error(err)
+				}
+			}()
+
+			cpuStarted := cpuTime(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			wg.Wait()
+			b.StopTimer()
+			b.ReportMetric(float64(cpuTime(b)-cpuStarted)/float64(b.N), "cpu-ns/op")
+		})
+	}
+}
+
+// cpuTime returns user and system CPU time of the process.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	require.NoError(b, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
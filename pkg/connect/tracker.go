@@ -0,0 +1,107 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ConnTracker keeps track of accepted client connections until they are closed,
+// so that they can be drained on shutdown.
+type ConnTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// Listener wraps the listener to track all accepted connections.
+func (t *ConnTracker) Listener(ln net.Listener) net.Listener {
+	return &trackingListener{Listener: ln, tracker: t}
+}
+
+// Len returns the number of active connections.
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *ConnTracker) track(conn net.Conn) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tconn := &trackedConn{Conn: conn, tracker: t}
+	t.conns[tconn] = struct{}{}
+	t.wg.Add(1)
+	return tconn
+}
+
+func (t *ConnTracker) untrack(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	t.wg.Done()
+}
+
+// Drain waits for active connections to be closed. When ctx is done, all remaining
+// connections are closed and their number is returned.
+func (t *ConnTracker) Drain(ctx context.Context) (closed int) {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	<-done
+	return len(conns)
+}
+
+type trackingListener struct {
+	net.Listener
+	tracker *ConnTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.tracker.track(conn), nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker   *ConnTracker
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.tracker.untrack(c)
+	})
+	return err
+}
@@ -0,0 +1,98 @@
+package connect
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (*pipeListener) Close() error {
+	return nil
+}
+
+func (*pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func acceptPipeConns(t *testing.T, ln net.Listener, n int) []net.Conn {
+	t.Helper()
+	result := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		result = append(result, conn)
+	}
+	return result
+}
+
+func TestConnTrackerDrain(t *testing.T) {
+	t.Run("NoConnections", func(t *testing.T) {
+		tracker := NewConnTracker()
+		require.Zero(t, tracker.Drain(context.Background()))
+	})
+
+	t.Run("ConnectionsClosed", func(t *testing.T) {
+		tracker := NewConnTracker()
+		pl := &pipeListener{conns: make(chan net.Conn, 2)}
+		for i := 0; i < 2; i++ {
+			conn, _ := net.Pipe()
+			pl.conns <- conn
+		}
+		conns := acceptPipeConns(t, tracker.Listener(pl), 2)
+		require.Equal(t, 2, tracker.Len())
+
+		go func() {
+			for _, conn := range conns {
+				conn.Close()
+				// double close must not untrack twice
+				conn.Close()
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		require.Zero(t, tracker.Drain(ctx))
+		require.Zero(t, tracker.Len())
+	})
+
+	t.Run("ConnectionsForceClosed", func(t *testing.T) {
+		tracker := NewConnTracker()
+		pl := &pipeListener{conns: make(chan net.Conn, 2)}
+		for i := 0; i < 2; i++ {
+			conn, _ := net.Pipe()
+			pl.conns <- conn
+		}
+		conns := acceptPipeConns(t, tracker.Listener(pl), 2)
+
+		relayDone := make(chan error, len(conns))
+		for _, conn := range conns {
+			go func(conn net.Conn) {
+				_, err := io.Copy(io.Discard, conn)
+				relayDone <- err
+			}(conn)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.Equal(t, 2, tracker.Drain(ctx))
+		require.Zero(t, tracker.Len())
+		for range conns {
+			<-relayDone
+		}
+	})
+}
@@ -20,28 +20,59 @@ var (
 
 type TimeoutConn struct {
 	net.Conn
-	// specifies max amount of time to wait for Read/Write calls to complete
+	// specifies max amount of time to wait for Read/Write calls to complete, zero means no limit
 	IOTimeout time.Duration
+	// specifies the time after which Read/Write calls fail, zero means no limit
+	Deadline time.Time
 }
 
 func NewTimeoutConn(conn net.Conn, ioTimeout time.Duration) *TimeoutConn {
 	return &TimeoutConn{Conn: conn, IOTimeout: ioTimeout}
 }
 
+// WithLifetime limits Read/Write calls to the lifetime since now, zero means no limit.
+func (c *TimeoutConn) WithLifetime(lifetime time.Duration) *TimeoutConn {
+	if lifetime > 0 {
+		c.Deadline = time.Now().Add(lifetime)
+	}
+	return c
+}
+
 func (c *TimeoutConn) Read(b []byte) (n int, err error) {
-	if err = c.SetDeadline(time.Now().Add(c.IOTimeout)); err != nil {
+	if err = c.SetDeadline(c.deadline()); err != nil {
 		return
 	}
 	return c.Conn.Read(b)
 }
 
 func (c *TimeoutConn) Write(b []byte) (n int, err error) {
-	if err = c.SetDeadline(time.Now().Add(c.IOTimeout)); err != nil {
+	if err = c.SetDeadline(c.deadline()); err != nil {
 		return
 	}
 	return c.Conn.Write(b)
 }
 
+func (c *TimeoutConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// deadline returns the earliest of the i/o timeout and the lifetime deadlines.
+func (c *TimeoutConn) deadline() time.Time {
+	deadline := ioDeadline(c.IOTimeout)
+	if !c.Deadline.IsZero() && (deadline.IsZero() || c.Deadline.Before(deadline)) {
+		return c.Deadline
+	}
+	return deadline
+}
+
+// ioDeadline returns the deadline of the i/o operation, zero timeout means no deadline.
+func ioDeadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
 type Transporter interface {
 	Transport(rw1, rw2 io.ReadWriter) error
 }
@@ -54,19 +85,33 @@ type transporter struct {
 	log *zerolog.Logger
 }
 
+// Transport relays data in both directions until both of them finish, one of them fails
+// or times out. When one side reaches EOF, the writing side of the other one is shut down
+// and the opposite direction keeps running. If the other side doesn't support half-close,
+// the transport finishes right away. Data between two TCP sockets is spliced in the kernel.
 func (t *transporter) Transport(rw1, rw2 io.ReadWriter) error {
-	errc := make(chan error, 1)
-	copyBuf := func(w io.Writer, r io.Reader) {
-		buf := trPool.Get().([]byte)
-		defer trPool.Put(buf) //nolint:staticcheck
-
-		_, err := io.CopyBuffer(w, r, buf)
-		errc <- err
+	if conn1, conn2, ok := newSplicePair(rw1, rw2); ok {
+		t.log.Debug().Msg("splice connection")
+		rw1, rw2 = conn1, conn2
+	}
+	type copyResult struct {
+		err        error
+		halfClosed bool
 	}
-	go copyBuf(rw1, rw2)
-	go copyBuf(rw2, rw1)
+	results := make(chan copyResult, 2)
+	relay := func(w io.Writer, r io.Reader) {
+		err := copyData(w, r)
+		results <- copyResult{err: err, halfClosed: err == nil && closeWrite(w) == nil}
+	}
+	go relay(rw1, rw2)
+	go relay(rw2, rw1)
 
-	err := <-errc
+	result := <-results
+	if result.halfClosed {
+		t.log.Debug().Msg("half-close connection")
+		result = <-results
+	}
+	err := result.err
 	t.log.Debug().Err(err).Msg("close connection")
 	var terr timeoutError
 	if err == io.EOF || (errors.As(err, &terr) && terr.Timeout()) {
@@ -75,7 +120,36 @@ func (t *transporter) Transport(rw1, rw2 io.ReadWriter) error {
 	return err
 }
 
+// copyData copies data from r to w until EOF.
+func copyData(w io.Writer, r io.Reader) (err error) {
+	if dst, ok := w.(*spliceConn); ok {
+		if src, ok := r.(*spliceConn); ok {
+			return dst.spliceFrom(src)
+		}
+	}
+	buf := trPool.Get().([]byte)
+	defer trPool.Put(buf) //nolint:staticcheck
+
+	_, err = io.CopyBuffer(w, r, buf)
+	return
+}
+
 type timeoutError interface {
 	error
 	Timeout() bool
 }
+
+var errHalfCloseUnsupported = errors.New("half-close is not supported")
+
+// closeWriter is implemented by connections that support half-close, e.g. *net.TCPConn and gonet.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of the connection if it supports half-close.
+func closeWrite(w interface{}) error {
+	if cw, ok := w.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
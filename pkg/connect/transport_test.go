@@ -0,0 +1,125 @@
+package connect
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTCPConnPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	server, err := ln.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestTimeoutConn(t *testing.T) {
+	t.Run("IdleTimeout", func(t *testing.T) {
+		client, _ := newTCPConnPair(t)
+		conn := NewTimeoutConn(client, 50*time.Millisecond)
+		_, err := conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+	t.Run("NoIdleTimeout", func(t *testing.T) {
+		client, server := newTCPConnPair(t)
+		conn := NewTimeoutConn(client, 0)
+		time.AfterFunc(100*time.Millisecond, func() {
+			server.Write([]byte{1})
+		})
+		n, err := conn.Read(make([]byte, 1))
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	})
+	t.Run("LifetimeExceeded", func(t *testing.T) {
+		client, server := newTCPConnPair(t)
+		conn := NewTimeoutConn(client, time.Minute).WithLifetime(150 * time.Millisecond)
+		started := time.Now()
+		buf := make([]byte, 1)
+		// traffic keeps the flow from being idle
+		for i := 0; ; i++ {
+			time.AfterFunc(20*time.Millisecond, func() {
+				server.Write([]byte{1})
+			})
+			if _, err := conn.Read(buf); err != nil {
+				require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+				break
+			}
+			require.Less(t, i, 100)
+		}
+		require.GreaterOrEqual(t, time.Since(started), 150*time.Millisecond)
+		_, err := conn.Write([]byte{1})
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+	t.Run("LifetimeWithoutIdleTimeout", func(t *testing.T) {
+		client, _ := newTCPConnPair(t)
+		conn := NewTimeoutConn(client, 0).WithLifetime(50 * time.Millisecond)
+		_, err := conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestTransporterHalfClose(t *testing.T) {
+	log := zerolog.Nop()
+	client, localConn := newTCPConnPair(t)
+	dstConn, server := newTCPConnPair(t)
+	done := make(chan error, 1)
+	go func() {
+		// wrappers of relayed connections keep half-close support
+		done <- NewTransporter(&log).Transport(NewTimeoutConn(localConn, time.Minute),
+			&shapedReadWriter{ReadWriter: NewTimeoutConn(dstConn, time.Minute)})
+	}()
+
+	_, err := client.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+	data, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(data))
+
+	// the response is relayed after the request side is closed
+	_, err = server.Write([]byte("pong"))
+	require.NoError(t, err)
+	require.NoError(t, server.Close())
+	data, err = io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(data))
+
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("transport is not finished")
+	}
+}
+
+func TestTransporterWithoutHalfClose(t *testing.T) {
+	log := zerolog.Nop()
+	client, localConn := net.Pipe()
+	defer client.Close()
+	dstConn, server := net.Pipe()
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewTransporter(&log).Transport(localConn, dstConn)
+	}()
+
+	require.NoError(t, client.Close())
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("transport is not finished")
+	}
+}
@@ -0,0 +1,168 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnknownForward = errors.New("unknown forward name")
+
+// UpstreamHealth is the passive health of the upstream derived from its recent dials.
+type UpstreamHealth struct {
+	Name                string        `json:"name"`
+	Healthy             bool          `json:"healthy"`
+	Dials               uint64        `json:"dials"`
+	Failures            uint64        `json:"failures"`
+	ConsecutiveFailures uint64        `json:"consecutive_failures"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastDial            time.Time     `json:"last_dial"`
+	ConnectTime         time.Duration `json:"connect_time"`
+}
+
+// UpstreamMonitor records results of dials through the upstream.
+type UpstreamMonitor struct {
+	mu     sync.Mutex
+	health UpstreamHealth
+}
+
+func NewUpstreamMonitor(name string) *UpstreamMonitor {
+	return &UpstreamMonitor{health: UpstreamHealth{Name: name, Healthy: true}}
+}
+
+// Connector wraps the connector of the upstream to monitor its dials.
+func (m *UpstreamMonitor) Connector(connector Connector) Connector {
+	return &monitoredConnector{Connector: connector, monitor: m}
+}
+
+// Health returns the current health of the upstream. The upstream is healthy
+// until dials through it fail.
+func (m *UpstreamMonitor) Health() UpstreamHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.health
+}
+
+func (m *UpstreamMonitor) record(started time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := &m.health
+	h.Dials++
+	h.LastDial = started
+	// the proxy that reports the unavailable destination is healthy itself
+	var replyErr *SOCKSReplyError
+	if err != nil && !errors.As(err, &replyErr) {
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+		h.Healthy = false
+		return
+	}
+	h.ConsecutiveFailures = 0
+	h.Healthy = true
+	h.ConnectTime = time.Since(started)
+}
+
+type monitoredConnector struct {
+	Connector
+	monitor *UpstreamMonitor
+}
+
+func (c *monitoredConnector) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	started := time.Now()
+	conn, err := c.Connector.DialContext(ctx, network, address)
+	c.monitor.record(started, err)
+	return conn, err
+}
+
+// ForwardSwitch routes flows through the active one of named upstream routes,
+// e.g. chains and pools of the config file.
+type ForwardSwitch struct {
+	mu     sync.RWMutex
+	active string
+	routes map[string]*forwardRoute
+}
+
+type forwardRoute struct {
+	tcpConn Connector
+	udpConn Connector
+}
+
+func NewForwardSwitch() *ForwardSwitch {
+	return &ForwardSwitch{routes: make(map[string]*forwardRoute)}
+}
+
+// Add adds the named route, the first added route is active.
+func (s *ForwardSwitch) Add(name string, tcpConn, udpConn Connector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[name] = &forwardRoute{tcpConn: tcpConn, udpConn: udpConn}
+	if s.active == "" {
+		s.active = name
+	}
+}
+
+// Switch makes the named route active for new flows.
+func (s *ForwardSwitch) Switch(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.routes[name]; !ok {
+		return ErrUnknownForward
+	}
+	s.active = name
+	return nil
+}
+
+// Active returns the name of the active route.
+func (s *ForwardSwitch) Active() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// Names returns sorted names of all routes.
+func (s *ForwardSwitch) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.routes))
+	for name := range s.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TCPConnector returns the connector that dials TCP flows through the active route.
+func (s *ForwardSwitch) TCPConnector() Connector {
+	return &switchConnector{s: s}
+}
+
+// UDPConnector returns the connector that dials UDP flows through the active route.
+func (s *ForwardSwitch) UDPConnector() Connector {
+	return &switchConnector{s: s, udp: true}
+}
+
+func (s *ForwardSwitch) activeRoute() *forwardRoute {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.routes[s.active]
+}
+
+type switchConnector struct {
+	s   *ForwardSwitch
+	udp bool
+}
+
+func (c *switchConnector) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	route := c.s.activeRoute()
+	if route == nil {
+		return nil, ErrUnknownForward
+	}
+	if c.udp {
+		return route.udpConn.DialContext(ctx, network, address)
+	}
+	return route.tcpConn.DialContext(ctx, network, address)
+}
@@ -0,0 +1,93 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/stretchr/testify/require"
+)
+
+// failingConnector fails dials with the error if it is set
+type failingConnector struct {
+	err error
+}
+
+func (c *failingConnector) DialContext(context.Context, string, string) (net.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &net.TCPConn{}, nil
+}
+
+func TestUpstreamMonitor(t *testing.T) {
+	connector := &failingConnector{}
+	monitor := NewUpstreamMonitor("127.0.0.1:1080")
+	monitored := monitor.Connector(connector)
+
+	health := monitor.Health()
+	require.Equal(t, "127.0.0.1:1080", health.Name)
+	require.True(t, health.Healthy)
+	require.Zero(t, health.Dials)
+
+	connector.err = errors.New("connection refused")
+	_, err := monitored.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.Error(t, err)
+	_, err = monitored.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.Error(t, err)
+	health = monitor.Health()
+	require.False(t, health.Healthy)
+	require.Equal(t, uint64(2), health.Dials)
+	require.Equal(t, uint64(2), health.Failures)
+	require.Equal(t, uint64(2), health.ConsecutiveFailures)
+	require.Equal(t, "connection refused", health.LastError)
+	require.False(t, health.LastDial.IsZero())
+
+	connector.err = nil
+	_, err = monitored.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.NoError(t, err)
+	health = monitor.Health()
+	require.True(t, health.Healthy)
+	require.Equal(t, uint64(3), health.Dials)
+	require.Equal(t, uint64(2), health.Failures)
+	require.Zero(t, health.ConsecutiveFailures)
+
+	// the unavailable destination doesn't make the upstream unhealthy
+	connector.err = &SOCKSReplyError{Address: "1.1.1.1:443", Reply: gosocks5.HostUnreachable}
+	_, err = monitored.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.Error(t, err)
+	health = monitor.Health()
+	require.True(t, health.Healthy)
+	require.Equal(t, uint64(4), health.Dials)
+	require.Equal(t, uint64(2), health.Failures)
+}
+
+func TestForwardSwitch(t *testing.T) {
+	dialedRoute := func(connector Connector) string {
+		_, err := connector.DialContext(context.Background(), "tcp", "1.1.1.1:443")
+		require.Error(t, err)
+		return err.Error()
+	}
+	forward := NewForwardSwitch()
+	_, err := forward.TCPConnector().DialContext(context.Background(), "tcp", "1.1.1.1:443")
+	require.ErrorIs(t, err, ErrUnknownForward)
+
+	forward.Add("tor", &failingConnector{err: errors.New("tor tcp")}, &failingConnector{err: errors.New("tor udp")})
+	forward.Add("eu", &failingConnector{err: errors.New("eu tcp")}, &failingConnector{err: errors.New("eu udp")})
+	require.Equal(t, "tor", forward.Active())
+	require.Equal(t, []string{"eu", "tor"}, forward.Names())
+
+	tcpConn, udpConn := forward.TCPConnector(), forward.UDPConnector()
+	require.Equal(t, "tor tcp", dialedRoute(tcpConn))
+	require.Equal(t, "tor udp", dialedRoute(udpConn))
+
+	require.NoError(t, forward.Switch("eu"))
+	require.Equal(t, "eu", forward.Active())
+	require.Equal(t, "eu tcp", dialedRoute(tcpConn))
+	require.Equal(t, "eu udp", dialedRoute(udpConn))
+
+	require.ErrorIs(t, forward.Switch("us"), ErrUnknownForward)
+	require.Equal(t, "eu", forward.Active())
+}
@@ -0,0 +1,280 @@
+package connect
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"golang.org/x/time/rate"
+)
+
+var ErrQuotaExceeded = errors.New("data quota exceeded")
+
+// UserLimits describes bandwidth limits and data quotas of the user, zero values mean unlimited.
+type UserLimits struct {
+	// Rate limits the total throughput of all user connections in bytes per second
+	Rate int64
+	// ConnRate limits the throughput of each user connection in bytes per second
+	ConnRate int64
+	// DailyQuota limits the number of bytes transferred per calendar day
+	DailyQuota int64
+	// MonthlyQuota limits the number of bytes transferred per calendar month
+	MonthlyQuota int64
+}
+
+type User struct {
+	Name     string
+	Password string
+	Limits   UserLimits
+}
+
+// UserManager authenticates server users and enforces their limits. Data usage
+// is persisted to the state file, if it is set.
+type UserManager struct {
+	mu        sync.Mutex
+	users     map[string]*userState
+	stateFile string
+	now       func() time.Time
+}
+
+type userState struct {
+	*User
+	limiter *rate.Limiter
+	// guarded by UserManager.mu
+	usage *userUsage
+}
+
+type userUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+func NewUserManager(users []*User, stateFile string) (*UserManager, error) {
+	m := &UserManager{
+		users:     make(map[string]*userState, len(users)),
+		stateFile: stateFile,
+		now:       time.Now,
+	}
+	for _, user := range users {
+		m.users[user.Name] = &userState{
+			User:    user,
+			limiter: newByteLimiter(user.Limits.Rate),
+			usage:   &userUsage{},
+		}
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *UserManager) load() error {
+	if m.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state map[string]*userUsage
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for name, usage := range state {
+		if user, ok := m.users[name]; ok && usage != nil {
+			user.usage = usage
+		}
+	}
+	return nil
+}
+
+// Save writes the data usage of all users to the state file.
+func (m *UserManager) Save() error {
+	if m.stateFile == "" {
+		return nil
+	}
+	m.mu.Lock()
+	state := make(map[string]userUsage, len(m.users))
+	for name, user := range m.users {
+		state[name] = *user.usage
+	}
+	m.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first to never leave a truncated state file
+	tmpFile, err := os.CreateTemp(filepath.Dir(m.stateFile), filepath.Base(m.stateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), m.stateFile)
+}
+
+func (m *UserManager) authenticate(name, password string) *userState {
+	user, ok := m.users[name]
+	// the password comparison doesn't leak the matched prefix length through timing
+	if !ok || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// checkQuota returns ErrQuotaExceeded if the user has exhausted any of the data quotas.
+func (m *UserManager) checkQuota(user *userState) error {
+	return m.consume(user, 0)
+}
+
+// consume checks quotas and adds n bytes to the data usage of the user,
+// the usage is not changed if the bytes exceed any of the quotas.
+func (m *UserManager) consume(user *userState, n int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	usage := user.usage
+	if day := now.Format("2006-01-02"); usage.Day != day {
+		usage.Day = day
+		usage.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); usage.Month != month {
+		usage.Month = month
+		usage.MonthBytes = 0
+	}
+	limits := user.Limits
+	if quotaExceeded(usage.DayBytes, n, limits.DailyQuota) || quotaExceeded(usage.MonthBytes, n, limits.MonthlyQuota) {
+		return ErrQuotaExceeded
+	}
+	usage.DayBytes += int64(n)
+	usage.MonthBytes += int64(n)
+	return nil
+}
+
+// quotaExceeded reports whether n more bytes don't fit into the quota, or the quota is exhausted already.
+func quotaExceeded(used int64, n int, quota int64) bool {
+	return quota > 0 && (used+int64(n) > quota || used >= quota)
+}
+
+// newConn wraps the client connection of the user to enforce limits.
+func (m *UserManager) newConn(conn net.Conn, user *userState) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &userConn{
+		Conn:        conn,
+		manager:     m,
+		user:        user,
+		connLimiter: newByteLimiter(user.Limits.ConnRate),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// userConn applies bandwidth limits and accounts data usage of all bytes read from and written to the connection.
+type userConn struct {
+	net.Conn
+	manager     *UserManager
+	user        *userState
+	connLimiter *rate.Limiter
+	// ctx is canceled on close to interrupt waiting for limiters
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *userConn) Read(b []byte) (n int, err error) {
+	if n, err = c.Conn.Read(b); n > 0 {
+		if lerr := c.limit(n); lerr != nil {
+			return n, lerr
+		}
+	}
+	return
+}
+
+func (c *userConn) Write(b []byte) (n int, err error) {
+	if err = c.limit(len(b)); err != nil {
+		return
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *userConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *userConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *userConn) limit(n int) error {
+	if err := c.manager.consume(c.user, n); err != nil {
+		return err
+	}
+	if err := waitBytes(c.ctx, n, c.user.limiter, c.connLimiter); err != nil {
+		if c.ctx.Err() != nil {
+			return net.ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// userSelector is a SOCKS5 server selector that requires username/password authentication.
+// It is created for each client connection to remember the authenticated user.
+type userSelector struct {
+	users *UserManager
+	user  *userState
+}
+
+func (*userSelector) Methods() []uint8 {
+	return []uint8{gosocks5.MethodUserPass}
+}
+
+func (*userSelector) Select(methods ...uint8) uint8 {
+	for _, method := range methods {
+		if method == gosocks5.MethodUserPass {
+			return method
+		}
+	}
+	return gosocks5.MethodNoAcceptable
+}
+
+func (s *userSelector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
+	if method != gosocks5.MethodUserPass {
+		return nil, gosocks5.ErrBadMethod
+	}
+	req, err := gosocks5.ReadUserPassRequest(conn)
+	if err != nil {
+		return nil, err
+	}
+	if s.user = s.users.authenticate(req.Username, req.Password); s.user == nil {
+		resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Failure)
+		if err := resp.Write(conn); err != nil {
+			return nil, err
+		}
+		return nil, gosocks5.ErrAuthFailure
+	}
+	resp := gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Succeeded)
+	if err := resp.Write(conn); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
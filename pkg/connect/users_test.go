@@ -0,0 +1,253 @@
+package connect
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ginuerzh/gosocks5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserManagerQuota(t *testing.T) {
+	now := time.Date(2022, 11, 30, 23, 0, 0, 0, time.UTC)
+	m, err := NewUserManager([]*User{
+		{Name: "daily", Limits: UserLimits{DailyQuota: 100}},
+		{Name: "monthly", Limits: UserLimits{MonthlyQuota: 150}},
+	}, "")
+	require.NoError(t, err)
+	m.now = func() time.Time { return now }
+
+	daily := m.users["daily"]
+	require.NoError(t, m.consume(daily, 99))
+	// the rejected bytes are not accounted
+	require.ErrorIs(t, m.consume(daily, 2), ErrQuotaExceeded)
+	require.Equal(t, int64(99), daily.usage.DayBytes)
+	require.NoError(t, m.checkQuota(daily))
+	// the transfer may use up the quota exactly
+	require.NoError(t, m.consume(daily, 1))
+	require.ErrorIs(t, m.checkQuota(daily), ErrQuotaExceeded)
+	require.ErrorIs(t, m.consume(daily, 1), ErrQuotaExceeded)
+	require.Equal(t, int64(100), daily.usage.DayBytes)
+
+	monthly := m.users["monthly"]
+	require.NoError(t, m.consume(monthly, 100))
+
+	// next day resets the daily quota only
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, m.checkQuota(daily))
+	require.NoError(t, m.consume(monthly, 100))
+
+	now = now.Add(-2 * time.Hour)
+	m.users["monthly"].usage = &userUsage{Month: "2022-11", MonthBytes: 100}
+	require.ErrorIs(t, m.consume(monthly, 51), ErrQuotaExceeded)
+	require.NoError(t, m.consume(monthly, 50))
+}
+
+func TestUserManagerSaveLoad(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quota.json")
+	users := []*User{{Name: "abc", Limits: UserLimits{DailyQuota: 1000}}}
+	m, err := NewUserManager(users, stateFile)
+	require.NoError(t, err)
+	require.NoError(t, m.consume(m.users["abc"], 600))
+	require.NoError(t, m.Save())
+
+	m, err = NewUserManager(users, stateFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(600), m.users["abc"].usage.DayBytes)
+	require.ErrorIs(t, m.consume(m.users["abc"], 401), ErrQuotaExceeded)
+}
+
+func TestUserConnQuotaExceeded(t *testing.T) {
+	m, err := NewUserManager([]*User{{Name: "abc", Limits: UserLimits{DailyQuota: 10}}}, "")
+	require.NoError(t, err)
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+	go io.Copy(io.Discard, conn2) //nolint:errcheck
+
+	uconn := m.newConn(conn1, m.users["abc"])
+	_, err = uconn.Write([]byte("12345"))
+	require.NoError(t, err)
+	_, err = uconn.Write([]byte("12345"))
+	require.NoError(t, err)
+	_, err = uconn.Write([]byte("1"))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestUserConnCloseInterruptsLimit(t *testing.T) {
+	m, err := NewUserManager([]*User{{Name: "abc", Limits: UserLimits{ConnRate: 1}}}, "")
+	require.NoError(t, err)
+	conn1, conn2 := net.Pipe()
+	defer conn2.Close()
+	go io.Copy(io.Discard, conn2) //nolint:errcheck
+
+	uconn := m.newConn(conn1, m.users["abc"])
+	// the second burst waits for hours at the connection rate
+	result := make(chan error, 1)
+	go func() {
+		_, err := uconn.Write(make([]byte, 2*minLimiterBurst))
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, uconn.Close())
+	select {
+	case err = <-result:
+		require.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "write is not interrupted by close")
+	}
+}
+
+func startAuthServerHandler(t *testing.T, connector Connector, users []*User) net.Conn {
+	t.Helper()
+	log := zerolog.Nop()
+	m, err := NewUserManager(users, "")
+	require.NoError(t, err)
+	h := NewServerHandler(&log, connector, connector, NewTransporter(&log), WithUsers(m))
+	clientConn, serverConn := net.Pipe()
+	go h.Handle(serverConn) //nolint:errcheck
+	t.Cleanup(func() { clientConn.Close() })
+	return clientConn
+}
+
+func TestServerHandlerSOCKS5Auth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		status   uint8
+	}{
+		{name: "ValidPassword", password: "def", status: gosocks5.Succeeded},
+		{name: "InvalidPassword", password: "xyz", status: gosocks5.Failure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := startAuthServerHandler(t, newPipeConnector(), []*User{{Name: "abc", Password: "def"}})
+
+			go conn.Write([]byte{gosocks5.Ver5, 2, gosocks5.MethodNoAuth, gosocks5.MethodUserPass}) //nolint:errcheck
+			br := bufio.NewReader(conn)
+			method := make([]byte, 2)
+			_, err := io.ReadFull(br, method)
+			require.NoError(t, err)
+			require.Equal(t, []byte{gosocks5.Ver5, gosocks5.MethodUserPass}, method)
+
+			go gosocks5.NewUserPassRequest(gosocks5.UserPassVer, "abc", tt.password).Write(conn) //nolint:errcheck
+			resp, err := gosocks5.ReadUserPassResponse(br)
+			require.NoError(t, err)
+			require.Equal(t, tt.status, resp.Status)
+		})
+	}
+}
+
+func TestServerHandlerSOCKS5QuotaExceeded(t *testing.T) {
+	users := []*User{{Name: "abc", Password: "def", Limits: UserLimits{DailyQuota: 1}}}
+	log := zerolog.Nop()
+	m, err := NewUserManager(users, "")
+	require.NoError(t, err)
+	// use up the quota
+	require.NoError(t, m.consume(m.users["abc"], 1))
+	connector := newPipeConnector()
+	h := NewServerHandler(&log, connector, connector, NewTransporter(&log), WithUsers(m))
+	conn, serverConn := net.Pipe()
+	defer conn.Close()
+	go h.Handle(serverConn) //nolint:errcheck
+
+	go conn.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodUserPass}) //nolint:errcheck
+	br := bufio.NewReader(conn)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(br, method)
+	require.NoError(t, err)
+	go gosocks5.NewUserPassRequest(gosocks5.UserPassVer, "abc", "def").Write(conn) //nolint:errcheck
+	_, err = gosocks5.ReadUserPassResponse(br)
+	require.NoError(t, err)
+
+	req := gosocks5.NewRequest(gosocks5.CmdConnect, &gosocks5.Addr{Type: gosocks5.AddrDomain, Host: "example.com", Port: 80})
+	go req.Write(conn) //nolint:errcheck
+	reply, err := gosocks5.ReadReply(br)
+	require.NoError(t, err)
+	require.Equal(t, uint8(gosocks5.NotAllowed), reply.Rep)
+}
+
+func TestServerHandlerSOCKS5UDPAccounted(t *testing.T) {
+	users := []*User{{Name: "abc", Password: "def", Limits: UserLimits{DailyQuota: 100}}}
+	log := zerolog.Nop()
+	m, err := NewUserManager(users, "")
+	require.NoError(t, err)
+	connector := newPipeConnector()
+	h := NewServerHandler(&log, connector, connector, NewTransporter(&log), WithUsers(m))
+	// the UDP relay listens on the address of the TCP listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		if serverConn, err := ln.Accept(); err == nil {
+			h.Handle(serverConn) //nolint:errcheck
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{gosocks5.Ver5, 1, gosocks5.MethodUserPass})
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(br, method)
+	require.NoError(t, err)
+	require.NoError(t, gosocks5.NewUserPassRequest(gosocks5.UserPassVer, "abc", "def").Write(conn))
+	_, err = gosocks5.ReadUserPassResponse(br)
+	require.NoError(t, err)
+	require.NoError(t, gosocks5.NewRequest(gosocks5.CmdUdp, &gosocks5.Addr{Type: gosocks5.AddrIPv4}).Write(conn))
+	reply, err := gosocks5.ReadReply(br)
+	require.NoError(t, err)
+	require.Equal(t, uint8(gosocks5.Succeeded), reply.Rep)
+
+	udpConn, err := net.Dial("udp", reply.Addr.String())
+	require.NoError(t, err)
+	defer udpConn.Close()
+	_, err = udpConn.Write([]byte("ping"))
+	require.NoError(t, err)
+	dstConn := <-connector.conns
+	defer dstConn.Close()
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(dstConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	// the first datagram of the association is accounted as well
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Equal(t, int64(4), m.users["abc"].usage.DayBytes)
+}
+
+func TestServerHandlerHTTPAuthRequired(t *testing.T) {
+	conn := startAuthServerHandler(t, newPipeConnector(), []*User{{Name: "abc", Password: "def"}})
+
+	go conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")) //nolint:errcheck
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	require.Equal(t, `Basic realm="wirez"`, resp.Header.Get("Proxy-Authenticate"))
+}
+
+func TestServerHandlerHTTPAuth(t *testing.T) {
+	connector := newPipeConnector()
+	conn := startAuthServerHandler(t, connector, []*User{{Name: "abc", Password: "def"}})
+
+	go conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" + //nolint:errcheck
+		"Proxy-Authorization: Basic YWJjOmRlZg==\r\n\r\n"))
+	require.Equal(t, "example.com:443", <-connector.addresses)
+	dstConn := <-connector.conns
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	requireEcho(t, &bufferedConn{Conn: conn, r: br}, dstConn)
+}